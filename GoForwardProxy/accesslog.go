@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"goproxycommon/accesslog"
+)
+
+// SetAccessLog 设置访问日志
+func (p *ForwardProxy) SetAccessLog(logger *accesslog.Logger) {
+	p.accessLog = logger
+}
+
+// serveObserved 调用handler处理请求，记录请求指标，开启访问日志时写入访问记录；
+// 连接被接管的请求由隧道结束时写入访问日志
+func (p *ForwardProxy) serveObserved(w http.ResponseWriter, r *http.Request, handler func(http.ResponseWriter, *http.Request)) {
+	var e *accesslog.Entry
+	if p.accessLog != nil {
+		e = accesslog.NewEntry(r)
+	}
+	lw := accesslog.NewResponseWriter(w)
+	// handler以http.ErrAbortHandler中断时也要记录
+	defer p.finishObserved(r, lw, e)
+	handler(lw, r)
+}
+
+// finishObserved 请求处理结束后记录指标和访问日志
+func (p *ForwardProxy) finishObserved(r *http.Request, lw *accesslog.ResponseWriter, e *accesslog.Entry) {
+	p.metrics.observeRequest(r, lw)
+	if e == nil || lw.Hijacked() {
+		return
+	}
+	if info := requestInfoFrom(r.Context()); info != nil {
+		e.User = info.user
+		e.Upstream, e.Parent = info.upstream, info.parent
+	}
+	e.Finish(lw)
+	p.accessLog.Log(e)
+}
+
+// setPeer 记录请求实际连接的上游地址，去掉TLS、故障注入和协议升级的包装
+func (info *requestInfo) setPeer(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			conn = c.NetConn()
+			continue
+		case *faultConn:
+			conn = c.Conn
+			continue
+		case *upgradedConn:
+			conn = c.Conn
+			continue
+		}
+		break
+	}
+	if pc, ok := conn.(*parentConn); ok {
+		info.upstream, info.parent = pc.parent, true
+		return
+	}
+	info.upstream, info.parent = conn.RemoteAddr().String(), false
+}
+
+// logTunnel 隧道结束时写入访问日志
+func (p *ForwardProxy) logTunnel(t *Tunnel, method string, targetConn net.Conn) {
+	if p.accessLog == nil {
+		return
+	}
+	info := t.Info()
+	e := &accesslog.Entry{
+		Time:     t.Start,
+		Duration: time.Since(t.Start),
+		Client:   t.Client,
+		User:     t.User,
+		Method:   method,
+		URL:      t.Target,
+		Status:   hijackedStatus(method),
+		Bytes:    info.BytesOut,
+		BytesIn:  info.BytesIn,
+	}
+	peer := &requestInfo{}
+	peer.setPeer(targetConn)
+	e.Upstream, e.Parent = peer.upstream, peer.parent
+	p.accessLog.Log(e)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"goproxycommon/accesslog"
+)
+
+// syncBuffer 可并发读写的缓冲区
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// entries 解析已写入的JSON访问记录
+func (b *syncBuffer) entries(t *testing.T) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("访问日志不是有效的JSON: %q", line)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// TestAccessLog 测试HTTP请求和CONNECT隧道的访问日志
+func TestAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "hello")
+	}))
+	defer backend.Close()
+	echoAddr := startEchoServer(t)
+
+	var buf syncBuffer
+	proxy := NewForwardProxy()
+	proxy.SetAccessLog(accesslog.New(&buf, accesslog.FormatJSON))
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+	resp, err := client.Get(backend.URL + "/path")
+	if err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	conn, br := dialConnect(t, proxyURL.Host, echoAddr)
+	conn.Write([]byte("ping"))
+	io.ReadFull(br, make([]byte, 4))
+	conn.Close()
+
+	// 隧道在关闭后才写入日志
+	var entries []map[string]interface{}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if entries = buf.entries(t); len(entries) == 2 {
+			break
+		}
+	}
+	if len(entries) != 2 {
+		t.Fatalf("期望2条访问记录, 实际 %d", len(entries))
+	}
+
+	backendAddr := strings.TrimPrefix(backend.URL, "http://")
+	tests := []struct {
+		name string
+		got  map[string]interface{}
+		want map[string]interface{}
+	}{
+		{"HTTP请求", entries[0], map[string]interface{}{
+			"method": "GET", "url": backend.URL + "/path", "status": 200.0, "bytes": 5.0,
+			"upstream": backendAddr, "content_type": "text/plain",
+		}},
+		{"CONNECT隧道", entries[1], map[string]interface{}{
+			"method": "CONNECT", "url": echoAddr, "status": 200.0, "bytes": 4.0, "bytes_in": 4.0, "upstream": echoAddr,
+		}},
+	}
+	for _, tt := range tests {
+		for key, want := range tt.want {
+			if tt.got[key] != want {
+				t.Errorf("%s: 字段%s不匹配, 期望 %v, 实际 %v", tt.name, key, want, tt.got[key])
+			}
+		}
+	}
+}
+
+// TestAccessLogParentWrapped 测试故障注入的隧道和协议升级的连接经上级代理时也记录上级代理
+func TestAccessLogParentWrapped(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	backend := startUpgradeServer(t)
+
+	parentProxy := NewForwardProxy()
+	parentProxy.SetViaName("parent")
+	parent := httptest.NewServer(parentProxy)
+	defer parent.Close()
+	parentAddr := strings.TrimPrefix(parent.URL, "http://")
+	router, err := ParseRoutes([]byte("127.0.0.1 " + parent.URL))
+	if err != nil {
+		t.Fatalf("解析路由规则失败: %v", err)
+	}
+
+	var buf syncBuffer
+	proxy := NewForwardProxy()
+	proxy.SetRouter(router)
+	proxy.faults.Add(FaultRule{Method: http.MethodConnect, Bandwidth: 1 << 20})
+	proxy.SetAccessLog(accesslog.New(&buf, accesslog.FormatJSON))
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyAddr := strings.TrimPrefix(proxyServer.URL, "http://")
+
+	conn, br := dialConnect(t, proxyAddr, echoAddr)
+	conn.Write([]byte("ping"))
+	io.ReadFull(br, make([]byte, 4))
+	conn.Close()
+
+	conn, br, resp := dialUpgrade(t, proxyAddr, backend.URL, "websocket", "ping")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("升级失败: %s", resp.Status)
+	}
+	io.ReadFull(br, make([]byte, 4))
+	conn.Close()
+
+	var entries []map[string]interface{}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if entries = buf.entries(t); len(entries) == 2 {
+			break
+		}
+	}
+	if len(entries) != 2 {
+		t.Fatalf("期望2条访问记录, 实际 %d", len(entries))
+	}
+	for _, e := range entries {
+		if e["upstream"] != parentAddr || e["parent"] != true {
+			t.Errorf("%s %s: 应记录上级代理%s, 实际 %v %v", e["method"], e["url"], parentAddr, e["upstream"], e["parent"])
+		}
+	}
+}
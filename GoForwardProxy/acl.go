@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Action 访问控制规则的动作
+type Action string
+
+const (
+	ActionAllow Action = "allow"
+	ActionDeny  Action = "deny"
+)
+
+// PortRange 端口范围，包含两端
+type PortRange struct {
+	Low, High int
+}
+
+// Rule 访问控制规则，所有非空条件同时满足时规则命中
+type Rule struct {
+	Action  Action
+	Domains []string     // 域名模式，支持 *.example.com
+	CIDRs   []*net.IPNet // 解析后的目标IP范围
+	Ports   []PortRange  // 目标端口
+	Methods []string     // 请求方法，CONNECT表示隧道
+	Reason  string       // 拒绝时返回给客户端的原因
+}
+
+// Policy 有序的访问控制规则集，按顺序匹配第一条命中的规则
+type Policy struct {
+	Rules   []Rule
+	Default Action // 没有规则命中时的动作，为空表示允许
+}
+
+// accessTarget 访问控制检查的对象
+type accessTarget struct {
+	host   string
+	ip     net.IP
+	port   int
+	method string
+}
+
+// AccessDeniedError 访问被访问控制规则拒绝
+type AccessDeniedError struct {
+	Target string
+	Reason string
+}
+
+func (e *AccessDeniedError) Error() string {
+	return fmt.Sprintf("访问%s被拒绝: %s", e.Target, e.Reason)
+}
+
+// matches 判断规则是否命中目标
+func (r *Rule) matches(t accessTarget) bool {
+	if len(r.Domains) > 0 {
+		matched := false
+		for _, pattern := range r.Domains {
+			if matchDomain(pattern, t.host) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.CIDRs) > 0 {
+		matched := false
+		for _, cidr := range r.CIDRs {
+			if t.ip != nil && cidr.Contains(t.ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.Ports) > 0 {
+		matched := false
+		for _, pr := range r.Ports {
+			if t.port >= pr.Low && t.port <= pr.High {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.Methods) > 0 {
+		matched := false
+		for _, method := range r.Methods {
+			if strings.EqualFold(method, t.method) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// check 检查目标是否允许访问，拒绝时返回AccessDeniedError
+func (p *Policy) check(t accessTarget) error {
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.matches(t) {
+			continue
+		}
+		if rule.Action == ActionDeny {
+			reason := rule.Reason
+			if reason == "" {
+				reason = fmt.Sprintf("命中第%d条拒绝规则", i+1)
+			}
+			return &AccessDeniedError{Target: net.JoinHostPort(t.host, strconv.Itoa(t.port)), Reason: reason}
+		}
+		return nil
+	}
+	if p.Default == ActionDeny {
+		return &AccessDeniedError{Target: net.JoinHostPort(t.host, strconv.Itoa(t.port)), Reason: "没有匹配的允许规则"}
+	}
+	return nil
+}
+
+// ParseRule 解析一行规则，格式为:
+//
+//	allow|deny [domain=a.com,*.b.com] [cidr=10.0.0.0/8] [port=443,8000-9000] [method=CONNECT] [reason=xxx]
+func ParseRule(line string) (Rule, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return Rule{}, fmt.Errorf("规则为空")
+	}
+	rule := Rule{Action: Action(strings.ToLower(fields[0]))}
+	if rule.Action != ActionAllow && rule.Action != ActionDeny {
+		return Rule{}, fmt.Errorf("未知的规则动作: %s", fields[0])
+	}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return Rule{}, fmt.Errorf("无效的规则条件: %s", field)
+		}
+		if key == "reason" {
+			rule.Reason = value
+			continue
+		}
+		for _, item := range strings.Split(value, ",") {
+			switch key {
+			case "domain":
+				rule.Domains = append(rule.Domains, item)
+			case "cidr":
+				cidr, err := parseCIDR(item)
+				if err != nil {
+					return Rule{}, err
+				}
+				rule.CIDRs = append(rule.CIDRs, cidr)
+			case "port":
+				pr, err := parsePortRange(item)
+				if err != nil {
+					return Rule{}, err
+				}
+				rule.Ports = append(rule.Ports, pr)
+			case "method":
+				rule.Methods = append(rule.Methods, strings.ToUpper(item))
+			default:
+				return Rule{}, fmt.Errorf("未知的规则条件: %s", key)
+			}
+		}
+	}
+	return rule, nil
+}
+
+// parseCIDR 解析CIDR，单个IP视为/32或/128
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("无效的IP地址: %s", s)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, cidr, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("无效的CIDR: %s", s)
+	}
+	return cidr, nil
+}
+
+// parsePortRange 解析端口或端口范围，如 443 或 8000-9000
+func parsePortRange(s string) (PortRange, error) {
+	low, high, isRange := strings.Cut(s, "-")
+	lo, err := strconv.Atoi(low)
+	if err != nil || lo < 1 || lo > 65535 {
+		return PortRange{}, fmt.Errorf("无效的端口: %s", s)
+	}
+	if !isRange {
+		return PortRange{Low: lo, High: lo}, nil
+	}
+	hi, err := strconv.Atoi(high)
+	if err != nil || hi < lo || hi > 65535 {
+		return PortRange{}, fmt.Errorf("无效的端口范围: %s", s)
+	}
+	return PortRange{Low: lo, High: hi}, nil
+}
+
+// ParsePolicy 解析规则文本，每行一条规则，#开头为注释
+func ParsePolicy(data []byte) (*Policy, error) {
+	policy := &Policy{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		rule, err := ParseRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("第%d行: %v", line, err)
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// LoadPolicy 从文件加载访问控制规则
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取规则文件失败: %v", err)
+	}
+	return ParsePolicy(data)
+}
+
+// defaultPolicyRules 默认规则：禁止访问内网地址，CONNECT只允许443端口
+const defaultPolicyRules = `
+deny cidr=127.0.0.0/8,::1/128 reason=禁止访问本机回环地址
+deny cidr=10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,100.64.0.0/10,fc00::/7 reason=禁止访问内网地址
+deny cidr=169.254.0.0/16,fe80::/10 reason=禁止访问链路本地地址
+deny cidr=0.0.0.0/8,224.0.0.0/4,ff00::/8 reason=禁止访问保留地址
+allow method=CONNECT port=443
+deny method=CONNECT reason=CONNECT只允许443端口
+allow
+`
+
+// DefaultPolicy 返回默认的访问控制规则
+func DefaultPolicy() *Policy {
+	policy, err := ParsePolicy([]byte(defaultPolicyRules))
+	if err != nil {
+		panic(err)
+	}
+	return policy
+}
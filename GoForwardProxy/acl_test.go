@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPolicyCheck 测试规则的解析与顺序匹配
+func TestPolicyCheck(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`
+# 注释
+deny domain=*.internal.example.com reason=内部域名
+allow cidr=10.1.0.0/16 port=80,8000-9000 method=GET
+deny cidr=10.0.0.0/8
+allow method=CONNECT port=443
+deny method=CONNECT
+`))
+	if err != nil {
+		t.Fatalf("解析规则失败: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		target accessTarget
+		allow  bool
+	}{
+		{"内部域名", accessTarget{host: "a.internal.example.com", ip: net.ParseIP("1.2.3.4"), port: 80, method: "GET"}, false},
+		{"允许的内网段", accessTarget{host: "svc", ip: net.ParseIP("10.1.2.3"), port: 8080, method: "GET"}, true},
+		{"内网段方法不匹配", accessTarget{host: "svc", ip: net.ParseIP("10.1.2.3"), port: 8080, method: "POST"}, false},
+		{"内网段端口不匹配", accessTarget{host: "svc", ip: net.ParseIP("10.1.2.3"), port: 22, method: "GET"}, false},
+		{"CONNECT 443", accessTarget{host: "example.com", ip: net.ParseIP("1.2.3.4"), port: 443, method: "CONNECT"}, true},
+		{"CONNECT 其他端口", accessTarget{host: "example.com", ip: net.ParseIP("1.2.3.4"), port: 22, method: "CONNECT"}, false},
+		{"默认允许", accessTarget{host: "example.com", ip: net.ParseIP("1.2.3.4"), port: 80, method: "GET"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.check(tt.target)
+			if (err == nil) != tt.allow {
+				t.Errorf("期望允许=%v, 实际错误: %v", tt.allow, err)
+			}
+		})
+	}
+
+	for _, bad := range []string{"permit", "deny port=0", "deny cidr=10.0.0.0/33", "deny foo=bar"} {
+		if _, err := ParseRule(bad); err == nil {
+			t.Errorf("规则 %q 应该解析失败", bad)
+		}
+	}
+}
+
+// TestProxyPolicy 测试代理对普通请求和CONNECT请求的访问控制
+func TestProxyPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+
+	allowGet, err := ParsePolicy([]byte("allow cidr=127.0.0.1 method=GET,CONNECT\ndeny reason=只允许GET"))
+	if err != nil {
+		t.Fatalf("解析规则失败: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		policy     *Policy
+		method     string
+		wantStatus int
+	}{
+		{name: "默认规则禁止回环地址", policy: DefaultPolicy(), method: http.MethodGet, wantStatus: http.StatusForbidden},
+		{name: "默认规则禁止CONNECT非443端口", policy: DefaultPolicy(), method: http.MethodConnect, wantStatus: http.StatusForbidden},
+		{name: "允许GET", policy: allowGet, method: http.MethodGet, wantStatus: http.StatusOK},
+		{name: "拒绝POST", policy: allowGet, method: http.MethodPost, wantStatus: http.StatusForbidden},
+		{name: "允许CONNECT", policy: allowGet, method: http.MethodConnect, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := NewForwardProxy()
+			proxy.SetPolicy(tt.policy)
+			proxyServer := httptest.NewServer(proxy)
+			defer proxyServer.Close()
+
+			var resp *http.Response
+			if tt.method == http.MethodConnect {
+				conn, err := net.Dial("tcp", strings.TrimPrefix(proxyServer.URL, "http://"))
+				if err != nil {
+					t.Fatalf("连接代理失败: %v", err)
+				}
+				defer conn.Close()
+				fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", backendHost, backendHost)
+				resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+				if err != nil {
+					t.Fatalf("读取CONNECT响应失败: %v", err)
+				}
+			} else {
+				proxyURL, _ := url.Parse(proxyServer.URL)
+				client := &http.Client{
+					Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+					Timeout:   5 * time.Second,
+				}
+				req, _ := http.NewRequest(tt.method, backend.URL, nil)
+				resp, err = client.Do(req)
+				if err != nil {
+					t.Fatalf("请求失败: %v", err)
+				}
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("状态码不匹配, 期望 %d, 实际 %d", tt.wantStatus, resp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AdminHandler 返回管理接口的处理器，应只监听在本机地址上
+//
+//	GET    /tunnels       列出所有活跃隧道
+//	GET    /tunnels/{id}  查看单个隧道
+//	DELETE /tunnels/{id}  强制关闭隧道
+//	GET    /metrics       Prometheus格式的运行指标
+//	GET    /faults        列出故障注入规则
+//	POST   /faults        添加或替换故障注入规则
+//	DELETE /faults        清空故障注入规则
+//	GET    /faults/{id}   查看单个故障注入规则
+//	DELETE /faults/{id}   删除单个故障注入规则
+func (p *ForwardProxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnels", p.handleTunnelList)
+	mux.HandleFunc("/tunnels/", p.handleTunnel)
+	mux.HandleFunc("/metrics", p.handleMetrics)
+	mux.HandleFunc("/faults", p.handleFaultList)
+	mux.HandleFunc("/faults/", p.handleFault)
+	return mux
+}
+
+// handleTunnelList 列出所有活跃隧道
+func (p *ForwardProxy) handleTunnelList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "只允许GET方法", http.StatusMethodNotAllowed)
+		return
+	}
+	tunnels := p.tunnels.List()
+	infos := make([]TunnelInfo, 0, len(tunnels))
+	for _, t := range tunnels {
+		infos = append(infos, t.Info())
+	}
+	writeJSON(w, infos)
+}
+
+// handleTunnel 查看或关闭单个隧道
+func (p *ForwardProxy) handleTunnel(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/tunnels/"), 10, 64)
+	if err != nil {
+		http.Error(w, "无效的隧道ID", http.StatusBadRequest)
+		return
+	}
+	t, ok := p.tunnels.Get(id)
+	if !ok {
+		http.Error(w, "隧道不存在", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, t.Info())
+	case http.MethodDelete:
+		t.closeWithReason("管理接口关闭")
+		logf(r.Context(), "管理接口关闭了隧道#%d: %s -> %s", t.ID, t.Client, t.Target)
+		fmt.Fprintf(w, "已关闭隧道#%d\n", t.ID)
+	default:
+		http.Error(w, "只允许GET和DELETE方法", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeJSON 以JSON格式返回数据
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
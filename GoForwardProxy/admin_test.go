@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startEchoServer 启动TCP回显服务器
+func startEchoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// dialConnect 通过代理建立CONNECT隧道
+func dialConnect(t *testing.T, proxyAddr, target string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("连接代理失败: %v", err)
+	}
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("读取CONNECT响应失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT失败: %s", resp.Status)
+	}
+	return conn, br
+}
+
+// TestAdminTunnels 测试隧道的列出、查看和强制关闭
+func TestAdminTunnels(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	proxy := NewForwardProxy()
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	admin := proxy.AdminHandler()
+
+	conn, br := dialConnect(t, strings.TrimPrefix(proxyServer.URL, "http://"), echoAddr)
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("回显失败: %q %v", buf, err)
+	}
+
+	// 字节数在写入完成后才计入，等待计数稳定
+	var info TunnelInfo
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/tunnels", nil))
+		var infos []TunnelInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil {
+			t.Fatalf("解析隧道列表失败: %v", err)
+		}
+		if len(infos) != 1 {
+			t.Fatalf("期望1个隧道, 实际 %d", len(infos))
+		}
+		if info = infos[0]; info.BytesOut == 5 {
+			break
+		}
+	}
+	if info.Target != echoAddr || info.BytesIn != 5 || info.BytesOut != 5 {
+		t.Errorf("隧道信息不正确: %+v", info)
+	}
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/tunnels/%d", info.ID), nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("查看隧道失败: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/tunnels/%d", info.ID), nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("关闭隧道失败: %d", w.Code)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadByte(); err == nil {
+		t.Error("隧道关闭后客户端连接应该断开")
+	}
+
+	// 隧道结束后从登记表中移除
+	deadline := time.Now().Add(5 * time.Second)
+	for len(proxy.tunnels.List()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(proxy.tunnels.List()); n != 0 {
+		t.Errorf("期望0个隧道, 实际 %d", n)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/tunnels/999", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("不存在的隧道应返回404, 实际 %d", w.Code)
+	}
+}
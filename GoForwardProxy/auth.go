@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Authenticator 代理认证接口，可插拔不同的认证方式
+type Authenticator interface {
+	// Authenticate 校验请求中的Proxy-Authorization，成功时返回用户名
+	Authenticate(r *http.Request) (string, error)
+	// Challenge 返回407响应中Proxy-Authenticate头的值
+	Challenge() string
+}
+
+// PasswordStore 用户名密码校验接口，HTTP Basic认证和SOCKS5认证共用
+type PasswordStore interface {
+	Verify(user, password string) bool
+}
+
+var (
+	errNoCredentials  = errors.New("缺少代理认证信息")
+	errBadCredentials = errors.New("用户名或密码错误")
+)
+
+// BasicAuth 基于Proxy-Authorization: Basic的认证
+type BasicAuth struct {
+	Realm string
+	Store PasswordStore
+}
+
+// Authenticate 实现Authenticator接口
+func (a *BasicAuth) Authenticate(r *http.Request) (string, error) {
+	header := r.Header.Get("Proxy-Authorization")
+	if header == "" {
+		return "", errNoCredentials
+	}
+	scheme, encoded, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", errNoCredentials
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", errBadCredentials
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || !a.Store.Verify(user, password) {
+		return "", errBadCredentials
+	}
+	return user, nil
+}
+
+// Challenge 实现Authenticator接口
+func (a *BasicAuth) Challenge() string {
+	return fmt.Sprintf("Basic realm=%q", a.Realm)
+}
+
+// HtpasswdFile htpasswd格式的用户文件，仅支持加盐哈希（$apr1$ 和 {SSHA}）
+type HtpasswdFile struct {
+	users map[string]string
+}
+
+// LoadHtpasswd 加载htpasswd格式的用户文件
+func LoadHtpasswd(path string) (*HtpasswdFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取用户文件失败: %v", err)
+	}
+	return ParseHtpasswd(data)
+}
+
+// ParseHtpasswd 解析htpasswd格式的内容，每行为 user:hash
+func ParseHtpasswd(data []byte) (*HtpasswdFile, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("用户文件第%d行格式错误", line)
+		}
+		if !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SSHA}") {
+			return nil, fmt.Errorf("用户文件第%d行使用了不支持的哈希格式，仅支持$apr1$和{SSHA}", line)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &HtpasswdFile{users: users}, nil
+}
+
+// Verify 实现PasswordStore接口
+func (h *HtpasswdFile) Verify(user, password string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		return constantTimeEqual(apr1Crypt(password, salt), hash)
+	case strings.HasPrefix(hash, "{SSHA}"):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, "{SSHA}"))
+		if err != nil || len(decoded) <= sha1.Size {
+			return false
+		}
+		return constantTimeEqual(sshaHash(password, decoded[sha1.Size:]), hash)
+	}
+	return false
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// sshaHash 计算 {SSHA} 格式的哈希: base64(sha1(password+salt)+salt)
+func sshaHash(password string, salt []byte) string {
+	h := sha1.New()
+	h.Write([]byte(password))
+	h.Write(salt)
+	return "{SSHA}" + base64.StdEncoding.EncodeToString(append(h.Sum(nil), salt...))
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1Crypt 计算Apache的 $apr1$ MD5哈希
+func apr1Crypt(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		n := i
+		if n > 16 {
+			n = 16
+		}
+		ctx.Write(alt[:n])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(magic + salt + "$")
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return out.String()
+}
+
+// authenticate 对请求进行代理认证，失败时返回407并返回false
+func (p *ForwardProxy) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if p.auth == nil {
+		return "", true
+	}
+	user, err := p.auth.Authenticate(r)
+	if err != nil {
+		logf(r.Context(), "代理认证失败: %v", err)
+		w.Header().Set("Proxy-Authenticate", p.auth.Challenge())
+		http.Error(w, err.Error(), http.StatusProxyAuthRequired)
+		return "", false
+	}
+	// 凭据只用于本代理，不能转发给上游
+	r.Header.Del("Proxy-Authorization")
+	return user, true
+}
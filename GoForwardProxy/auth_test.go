@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHtpasswdVerify 测试htpasswd哈希校验
+func TestHtpasswdVerify(t *testing.T) {
+	// $apr1$ 哈希由 openssl passwd -apr1 -salt abcdefgh secret 生成
+	data := "# 测试用户\n" +
+		"alice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n" +
+		"bob:" + sshaHash("hunter2", []byte("saltsalt")) + "\n"
+	users, err := ParseHtpasswd([]byte(data))
+	if err != nil {
+		t.Fatalf("解析用户文件失败: %v", err)
+	}
+
+	tests := []struct {
+		user, password string
+		want           bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "hunter2", true},
+		{"bob", "hunter3", false},
+		{"carol", "secret", false},
+	}
+	for _, tt := range tests {
+		if got := users.Verify(tt.user, tt.password); got != tt.want {
+			t.Errorf("Verify(%q, %q) = %v, 期望 %v", tt.user, tt.password, got, tt.want)
+		}
+	}
+
+	if _, err := ParseHtpasswd([]byte("alice:plaintext\n")); err == nil {
+		t.Error("未加盐的哈希应该被拒绝")
+	}
+}
+
+// TestProxyAuth 测试普通请求和CONNECT请求的代理认证
+func TestProxyAuth(t *testing.T) {
+	var gotAuth string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Proxy-Authorization")
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+
+	users, err := ParseHtpasswd([]byte("alice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n"))
+	if err != nil {
+		t.Fatalf("解析用户文件失败: %v", err)
+	}
+	proxy := NewForwardProxy()
+	proxy.SetAuthenticator(&BasicAuth{Realm: "test", Store: users})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	tests := []struct {
+		name       string
+		userinfo   *url.Userinfo
+		wantStatus int
+	}{
+		{name: "未认证", userinfo: nil, wantStatus: http.StatusProxyAuthRequired},
+		{name: "密码错误", userinfo: url.UserPassword("alice", "wrong"), wantStatus: http.StatusProxyAuthRequired},
+		{name: "认证成功", userinfo: url.UserPassword("alice", "secret"), wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyURL, _ := url.Parse(proxyServer.URL)
+			proxyURL.User = tt.userinfo
+			client := &http.Client{
+				Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+				Timeout:   5 * time.Second,
+			}
+			resp, err := client.Get(backend.URL)
+			if err != nil {
+				t.Fatalf("请求失败: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("状态码不匹配, 期望 %d, 实际 %d", tt.wantStatus, resp.StatusCode)
+			}
+			if tt.wantStatus == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") != `Basic realm="test"` {
+				t.Errorf("Proxy-Authenticate不正确: %q", resp.Header.Get("Proxy-Authenticate"))
+			}
+			if gotAuth != "" {
+				t.Errorf("Proxy-Authorization被转发到了上游: %q", gotAuth)
+			}
+
+			// 同样的凭据用于CONNECT请求
+			conn, err := net.Dial("tcp", proxyURL.Host)
+			if err != nil {
+				t.Fatalf("连接代理失败: %v", err)
+			}
+			defer conn.Close()
+			req, _ := http.NewRequest(http.MethodConnect, "", nil)
+			req.URL = &url.URL{Host: strings.TrimPrefix(backend.URL, "http://")}
+			req.Host = req.URL.Host
+			if tt.userinfo != nil {
+				password, _ := tt.userinfo.Password()
+				req.SetBasicAuth(tt.userinfo.Username(), password)
+				req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+				req.Header.Del("Authorization")
+			}
+			req.Write(conn)
+			connectResp, err := http.ReadResponse(bufio.NewReader(conn), req)
+			if err != nil {
+				t.Fatalf("读取CONNECT响应失败: %v", err)
+			}
+			if connectResp.StatusCode != tt.wantStatus {
+				t.Errorf("CONNECT状态码不匹配, 期望 %d, 实际 %d", tt.wantStatus, connectResp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,797 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// methodPurge 清除缓存条目的请求方法，只允许本机客户端使用
+	methodPurge = "PURGE"
+
+	// defaultMaxObjectSize 单个缓存对象的默认大小上限
+	defaultMaxObjectSize = 64 << 20
+
+	// heuristicMaxLifetime 启发式新鲜期的上限
+	heuristicMaxLifetime = 24 * time.Hour
+
+	// revalidateTimeout 后台重新验证的超时时间
+	revalidateTimeout = 30 * time.Second
+)
+
+// cacheableStatus 可以缓存的状态码（RFC 9110 15.1 中可启发式缓存的状态码）
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// cacheEntry 缓存的一个响应（同一URL的一个Vary变体）
+type cacheEntry struct {
+	StatusCode   int
+	Header       http.Header
+	Body         []byte
+	RequestTime  time.Time         // 发出请求的时间
+	ResponseTime time.Time         // 收到响应的时间
+	Vary         map[string]string // Vary列出的请求头在原始请求中的取值
+}
+
+// cacheItem 同一URL的所有变体，内存层和磁盘层都以此为单位
+type cacheItem struct {
+	key      string
+	variants []*cacheEntry
+	size     int64
+}
+
+// Cache 共享HTTP缓存（RFC 9111），内存层按大小LRU淘汰，可选磁盘层
+type Cache struct {
+	MaxObjectSize int64 // 单个响应体的大小上限
+
+	mu      sync.Mutex
+	maxMem  int64
+	memSize int64
+	lru     *list.List
+	items   map[string]*list.Element
+
+	dir      string
+	maxDisk  int64
+	diskSize int64
+
+	revalidating map[string]bool // 正在后台重新验证的URL
+}
+
+// NewCache 创建缓存，dir为空时只使用内存
+func NewCache(maxMem int64, dir string, maxDisk int64) (*Cache, error) {
+	c := &Cache{
+		MaxObjectSize: defaultMaxObjectSize,
+		maxMem:        maxMem,
+		lru:           list.New(),
+		items:         make(map[string]*list.Element),
+		dir:           dir,
+		maxDisk:       maxDisk,
+		revalidating:  make(map[string]bool),
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("创建缓存目录失败: %v", err)
+		}
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("读取缓存目录失败: %v", err)
+		}
+		for _, f := range files {
+			if fi, err := f.Info(); err == nil && fi.Mode().IsRegular() {
+				c.diskSize += fi.Size()
+			}
+		}
+	}
+	return c, nil
+}
+
+// cacheKey 缓存的主键，由请求的绝对URL组成
+func cacheKey(u *url.URL) string {
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + u.RequestURI()
+}
+
+// cacheableRequest 判断请求是否可以经过缓存处理
+func cacheableRequest(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.Header.Get("Range") == ""
+}
+
+// isSafeMethod 判断是否为安全方法（RFC 9110 9.2.1）
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// parseCacheControl 解析Cache-Control头，指令名转为小写
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg, _ := strings.Cut(directive, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+	return cc
+}
+
+// ccSeconds 读取以秒为单位的指令值
+func ccSeconds(cc map[string]string, name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || secs < 0 {
+		return 0, true
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// isStorable 判断响应是否可以存入共享缓存（RFC 9111 3）
+func isStorable(req *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet || !cacheableStatus[resp.StatusCode] {
+		return false
+	}
+	reqCC := parseCacheControl(req.Header)
+	respCC := parseCacheControl(resp.Header)
+	if _, ok := reqCC["no-store"]; ok {
+		return false
+	}
+	for _, name := range []string{"no-store", "private"} {
+		if _, ok := respCC[name]; ok {
+			return false
+		}
+	}
+	for _, name := range varyNames(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	// 共享缓存不保存带Set-Cookie的响应，避免把一个用户的会话发给其他用户
+	if resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" {
+		_, public := respCC["public"]
+		_, sMaxAge := respCC["s-maxage"]
+		_, mustRevalidate := respCC["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return false
+		}
+	}
+	entry := &cacheEntry{Header: resp.Header}
+	return entry.freshnessLifetime() > 0 || entry.hasValidators()
+}
+
+// varyNames 返回Vary头列出的请求头名称
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, textproto.CanonicalMIMEHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// varyValues 记录Vary列出的请求头在请求中的取值
+func varyValues(respHeader, reqHeader http.Header) map[string]string {
+	values := make(map[string]string)
+	for _, name := range varyNames(respHeader) {
+		values[name] = strings.Join(reqHeader.Values(name), ",")
+	}
+	return values
+}
+
+// matches 判断请求是否与缓存变体的Vary取值一致
+func (e *cacheEntry) matches(reqHeader http.Header) bool {
+	for name, value := range e.Vary {
+		if strings.Join(reqHeader.Values(name), ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// sameVariant 判断两个条目是否为同一个Vary变体
+func (e *cacheEntry) sameVariant(other *cacheEntry) bool {
+	if len(e.Vary) != len(other.Vary) {
+		return false
+	}
+	for name, value := range e.Vary {
+		if v, ok := other.Vary[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// date 返回响应的Date，缺失时使用收到响应的时间
+func (e *cacheEntry) date() time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// freshnessLifetime 计算新鲜期（RFC 9111 4.2.1），共享缓存优先使用s-maxage
+func (e *cacheEntry) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if d, ok := ccSeconds(cc, "s-maxage"); ok {
+		return d
+	}
+	if d, ok := ccSeconds(cc, "max-age"); ok {
+		return d
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(e.date())
+	}
+	// 启发式新鲜期：距离最后修改时间的10%
+	if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil {
+		d := e.date().Sub(lm) / 10
+		if d > heuristicMaxLifetime {
+			d = heuristicMaxLifetime
+		}
+		if d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// age 计算当前年龄（RFC 9111 4.2.3）
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparentAge := e.ResponseTime.Sub(e.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	ageValue := time.Duration(0)
+	if secs, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && secs > 0 {
+		ageValue = time.Duration(secs) * time.Second
+	}
+	correctedAge := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	initialAge := apparentAge
+	if correctedAge > initialAge {
+		initialAge = correctedAge
+	}
+	return initialAge + now.Sub(e.ResponseTime)
+}
+
+// hasValidators 判断是否可以进行条件请求重新验证
+func (e *cacheEntry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// size 估算条目占用的内存
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.Body))
+	for name, values := range e.Header {
+		n += int64(len(name))
+		for _, v := range values {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+// refreshed 用304响应的头部更新条目，返回新的条目（RFC 9111 4.3.4）
+func (e *cacheEntry) refreshed(header http.Header, requestTime, responseTime time.Time) *cacheEntry {
+	updated := *e
+	updated.Header = e.Header.Clone()
+	for name, values := range header {
+		if name == "Content-Length" {
+			continue
+		}
+		updated.Header[name] = values
+	}
+	updated.RequestTime = requestTime
+	updated.ResponseTime = responseTime
+	return &updated
+}
+
+// lookup 查找与请求匹配的缓存变体
+func (c *Cache) lookup(key string, reqHeader http.Header) *cacheEntry {
+	c.mu.Lock()
+	var variants []*cacheEntry
+	el, ok := c.items[key]
+	if ok {
+		c.lru.MoveToFront(el)
+		variants = el.Value.(*cacheItem).variants
+	}
+	c.mu.Unlock()
+
+	if !ok && c.dir != "" {
+		variants = c.readDisk(key)
+		if variants != nil {
+			c.mu.Lock()
+			c.putMemLocked(key, variants)
+			c.mu.Unlock()
+		}
+	}
+	for _, e := range variants {
+		if e.matches(reqHeader) {
+			return e
+		}
+	}
+	return nil
+}
+
+// store 保存条目，替换同一Vary变体的旧条目
+func (c *Cache) store(key string, entry *cacheEntry) {
+	c.mu.Lock()
+	var existing []*cacheEntry
+	el, inMem := c.items[key]
+	if inMem {
+		existing = el.Value.(*cacheItem).variants
+	}
+	c.mu.Unlock()
+	// 不在内存层时其他变体可能只在磁盘层，合并后再写回，避免覆盖掉
+	if !inMem && c.dir != "" {
+		existing = c.readDisk(key)
+	}
+
+	variants := []*cacheEntry{entry}
+	for _, e := range existing {
+		if !e.sameVariant(entry) {
+			variants = append(variants, e)
+		}
+	}
+	c.mu.Lock()
+	c.putMemLocked(key, variants)
+	c.mu.Unlock()
+
+	if c.dir != "" {
+		c.writeDisk(key, variants)
+	}
+}
+
+// Invalidate 删除URL对应的所有缓存条目，返回条目是否存在
+func (c *Cache) Invalidate(key string) bool {
+	c.mu.Lock()
+	el, found := c.items[key]
+	if found {
+		c.removeMemLocked(el)
+	}
+	c.mu.Unlock()
+
+	if c.dir != "" {
+		path := c.diskPath(key)
+		if fi, err := os.Stat(path); err == nil {
+			if os.Remove(path) == nil {
+				c.mu.Lock()
+				c.diskSize -= fi.Size()
+				c.mu.Unlock()
+			}
+			found = true
+		}
+	}
+	return found
+}
+
+// putMemLocked 放入内存层并按LRU淘汰，调用时需持有锁
+func (c *Cache) putMemLocked(key string, variants []*cacheEntry) {
+	if el, ok := c.items[key]; ok {
+		c.removeMemLocked(el)
+	}
+	item := &cacheItem{key: key, variants: variants}
+	for _, e := range variants {
+		item.size += e.size()
+	}
+	if item.size > c.maxMem {
+		// 超过内存上限的对象只保存在磁盘层
+		return
+	}
+	c.items[key] = c.lru.PushFront(item)
+	c.memSize += item.size
+	for c.memSize > c.maxMem {
+		c.removeMemLocked(c.lru.Back())
+	}
+}
+
+func (c *Cache) removeMemLocked(el *list.Element) {
+	item := c.lru.Remove(el).(*cacheItem)
+	delete(c.items, item.key)
+	c.memSize -= item.size
+}
+
+// diskPath 返回URL对应的磁盘文件路径
+func (c *Cache) diskPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// readDisk 从磁盘层读取URL的所有变体
+func (c *Cache) readDisk(key string) []*cacheEntry {
+	data, err := os.ReadFile(c.diskPath(key))
+	if err != nil {
+		return nil
+	}
+	var stored struct {
+		Key      string
+		Variants []*cacheEntry
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&stored); err != nil || stored.Key != key {
+		return nil
+	}
+	return stored.Variants
+}
+
+// writeDisk 将URL的所有变体写入磁盘层，并按修改时间淘汰最旧的文件
+func (c *Cache) writeDisk(key string, variants []*cacheEntry) {
+	var buf bytes.Buffer
+	stored := struct {
+		Key      string
+		Variants []*cacheEntry
+	}{key, variants}
+	if err := gob.NewEncoder(&buf).Encode(&stored); err != nil {
+		return
+	}
+	if int64(buf.Len()) > c.maxDisk {
+		return
+	}
+
+	path := c.diskPath(key)
+	tmp, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return
+	}
+	tmp.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var oldSize int64
+	if fi, err := os.Stat(path); err == nil {
+		oldSize = fi.Size()
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	c.diskSize += int64(buf.Len()) - oldSize
+	if c.diskSize > c.maxDisk {
+		c.evictDiskLocked(path)
+	}
+}
+
+// evictDiskLocked 删除最旧的磁盘文件直到低于上限，keep为刚写入的文件
+func (c *Cache) evictDiskLocked(keep string) {
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	type diskFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var all []diskFile
+	for _, f := range files {
+		fi, err := f.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		all = append(all, diskFile{filepath.Join(c.dir, f.Name()), fi.Size(), fi.ModTime()})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].modTime.Before(all[j].modTime) })
+	for _, f := range all {
+		if c.diskSize <= c.maxDisk {
+			break
+		}
+		if f.path == keep {
+			continue
+		}
+		if os.Remove(f.path) == nil {
+			c.diskSize -= f.size
+		}
+	}
+}
+
+// startRevalidation 标记URL正在后台重新验证，已在进行时返回false
+func (c *Cache) startRevalidation(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.revalidating[key] {
+		return false
+	}
+	c.revalidating[key] = true
+	return true
+}
+
+func (c *Cache) finishRevalidation(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.revalidating, key)
+}
+
+// setValidators 为重新验证请求设置条件头，替换客户端自带的条件头
+func setValidators(h http.Header, e *cacheEntry) {
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		h.Del(name)
+	}
+	if etag := e.Header.Get("ETag"); etag != "" {
+		h.Set("If-None-Match", etag)
+	}
+	if lm := e.Header.Get("Last-Modified"); lm != "" {
+		h.Set("If-Modified-Since", lm)
+	}
+}
+
+// clientNotModified 判断客户端的条件请求是否可以直接返回304
+func clientNotModified(r *http.Request, e *cacheEntry) bool {
+	if e.StatusCode != http.StatusOK {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// writeCached 将缓存条目返回给客户端
+func (p *ForwardProxy) writeCached(w http.ResponseWriter, r *http.Request, e *cacheEntry, status string) {
+	h := w.Header()
+	for name, values := range e.Header {
+		h[name] = append([]string(nil), values...)
+	}
+	h.Set("Age", strconv.FormatInt(int64(e.age(time.Now())/time.Second), 10))
+	h.Add("Via", p.viaValue(1, 1))
+	h.Set("X-Cache", status)
+
+	if clientNotModified(r, e) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if e.StatusCode != http.StatusNoContent {
+		h.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	}
+	w.WriteHeader(e.StatusCode)
+	if r.Method != http.MethodHead {
+		if _, err := faultWriter(r.Context(), limitWriter(r.Context(), w)).Write(e.Body); err == errFaultTruncated {
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// handleCached 通过缓存处理GET/HEAD请求，req为已构造好的上游请求
+func (p *ForwardProxy) handleCached(w http.ResponseWriter, r *http.Request, req *http.Request) {
+	c := p.cache
+	key := cacheKey(req.URL)
+	reqCC := parseCacheControl(r.Header)
+	_, reqNoCache := reqCC["no-cache"]
+	if strings.Contains(strings.ToLower(r.Header.Get("Pragma")), "no-cache") && r.Header.Get("Cache-Control") == "" {
+		reqNoCache = true
+	}
+
+	entry := c.lookup(key, r.Header)
+	if entry != nil {
+		now := time.Now()
+		age := entry.age(now)
+		lifetime := entry.freshnessLifetime()
+		respCC := parseCacheControl(entry.Header)
+		_, respNoCache := respCC["no-cache"]
+		fresh := age < lifetime
+		if maxAge, ok := ccSeconds(reqCC, "max-age"); ok && age > maxAge {
+			fresh = false
+		}
+
+		if fresh && !reqNoCache && !respNoCache {
+			logf(r.Context(), "缓存命中: %s", key)
+			p.writeCached(w, r, entry, "HIT")
+			return
+		}
+
+		// stale-while-revalidate: 在允许的时间内先返回过期内容，后台重新验证（RFC 5861）
+		_, mustRevalidate := respCC["must-revalidate"]
+		_, proxyRevalidate := respCC["proxy-revalidate"]
+		if swr, ok := ccSeconds(respCC, "stale-while-revalidate"); ok && !fresh && !reqNoCache && !respNoCache &&
+			!mustRevalidate && !proxyRevalidate && age-lifetime <= swr && entry.hasValidators() {
+			logf(r.Context(), "返回过期缓存并后台重新验证: %s", key)
+			p.writeCached(w, r, entry, "STALE")
+			go p.revalidate(key, req, r.Header.Clone(), entry)
+			return
+		}
+	}
+
+	if _, ok := reqCC["only-if-cached"]; ok && entry == nil {
+		http.Error(w, "缓存中没有该资源", http.StatusGatewayTimeout)
+		return
+	}
+
+	upReq := req
+	if entry != nil && entry.hasValidators() {
+		upReq = req.Clone(req.Context())
+		setValidators(upReq.Header, entry)
+	}
+	requestTime := time.Now()
+	resp, err := p.doUpstream(upReq)
+	if err != nil {
+		writeDialError(w, r, err)
+		return
+	}
+	defer resp.Body.Close()
+	responseTime := time.Now()
+
+	if entry != nil && upReq != req && resp.StatusCode == http.StatusNotModified {
+		updated := entry.refreshed(resp.Header, requestTime, responseTime)
+		c.store(key, updated)
+		logf(r.Context(), "缓存重新验证成功: %s", key)
+		p.writeCached(w, r, updated, "REVALIDATED")
+		return
+	}
+
+	w.Header().Set("X-Cache", "MISS")
+	removeHopByHopHeaders(resp.Header)
+	if !isStorable(r, resp) || resp.ContentLength > c.MaxObjectSize {
+		p.copyResponse(w, r, resp)
+		return
+	}
+
+	// 边返回边缓存，超过大小上限时放弃缓存
+	header := resp.Header.Clone()
+	buf := &cappedBuffer{limit: c.MaxObjectSize}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(resp.Body, buf), resp.Body}
+	if err := p.copyResponse(w, r, resp); err != nil || buf.overflow {
+		return
+	}
+	if r.Method == http.MethodGet {
+		c.store(key, &cacheEntry{
+			StatusCode:   resp.StatusCode,
+			Header:       header,
+			Body:         buf.Bytes(),
+			RequestTime:  requestTime,
+			ResponseTime: responseTime,
+			Vary:         varyValues(header, r.Header),
+		})
+	}
+}
+
+// revalidate 在后台重新验证过期的缓存条目
+func (p *ForwardProxy) revalidate(key string, req *http.Request, reqHeader http.Header, entry *cacheEntry) {
+	c := p.cache
+	if !c.startRevalidation(key) {
+		return
+	}
+	defer c.finishRevalidation(key)
+
+	// 使用客户端信息的副本：原请求的处理函数返回后还会读取原信息写入访问日志
+	ctx := context.Background()
+	if info := requestInfoFrom(req.Context()); info != nil {
+		inner := *info
+		inner.viaParent = nil
+		ctx = withRequestInfo(ctx, &inner)
+	}
+	ctx, cancel := context.WithTimeout(ctx, revalidateTimeout)
+	defer cancel()
+
+	upReq := req.Clone(ctx)
+	setValidators(upReq.Header, entry)
+	requestTime := time.Now()
+	resp, err := p.client.Do(upReq)
+	if err != nil {
+		logf(ctx, "后台重新验证失败 %s: %v", key, err)
+		return
+	}
+	defer resp.Body.Close()
+	responseTime := time.Now()
+
+	if resp.StatusCode == http.StatusNotModified {
+		c.store(key, entry.refreshed(resp.Header, requestTime, responseTime))
+		return
+	}
+	removeHopByHopHeaders(resp.Header)
+	if !isStorable(&http.Request{Method: http.MethodGet, Header: reqHeader}, resp) {
+		c.Invalidate(key)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, c.MaxObjectSize+1))
+	if err != nil || int64(len(body)) > c.MaxObjectSize {
+		return
+	}
+	c.store(key, &cacheEntry{
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header,
+		Body:         body,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+		Vary:         varyValues(resp.Header, reqHeader),
+	})
+}
+
+// handlePurge 处理PURGE请求，删除URL对应的缓存条目，只允许本机客户端
+func (p *ForwardProxy) handlePurge(w http.ResponseWriter, r *http.Request) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		http.Error(w, "只允许本机清除缓存", http.StatusForbidden)
+		return
+	}
+	key := cacheKey(r.URL)
+	if !p.cache.Invalidate(key) {
+		http.Error(w, "缓存中没有该资源", http.StatusNotFound)
+		return
+	}
+	logf(r.Context(), "已清除缓存: %s", key)
+	fmt.Fprintf(w, "已清除缓存: %s\n", key)
+}
+
+// cappedBuffer 有大小上限的缓冲区，超过上限后丢弃数据并标记溢出
+type cappedBuffer struct {
+	bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if !b.overflow {
+		if int64(b.Len()+len(p)) > b.limit {
+			b.overflow = true
+			b.Reset()
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
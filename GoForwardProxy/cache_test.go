@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"goproxycommon/accesslog"
+)
+
+// newProxyTestClient 在随机端口启动代理并返回通过它访问的客户端
+func newProxyTestClient(t *testing.T, proxy *ForwardProxy) *http.Client {
+	proxyServer := httptest.NewServer(proxy)
+	t.Cleanup(proxyServer.Close)
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	return &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   5 * time.Second,
+	}
+}
+
+// newCacheTestProxy 创建开启缓存的代理以及通过它访问的客户端
+func newCacheTestProxy(t *testing.T, cache *Cache) *http.Client {
+	proxy := NewForwardProxy()
+	proxy.SetCache(cache)
+	return newProxyTestClient(t, proxy)
+}
+
+// fetch 发送请求并返回X-Cache和响应体
+func fetch(t *testing.T, client *http.Client, method, target string, header http.Header) (string, string) {
+	req, _ := http.NewRequest(method, target, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.Header.Get("X-Cache"), string(body)
+}
+
+// TestCache 测试缓存的命中、重新验证、Vary和清除
+func TestCache(t *testing.T) {
+	var hits, revalidations int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/revalidate":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt32(&revalidations, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		fmt.Fprintf(w, "%s %s", r.URL.Path, r.Header.Get("Accept-Language"))
+	}))
+	defer backend.Close()
+
+	cache, err := NewCache(1<<20, "", 0)
+	if err != nil {
+		t.Fatalf("创建缓存失败: %v", err)
+	}
+	client := newCacheTestProxy(t, cache)
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		header    http.Header
+		wantCache string
+		wantBody  string
+		wantHits  int32
+	}{
+		{"首次请求", "GET", "/fresh", nil, "MISS", "/fresh ", 1},
+		{"新鲜命中", "GET", "/fresh", nil, "HIT", "/fresh ", 1},
+		{"HEAD使用GET的缓存", "HEAD", "/fresh", nil, "HIT", "", 1},
+		{"客户端no-cache", "GET", "/fresh", http.Header{"Cache-Control": {"no-cache"}}, "MISS", "/fresh ", 2},
+		{"no-store不缓存", "GET", "/no-store", nil, "MISS", "/no-store ", 3},
+		{"no-store再次请求", "GET", "/no-store", nil, "MISS", "/no-store ", 4},
+		{"首次请求需验证的资源", "GET", "/revalidate", nil, "MISS", "/revalidate ", 5},
+		{"条件请求重新验证", "GET", "/revalidate", nil, "REVALIDATED", "/revalidate ", 6},
+		{"Vary首个变体", "GET", "/vary", http.Header{"Accept-Language": {"zh"}}, "MISS", "/vary zh", 7},
+		{"Vary不同变体", "GET", "/vary", http.Header{"Accept-Language": {"en"}}, "MISS", "/vary en", 8},
+		{"Vary命中变体", "GET", "/vary", http.Header{"Accept-Language": {"zh"}}, "HIT", "/vary zh", 8},
+		{"清除缓存", methodPurge, "/fresh", nil, "", "已清除缓存: " + cacheKey(mustParseURL(backend.URL+"/fresh")) + "\n", 8},
+		{"清除后重新请求", "GET", "/fresh", nil, "MISS", "/fresh ", 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xcache, body := fetch(t, client, tt.method, backend.URL+tt.path, tt.header)
+			if xcache != tt.wantCache {
+				t.Errorf("X-Cache不匹配, 期望 %q, 实际 %q", tt.wantCache, xcache)
+			}
+			if body != tt.wantBody {
+				t.Errorf("响应体不匹配, 期望 %q, 实际 %q", tt.wantBody, body)
+			}
+			if got := atomic.LoadInt32(&hits); got != tt.wantHits {
+				t.Errorf("上游请求次数不匹配, 期望 %d, 实际 %d", tt.wantHits, got)
+			}
+		})
+	}
+	if revalidations != 1 {
+		t.Errorf("期望1次条件请求, 实际 %d", revalidations)
+	}
+}
+
+// TestCacheStaleWhileRevalidate 测试过期内容先返回、后台重新验证
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	revalidated := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			revalidated <- struct{}{}
+			return
+		}
+		fmt.Fprint(w, "v1")
+	}))
+	defer backend.Close()
+
+	cache, _ := NewCache(1<<20, "", 0)
+	client := newCacheTestProxy(t, cache)
+
+	if xcache, _ := fetch(t, client, "GET", backend.URL, nil); xcache != "MISS" {
+		t.Fatalf("首次请求应为MISS, 实际 %q", xcache)
+	}
+	xcache, body := fetch(t, client, "GET", backend.URL, nil)
+	if xcache != "STALE" || body != "v1" {
+		t.Fatalf("期望返回过期缓存, 实际 %q %q", xcache, body)
+	}
+	select {
+	case <-revalidated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("没有进行后台重新验证")
+	}
+}
+
+// TestCacheRevalidateAccessLog 测试经上级代理后台重新验证时与访问日志没有数据竞争，需要-race运行
+func TestCacheRevalidateAccessLog(t *testing.T) {
+	revalidated := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			if strings.Contains(strings.Join(r.Header.Values("Via"), ","), "parent") {
+				revalidated <- struct{}{}
+			}
+			return
+		}
+		fmt.Fprint(w, "v1")
+	}))
+	defer backend.Close()
+
+	parentProxy := NewForwardProxy()
+	parentProxy.SetViaName("parent")
+	parent := httptest.NewServer(parentProxy)
+	defer parent.Close()
+	router, err := ParseRoutes([]byte("127.0.0.1 " + parent.URL))
+	if err != nil {
+		t.Fatalf("解析路由规则失败: %v", err)
+	}
+
+	cache, _ := NewCache(1<<20, "", 0)
+	proxy := NewForwardProxy()
+	proxy.SetCache(cache)
+	proxy.SetRouter(router)
+	var buf bytes.Buffer
+	proxy.SetAccessLog(accesslog.New(&buf, accesslog.FormatJSON))
+	client := newProxyTestClient(t, proxy)
+
+	fetch(t, client, "GET", backend.URL, nil)
+	if xcache, _ := fetch(t, client, "GET", backend.URL, nil); xcache != "STALE" {
+		t.Fatalf("期望返回过期缓存, 实际 %q", xcache)
+	}
+	select {
+	case <-revalidated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("没有经上级代理进行后台重新验证")
+	}
+}
+
+// TestCacheDiskTier 测试磁盘层缓存以及重启后的读取
+func TestCacheDiskTier(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "磁盘缓存内容")
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	// 内存层放不下任何对象，全部走磁盘层
+	cache, err := NewCache(1, dir, 1<<20)
+	if err != nil {
+		t.Fatalf("创建缓存失败: %v", err)
+	}
+	client := newCacheTestProxy(t, cache)
+	fetch(t, client, "GET", backend.URL, nil)
+	if xcache, body := fetch(t, client, "GET", backend.URL, nil); xcache != "HIT" || body != "磁盘缓存内容" {
+		t.Errorf("期望磁盘层命中, 实际 %q %q", xcache, body)
+	}
+
+	reopened, err := NewCache(1<<20, dir, 1<<20)
+	if err != nil {
+		t.Fatalf("重新打开缓存失败: %v", err)
+	}
+	client = newCacheTestProxy(t, reopened)
+	if xcache, _ := fetch(t, client, "GET", backend.URL, nil); xcache != "HIT" {
+		t.Errorf("重新打开后期望命中, 实际 %q", xcache)
+	}
+	if hits != 1 {
+		t.Errorf("上游请求次数不匹配, 期望 1, 实际 %d", hits)
+	}
+}
+
+// TestCacheDiskVariants 测试只在磁盘层的Vary变体在保存新变体时不会丢失
+func TestCacheDiskVariants(t *testing.T) {
+	dir := t.TempDir()
+	// 内存层放不下任何对象，变体只在磁盘层
+	cache, err := NewCache(1, dir, 1<<20)
+	if err != nil {
+		t.Fatalf("创建缓存失败: %v", err)
+	}
+	key := "http://example.com/"
+	for _, lang := range []string{"zh", "en"} {
+		cache.store(key, &cacheEntry{StatusCode: 200, Body: []byte(lang), Vary: map[string]string{"Accept-Language": lang}})
+	}
+	for _, lang := range []string{"zh", "en"} {
+		e := cache.lookup(key, http.Header{"Accept-Language": {lang}})
+		if e == nil || string(e.Body) != lang {
+			t.Errorf("变体%s丢失: %+v", lang, e)
+		}
+	}
+}
+
+func mustParseURL(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
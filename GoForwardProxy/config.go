@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"goproxycommon/accesslog"
+	"goproxycommon/proxyproto"
+)
+
+// Duration 配置文件中的时长，写作"30s"、"5m"等字符串，数字按秒计算
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+		return nil
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("无效的时长 %q", v)
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+	return fmt.Errorf("无效的时长: %s", b)
+}
+
+// Config GoForwardProxy的完整配置。可以从JSON或YAML文件加载，命令行参数优先于文件中的设置，例如：
+//
+//	{
+//	  "listen": {"http": ":8080", "socks": ":1080"},
+//	  "timeouts": {"tunnel_idle": "5m", "response_header": "30s"},
+//	  "upstream": {"routes": "routes.txt", "dns": ["1.1.1.1"], "tls_min_version": "1.2"},
+//	  "acl": "acl.txt",
+//	  "auth": {"htpasswd": "users.htpasswd"},
+//	  "log": {"access_log": "access.log", "format": "json"}
+//	}
+type Config struct {
+	File string `json:"-"` // 配置文件路径，为空时只使用命令行参数
+
+	Listen   ListenConfig   `json:"listen"`
+	Timeouts TimeoutConfig  `json:"timeouts"`
+	Upstream UpstreamConfig `json:"upstream"`
+	ACL      string         `json:"acl"` // 访问控制规则文件，为空时使用默认规则
+	Auth     AuthConfig     `json:"auth"`
+	Log      LogConfig      `json:"log"`
+	Limits   LimitConfig    `json:"limits"`
+	Cache    CacheConfig    `json:"cache"`
+	MITM     MITMConfig     `json:"mitm"`
+	HAR      HARConfig      `json:"har"`
+	Via      string         `json:"via"`       // Via头中本代理的标识，为空时使用主机名
+	PACProxy string         `json:"pac_proxy"` // PAC文件中的代理地址，为空时使用请求PAC时的Host
+}
+
+// ListenConfig 监听地址，修改后需要重启才能生效。证书文件在重新加载配置时重新读取，只有开启或关闭HTTPS需要重启
+type ListenConfig struct {
+	HTTP              string   `json:"http"`
+	SOCKS             string   `json:"socks"` // 为空时不启动
+	Admin             string   `json:"admin"` // 为空时不启动
+	ProxyProtocolFrom []string `json:"proxy_protocol_from"`
+	TLSCert           string   `json:"tls_cert"` // 非空时HTTP代理监听地址使用TLS（HTTPS代理）
+	TLSKey            string   `json:"tls_key"`
+}
+
+// TimeoutConfig 超时设置，0表示不限制。Read、Write和Idle修改后需要重启才能生效
+type TimeoutConfig struct {
+	Read           Duration `json:"read"`
+	Write          Duration `json:"write"`
+	Idle           Duration `json:"idle"`
+	Dial           Duration `json:"dial"`
+	ResponseHeader Duration `json:"response_header"`
+	ExpectContinue Duration `json:"expect_continue"`
+	BodyIdle       Duration `json:"body_idle"`
+	TunnelIdle     Duration `json:"tunnel_idle"`
+	TunnelMax      Duration `json:"tunnel_max"`
+	ShutdownGrace  Duration `json:"shutdown_grace"`
+}
+
+// UpstreamConfig 出站连接：上级代理路由、DNS、连接池、TLS和PROXY协议
+type UpstreamConfig struct {
+	Routes              string   `json:"routes"`
+	DNS                 []string `json:"dns"`
+	Hosts               string   `json:"hosts"`
+	DNSNegativeTTL      Duration `json:"dns_negative_ttl"`
+	MaxIdleConns        int      `json:"max_idle_conns"`
+	MaxIdleConnsPerHost int      `json:"max_idle_conns_per_host"`
+	IdleConnTimeout     Duration `json:"idle_conn_timeout"`
+	SourceAddrs         []string `json:"source_addrs"`   // 出站连接绑定的本地地址，每个地址族一个，路由规则中的source优先
+	FallbackDelay       Duration `json:"fallback_delay"` // happy eyeballs开始尝试下一个地址的等待时间，0表示依次尝试
+
+	TLSCA         []string `json:"tls_ca"`
+	TLSHosts      string   `json:"tls_hosts"`
+	TLSMinVersion string   `json:"tls_min_version"`
+
+	SendProxyProtocol      int      `json:"send_proxy_protocol"`
+	SendProxyProtocolHosts []string `json:"send_proxy_protocol_hosts"`
+}
+
+// AuthConfig 代理认证
+type AuthConfig struct {
+	Htpasswd string `json:"htpasswd"` // 为空时不需要认证
+	Realm    string `json:"realm"`
+}
+
+// LogConfig 访问日志，修改后需要重启才能生效
+type LogConfig struct {
+	AccessLog string `json:"access_log"` // "-"表示标准输出，为空时不记录
+	Format    string `json:"format"`
+	MaxSizeMB int64  `json:"max_size_mb"`
+	Backups   int    `json:"backups"`
+}
+
+// LimitConfig 每个客户端的限制和请求体大小上限，0表示不限制
+type LimitConfig struct {
+	RateKB  int64 `json:"rate_kb"`
+	Conns   int   `json:"conns"`
+	QuotaMB int64 `json:"quota_mb"`
+	BodyKB  int64 `json:"body_kb"` // 单个请求体的大小上限，超过时返回413
+}
+
+// CacheConfig HTTP缓存，修改后需要重启才能生效
+type CacheConfig struct {
+	MemMB  int64  `json:"mem_mb"` // 0表示不开启缓存
+	Dir    string `json:"dir"`
+	DiskMB int64  `json:"disk_mb"`
+}
+
+// MITMConfig HTTPS拦截
+type MITMConfig struct {
+	Enabled bool     `json:"enabled"`
+	CACert  string   `json:"ca_cert"`
+	CAKey   string   `json:"ca_key"`
+	Bypass  []string `json:"bypass"`
+}
+
+// HARConfig HAR录制和回放。录制的设置修改后需要重启才能生效，回放文件在重新加载时重新读取
+type HARConfig struct {
+	Record    string `json:"record"`      // 录制目录，为空时不录制
+	Per       string `json:"per"`         // session: 每次启动一个文件；client: 每个客户端IP一个文件
+	MaxBodyKB int64  `json:"max_body_kb"` // 每个请求体和响应体最多记录的大小，0表示不记录内容
+	Replay    string `json:"replay"`      // 非空时从这个HAR文件回放响应，不访问网络
+}
+
+// DefaultConfig 返回默认配置
+func DefaultConfig() *Config {
+	return &Config{
+		Listen: ListenConfig{HTTP: ":8080", Admin: "127.0.0.1:9090"},
+		Timeouts: TimeoutConfig{
+			Read:           Duration(time.Minute),
+			Write:          Duration(time.Minute),
+			Idle:           Duration(2 * time.Minute),
+			Dial:           Duration(30 * time.Second),
+			ResponseHeader: Duration(defaultResponseHeaderTimeout),
+			ExpectContinue: Duration(defaultExpectContinueTimeout),
+			BodyIdle:       Duration(defaultBodyIdleTimeout),
+			TunnelIdle:     Duration(defaultTunnelIdleTimeout),
+			ShutdownGrace:  Duration(defaultShutdownGrace),
+		},
+		Upstream: UpstreamConfig{
+			DNSNegativeTTL:  Duration(defaultDNSNegativeTTL),
+			MaxIdleConns:    100,
+			IdleConnTimeout: Duration(90 * time.Second),
+			FallbackDelay:   Duration(defaultFallbackDelay),
+			TLSMinVersion:   "1.2",
+		},
+		Auth:  AuthConfig{Realm: "GoForwardProxy"},
+		Log:   LogConfig{Format: "squid", MaxSizeMB: 100, Backups: 5},
+		Cache: CacheConfig{DiskMB: 1024},
+		MITM:  MITMConfig{CACert: "ca.pem", CAKey: "ca-key.pem"},
+		HAR:   HARConfig{Per: "session", MaxBodyKB: 1024},
+	}
+}
+
+// listFlag 逗号分隔的列表参数
+type listFlag struct {
+	items *[]string
+}
+
+func (f listFlag) String() string {
+	if f.items == nil {
+		return ""
+	}
+	return strings.Join(*f.items, ",")
+}
+
+func (f listFlag) Set(s string) error {
+	*f.items = splitList(s)
+	return nil
+}
+
+// flagSet 返回把命令行参数写入c的FlagSet，参数的默认值为c中的当前值
+func (c *Config) flagSet(handling flag.ErrorHandling) *flag.FlagSet {
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), handling)
+	duration := func(d *Duration, name, usage string) {
+		fs.DurationVar((*time.Duration)(d), name, time.Duration(*d), usage)
+	}
+	list := func(items *[]string, name, usage string) {
+		fs.Var(listFlag{items}, name, usage)
+	}
+
+	fs.StringVar(&c.File, "config", c.File, "JSON或YAML配置文件，命令行参数优先于文件中的设置；收到SIGHUP或文件修改后重新加载")
+
+	fs.StringVar(&c.Listen.HTTP, "listen", c.Listen.HTTP, "HTTP代理监听地址")
+	fs.StringVar(&c.Listen.SOCKS, "socks", c.Listen.SOCKS, "SOCKS5监听地址，如 :1080，为空时不启动")
+	fs.StringVar(&c.Listen.Admin, "admin", c.Listen.Admin, "管理接口（隧道管理、/metrics 指标和 /faults 故障注入）监听地址，为空时不启动")
+	list(&c.Listen.ProxyProtocolFrom, "proxy-protocol-from", "信任PROXY协议头的负载均衡器地址（CIDR），逗号分隔，为空时不解析")
+	fs.StringVar(&c.Listen.TLSCert, "tls-cert", c.Listen.TLSCert, "HTTPS代理的证书文件（PEM），设置后客户端通过TLS连接代理，支持HTTP/2")
+	fs.StringVar(&c.Listen.TLSKey, "tls-key", c.Listen.TLSKey, "HTTPS代理的私钥文件（PEM）")
+
+	duration(&c.Timeouts.Read, "read-timeout", "读取客户端请求的超时时间，0表示不限制")
+	duration(&c.Timeouts.Write, "write-timeout", "写入响应的超时时间，0表示不限制")
+	duration(&c.Timeouts.Idle, "idle-timeout", "客户端keep-alive连接的空闲超时，0表示不限制")
+	duration(&c.Timeouts.Dial, "dial-timeout", "连接上游的超时时间，0表示不限制")
+	duration(&c.Timeouts.ResponseHeader, "header-timeout", "等待上游响应头的超时时间，0表示不限制")
+	duration(&c.Timeouts.ExpectContinue, "expect-continue-timeout", "请求带有Expect: 100-continue时等待上游100 Continue的时间，超时后直接发送请求体，0表示不等待")
+	duration(&c.Timeouts.BodyIdle, "body-idle-timeout", "上游响应体持续无数据的超时时间，0表示不限制")
+	duration(&c.Timeouts.TunnelIdle, "tunnel-idle", "隧道空闲超时，0表示不限制")
+	duration(&c.Timeouts.TunnelMax, "tunnel-max", "隧道最长存活时间，0表示不限制")
+	duration(&c.Timeouts.ShutdownGrace, "shutdown-grace", "退出时等待请求和隧道结束的时间，超时后强制关闭")
+
+	fs.StringVar(&c.Upstream.Routes, "routes", c.Upstream.Routes, "上级代理路由规则文件，为空时全部直连")
+	list(&c.Upstream.DNS, "dns", "DNS服务器地址，逗号分隔，为空时使用系统解析器")
+	fs.StringVar(&c.Upstream.Hosts, "hosts", c.Upstream.Hosts, "hosts格式的静态主机记录文件，优先于DNS解析")
+	duration(&c.Upstream.DNSNegativeTTL, "dns-negative-ttl", "域名不存在时的缓存时间")
+	fs.IntVar(&c.Upstream.MaxIdleConns, "max-idle-conns", c.Upstream.MaxIdleConns, "上游连接池的最大空闲连接数，0表示不限制")
+	fs.IntVar(&c.Upstream.MaxIdleConnsPerHost, "max-idle-conns-per-host", c.Upstream.MaxIdleConnsPerHost, "每个上游主机的最大空闲连接数，0表示使用默认值2")
+	duration(&c.Upstream.IdleConnTimeout, "idle-conn-timeout", "上游空闲连接的保留时间，0表示不限制")
+	list(&c.Upstream.SourceAddrs, "source-addr", "出站连接绑定的本地地址，逗号分隔，每个地址族使用第一个同族地址；路由规则中的source=优先")
+	duration(&c.Upstream.FallbackDelay, "fallback-delay", "目标有多个地址时，上一个连接尝试超过这个时间没有结果就并行尝试下一个地址（happy eyeballs），0表示依次尝试")
+	list(&c.Upstream.TLSCA, "tls-ca", "额外信任的上游CA证书文件（PEM），逗号分隔，与系统根证书一起使用")
+	fs.StringVar(&c.Upstream.TLSHosts, "tls-hosts", c.Upstream.TLSHosts, "按主机设置CA、客户端证书和最低版本的TLS规则文件")
+	fs.StringVar(&c.Upstream.TLSMinVersion, "tls-min-version", c.Upstream.TLSMinVersion, "连接上游的最低TLS版本: 1.0、1.1、1.2 或 1.3")
+	fs.IntVar(&c.Upstream.SendProxyProtocol, "send-proxy-protocol", c.Upstream.SendProxyProtocol, "向隧道目标发送的PROXY协议版本: 1 或 2，0表示不发送")
+	list(&c.Upstream.SendProxyProtocolHosts, "send-proxy-protocol-hosts", "需要PROXY协议头的隧道目标主机，逗号分隔，支持 *.example.com")
+
+	fs.StringVar(&c.ACL, "acl", c.ACL, "访问控制规则文件，为空时使用默认规则（禁止内网地址，CONNECT只允许443端口）")
+
+	fs.StringVar(&c.Auth.Htpasswd, "htpasswd", c.Auth.Htpasswd, "代理认证使用的htpasswd用户文件，为空时不需要认证")
+	fs.StringVar(&c.Auth.Realm, "auth-realm", c.Auth.Realm, "代理认证的realm")
+
+	fs.StringVar(&c.Log.AccessLog, "access-log", c.Log.AccessLog, "访问日志文件，\"-\"表示标准输出，为空时不记录")
+	fs.StringVar(&c.Log.Format, "access-log-format", c.Log.Format, "访问日志格式: squid、combined 或 json")
+	fs.Int64Var(&c.Log.MaxSizeMB, "access-log-max-size", c.Log.MaxSizeMB, "访问日志轮转大小（MB），0表示不轮转")
+	fs.IntVar(&c.Log.Backups, "access-log-backups", c.Log.Backups, "访问日志保留的旧文件数")
+
+	fs.Int64Var(&c.Limits.RateKB, "limit-rate", c.Limits.RateKB, "每个客户端的带宽上限（KB/s），0表示不限制")
+	fs.IntVar(&c.Limits.Conns, "limit-conns", c.Limits.Conns, "每个客户端的最大并发连接数，0表示不限制")
+	fs.Int64Var(&c.Limits.QuotaMB, "limit-quota", c.Limits.QuotaMB, "每个客户端的每日流量配额（MB），0表示不限制")
+	fs.Int64Var(&c.Limits.BodyKB, "limit-body", c.Limits.BodyKB, "单个请求体的大小上限（KB），超过时返回413，0表示不限制")
+
+	fs.Int64Var(&c.Cache.MemMB, "cache-mem", c.Cache.MemMB, "HTTP缓存内存上限（MB），0表示不开启缓存")
+	fs.StringVar(&c.Cache.Dir, "cache-dir", c.Cache.Dir, "HTTP缓存磁盘目录，为空时只使用内存")
+	fs.Int64Var(&c.Cache.DiskMB, "cache-disk", c.Cache.DiskMB, "HTTP缓存磁盘上限（MB）")
+
+	fs.BoolVar(&c.MITM.Enabled, "mitm", c.MITM.Enabled, "开启HTTPS拦截模式")
+	fs.StringVar(&c.MITM.CACert, "ca-cert", c.MITM.CACert, "拦截模式使用的CA证书文件，不存在时自动生成")
+	fs.StringVar(&c.MITM.CAKey, "ca-key", c.MITM.CAKey, "拦截模式使用的CA私钥文件")
+	list(&c.MITM.Bypass, "mitm-bypass", "不进行拦截的主机列表，逗号分隔，支持*.example.com")
+
+	fs.StringVar(&c.HAR.Record, "har-record", c.HAR.Record, "把HTTP请求和响应录制为HAR文件的目录，为空时不录制")
+	fs.StringVar(&c.HAR.Per, "har-per", c.HAR.Per, "HAR文件的划分方式: session（每次启动一个文件）或 client（每个客户端IP一个文件）")
+	fs.Int64Var(&c.HAR.MaxBodyKB, "har-max-body", c.HAR.MaxBodyKB, "HAR中每个请求体和响应体最多记录的大小（KB），0表示不记录内容")
+	fs.StringVar(&c.HAR.Replay, "har-replay", c.HAR.Replay, "从HAR文件回放响应而不访问网络，HTTPS请求需要同时开启-mitm")
+
+	fs.StringVar(&c.Via, "via", c.Via, "Via头中本代理的标识，默认使用主机名")
+	fs.StringVar(&c.PACProxy, "pac-proxy", c.PACProxy, "PAC文件中客户端使用的代理地址，默认使用请求PAC时的Host")
+	return fs
+}
+
+// LoadConfig 解析命令行参数，指定了-config时先加载配置文件，再用命令行中出现的参数覆盖，最后检查配置
+func LoadConfig(args []string) (*Config, error) {
+	c := DefaultConfig()
+	if err := c.flagSet(flag.ContinueOnError).Parse(args); err != nil {
+		return nil, err
+	}
+	if c.File != "" {
+		path := c.File
+		c = DefaultConfig()
+		if err := c.readFile(path); err != nil {
+			return nil, err
+		}
+		// 参数已经解析过一次，这里不会出错
+		fs := c.flagSet(flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.Parse(args)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readFile 读取配置文件，扩展名为.yaml或.yml时按YAML解析，否则按JSON解析。未知的配置项视为错误
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("读取配置文件失败: %v", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		tree, err := parseYAML(data)
+		if err != nil {
+			return fmt.Errorf("配置文件%s: %v", path, err)
+		}
+		if data, err = json.Marshal(yamlToType(tree, reflect.TypeOf(c))); err != nil {
+			return fmt.Errorf("配置文件%s: %v", path, err)
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("配置文件%s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate 检查不需要读取其他文件就能发现的配置错误
+func (c *Config) Validate() error {
+	if c.Listen.HTTP == "" {
+		return fmt.Errorf("HTTP代理监听地址不能为空")
+	}
+	if _, err := proxyproto.ParseCIDRs(strings.Join(c.Listen.ProxyProtocolFrom, ",")); err != nil {
+		return fmt.Errorf("解析PROXY协议可信地址失败: %v", err)
+	}
+	if (c.Listen.TLSCert == "") != (c.Listen.TLSKey == "") {
+		return fmt.Errorf("HTTPS代理的证书和私钥需要同时设置")
+	}
+	if c.Log.AccessLog != "" {
+		if _, err := accesslog.ParseFormat(c.Log.Format); err != nil {
+			return err
+		}
+	}
+	if _, err := ParseTLSVersion(c.Upstream.TLSMinVersion); err != nil {
+		return err
+	}
+	if _, err := ParseSourceAddrs(c.Upstream.SourceAddrs); err != nil {
+		return err
+	}
+	if v := c.Upstream.SendProxyProtocol; v != 0 && v != 1 && v != 2 {
+		return fmt.Errorf("不支持的PROXY协议版本: %d", v)
+	}
+	durations := map[string]Duration{
+		"timeouts.read": c.Timeouts.Read, "timeouts.write": c.Timeouts.Write, "timeouts.idle": c.Timeouts.Idle,
+		"timeouts.dial": c.Timeouts.Dial, "timeouts.response_header": c.Timeouts.ResponseHeader,
+		"timeouts.expect_continue": c.Timeouts.ExpectContinue, "timeouts.body_idle": c.Timeouts.BodyIdle,
+		"timeouts.tunnel_idle": c.Timeouts.TunnelIdle, "timeouts.tunnel_max": c.Timeouts.TunnelMax,
+		"timeouts.shutdown_grace": c.Timeouts.ShutdownGrace, "upstream.dns_negative_ttl": c.Upstream.DNSNegativeTTL,
+		"upstream.idle_conn_timeout": c.Upstream.IdleConnTimeout, "upstream.fallback_delay": c.Upstream.FallbackDelay,
+	}
+	for name, d := range durations {
+		if d < 0 {
+			return fmt.Errorf("%s不能为负数", name)
+		}
+	}
+	if c.HAR.Per != "session" && c.HAR.Per != "client" {
+		return fmt.Errorf("不支持的HAR文件划分方式: %q", c.HAR.Per)
+	}
+	if c.HAR.MaxBodyKB < 0 {
+		return fmt.Errorf("HAR记录的内容大小不能为负数")
+	}
+	if c.Limits.RateKB < 0 || c.Limits.Conns < 0 || c.Limits.QuotaMB < 0 || c.Limits.BodyKB < 0 {
+		return fmt.Errorf("客户端限制不能为负数")
+	}
+	if c.Cache.MemMB < 0 || c.Cache.DiskMB < 0 || c.Upstream.MaxIdleConns < 0 || c.Upstream.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("缓存大小和连接池大小不能为负数")
+	}
+	return nil
+}
+
+// restartRequired 返回与old相比修改了的、需要重启才能生效的配置项
+func (c *Config) restartRequired(old *Config) []string {
+	var changed []string
+	// 证书文件在重新加载时重新读取，只比较是否开启了HTTPS
+	listen, oldListen := c.Listen, old.Listen
+	listen.TLSCert, listen.TLSKey, oldListen.TLSCert, oldListen.TLSKey = "", "", "", ""
+	if !reflect.DeepEqual(listen, oldListen) || (c.Listen.TLSCert == "") != (old.Listen.TLSCert == "") {
+		changed = append(changed, "listen")
+	}
+	if c.Timeouts.Read != old.Timeouts.Read || c.Timeouts.Write != old.Timeouts.Write || c.Timeouts.Idle != old.Timeouts.Idle {
+		changed = append(changed, "timeouts.read/write/idle")
+	}
+	if c.Log != old.Log {
+		changed = append(changed, "log")
+	}
+	if c.Cache != old.Cache {
+		changed = append(changed, "cache")
+	}
+	if c.HAR.Record != old.HAR.Record || c.HAR.Per != old.HAR.Per || c.HAR.MaxBodyKB != old.HAR.MaxBodyKB {
+		changed = append(changed, "har.record")
+	}
+	return changed
+}
+
+// listenCertificate 读取HTTPS代理的证书和私钥，没有开启HTTPS时返回nil
+func (c *Config) listenCertificate() (*tls.Certificate, error) {
+	if c.Listen.TLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.Listen.TLSCert, c.Listen.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("加载HTTPS代理证书失败: %v", err)
+	}
+	return &cert, nil
+}
+
+// limits 返回客户端限制，全部为0时返回false
+func (c *Config) limits() (Limits, bool) {
+	limits := Limits{Rate: c.Limits.RateKB << 10, MaxConns: c.Limits.Conns, DailyQuota: c.Limits.QuotaMB << 20}
+	return limits, limits.Rate > 0 || limits.MaxConns > 0 || limits.DailyQuota > 0
+}
+
+// NewProxy 按配置创建代理实例，并返回SOCKS5认证使用的用户存储。
+// prev不为nil时为重新加载配置：沿用prev的运行状态、访问日志和缓存，
+// 客户端限制、DNS解析和CA未修改时沿用原来的计数、解析缓存和叶子证书
+func (c *Config) NewProxy(prev *ForwardProxy) (*ForwardProxy, PasswordStore, error) {
+	proxy := NewForwardProxy()
+	if prev != nil {
+		proxy.inherit(prev)
+	}
+	proxy.SetTunnelTimeouts(time.Duration(c.Timeouts.TunnelIdle), time.Duration(c.Timeouts.TunnelMax))
+	proxy.SetUpstreamTimeouts(time.Duration(c.Timeouts.ResponseHeader), time.Duration(c.Timeouts.BodyIdle))
+	proxy.SetDialTimeout(time.Duration(c.Timeouts.Dial))
+	proxy.SetExpectContinueTimeout(time.Duration(c.Timeouts.ExpectContinue))
+	proxy.SetMaxRequestBody(c.Limits.BodyKB << 10)
+	proxy.SetConnPool(c.Upstream.MaxIdleConns, c.Upstream.MaxIdleConnsPerHost, time.Duration(c.Upstream.IdleConnTimeout))
+	proxy.SetFallbackDelay(time.Duration(c.Upstream.FallbackDelay))
+	proxy.SetPACProxy(c.PACProxy)
+	if c.Via != "" {
+		proxy.SetViaName(c.Via)
+	}
+
+	if prev == nil && c.Log.AccessLog != "" {
+		format, err := accesslog.ParseFormat(c.Log.Format)
+		if err != nil {
+			return nil, nil, err
+		}
+		logger, err := accesslog.Open(c.Log.AccessLog, format, c.Log.MaxSizeMB<<20, c.Log.Backups)
+		if err != nil {
+			return nil, nil, fmt.Errorf("打开访问日志失败: %v", err)
+		}
+		proxy.SetAccessLog(logger)
+		log.Printf("访问日志: %s（%s格式）", c.Log.AccessLog, c.Log.Format)
+	}
+	if prev == nil && c.Cache.MemMB > 0 {
+		cache, err := NewCache(c.Cache.MemMB<<20, c.Cache.Dir, c.Cache.DiskMB<<20)
+		if err != nil {
+			return nil, nil, fmt.Errorf("创建缓存失败: %v", err)
+		}
+		proxy.SetCache(cache)
+		log.Printf("HTTP缓存已开启，内存 %dMB，磁盘目录 %q", c.Cache.MemMB, c.Cache.Dir)
+	}
+	if prev == nil && c.HAR.Record != "" {
+		recorder, err := NewHARRecorder(c.HAR.Record, c.HAR.Per == "client", c.HAR.MaxBodyKB<<10)
+		if err != nil {
+			return nil, nil, fmt.Errorf("创建HAR录制目录失败: %v", err)
+		}
+		proxy.SetHARRecorder(recorder)
+		log.Printf("HAR录制已开启，目录 %s", c.HAR.Record)
+	}
+	if c.HAR.Replay != "" {
+		replay, err := LoadHARReplay(c.HAR.Replay)
+		if err != nil {
+			return nil, nil, fmt.Errorf("加载HAR回放文件失败: %v", err)
+		}
+		proxy.SetHARReplay(replay)
+		log.Printf("HAR回放模式，从 %s 回放%d条记录，不访问网络", c.HAR.Replay, replay.Len())
+	}
+
+	var upstreamResolver Resolver
+	if len(c.Upstream.DNS) > 0 {
+		upstreamResolver = NewDNSClient(c.Upstream.DNS)
+		log.Printf("使用DNS服务器: %s", strings.Join(c.Upstream.DNS, ","))
+	}
+	resolver := NewCachingResolver(upstreamResolver)
+	resolver.NegativeTTL = time.Duration(c.Upstream.DNSNegativeTTL)
+	// 解析设置未修改时沿用原来的解析器，保留已缓存的结果
+	if prev != nil {
+		if cached, ok := prev.resolver.(*CachingResolver); ok && cached.sameSettings(resolver) {
+			resolver = cached
+		}
+	}
+	var hosts map[string][]net.IP
+	if c.Upstream.Hosts != "" {
+		var err error
+		if hosts, err = LoadHosts(c.Upstream.Hosts); err != nil {
+			return nil, nil, fmt.Errorf("加载主机记录失败: %v", err)
+		}
+		log.Printf("已加载%d条静态主机记录: %s", len(hosts), c.Upstream.Hosts)
+	}
+	proxy.SetResolver(resolver)
+
+	if len(c.Upstream.SourceAddrs) > 0 {
+		sources, err := ParseSourceAddrs(c.Upstream.SourceAddrs)
+		if err != nil {
+			return nil, nil, err
+		}
+		proxy.SetSourceAddrs(sources)
+		log.Printf("出站连接绑定本地地址: %s", strings.Join(c.Upstream.SourceAddrs, ","))
+	}
+
+	if limits, ok := c.limits(); ok {
+		if prev != nil && prev.limiter != nil && prev.limiter.limits == limits {
+			proxy.SetLimiter(prev.limiter)
+		} else {
+			proxy.SetLimiter(NewLimiter(limits))
+			log.Printf("客户端限制已开启，带宽 %dKB/s，并发连接 %d，每日配额 %dMB", c.Limits.RateKB, c.Limits.Conns, c.Limits.QuotaMB)
+		}
+	}
+
+	if c.ACL != "" {
+		policy, err := LoadPolicy(c.ACL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("加载访问控制规则失败: %v", err)
+		}
+		proxy.SetPolicy(policy)
+		log.Printf("已加载访问控制规则: %s", c.ACL)
+	} else {
+		proxy.SetPolicy(DefaultPolicy())
+	}
+	if c.Upstream.Routes != "" {
+		router, err := LoadRoutes(c.Upstream.Routes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("加载路由规则失败: %v", err)
+		}
+		proxy.SetRouter(router)
+		log.Printf("已加载上级代理路由规则: %s", c.Upstream.Routes)
+	}
+
+	tlsPolicy, err := NewTLSPolicy(c.Upstream.TLSCA)
+	if err != nil {
+		return nil, nil, fmt.Errorf("加载TLS策略失败: %v", err)
+	}
+	if tlsPolicy.MinVersion, err = ParseTLSVersion(c.Upstream.TLSMinVersion); err != nil {
+		return nil, nil, err
+	}
+	if c.Upstream.TLSHosts != "" {
+		if tlsPolicy.Hosts, err = LoadTLSHostRules(c.Upstream.TLSHosts); err != nil {
+			return nil, nil, fmt.Errorf("加载TLS规则失败: %v", err)
+		}
+		log.Printf("已加载上游TLS规则: %s", c.Upstream.TLSHosts)
+	}
+	proxy.SetTLSPolicy(tlsPolicy)
+	if err := proxy.SetProxyProtocol(c.Upstream.SendProxyProtocol, c.Upstream.SendProxyProtocolHosts); err != nil {
+		return nil, nil, err
+	}
+
+	var users PasswordStore
+	if c.Auth.Htpasswd != "" {
+		file, err := LoadHtpasswd(c.Auth.Htpasswd)
+		if err != nil {
+			return nil, nil, fmt.Errorf("加载用户文件失败: %v", err)
+		}
+		users = file
+		proxy.SetAuthenticator(&BasicAuth{Realm: c.Auth.Realm, Store: users})
+		log.Printf("代理认证已开启，用户文件: %s", c.Auth.Htpasswd)
+	}
+	if c.MITM.Enabled {
+		if prev != nil && prev.ca != nil && prev.ca.loadedFrom(c.MITM.CACert, c.MITM.CAKey) {
+			// CA文件未修改时沿用原来的CA，保留已签发的叶子证书
+			proxy.EnableMITM(prev.ca, c.MITM.Bypass)
+		} else {
+			ca, err := LoadOrCreateCA(c.MITM.CACert, c.MITM.CAKey)
+			if err != nil {
+				return nil, nil, fmt.Errorf("加载CA失败: %v", err)
+			}
+			proxy.EnableMITM(ca, c.MITM.Bypass)
+			log.Printf("HTTPS拦截模式已开启，CA证书: %s", c.MITM.CACert)
+		}
+	}
+	// 沿用的解析器仍在被原来的代理使用，配置全部加载成功后才替换静态主机记录
+	resolver.SetHosts(hosts)
+	return proxy, users, nil
+}
+
+// inherit 沿用prev中与配置无关的运行状态（活跃隧道、拦截会话、指标和故障规则），
+// 以及需要重启才能修改的访问日志、缓存和HAR录制
+func (p *ForwardProxy) inherit(prev *ForwardProxy) {
+	p.tunnels = prev.tunnels
+	p.mitmServers = prev.mitmServers
+	p.metrics = prev.metrics
+	p.faults = prev.faults
+	p.accessLog = prev.accessLog
+	p.cache = prev.cache
+	p.har = prev.har
+}
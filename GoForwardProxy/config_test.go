@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeConfig 在临时目录中写入配置文件
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("写入配置文件失败: %v", err)
+	}
+	return path
+}
+
+// TestLoadConfig 测试JSON和YAML配置文件的加载，以及命令行参数的覆盖
+func TestLoadConfig(t *testing.T) {
+	jsonPath := writeConfig(t, "proxy.json", `{
+  "listen": {"http": ":3128", "socks": ":1080", "proxy_protocol_from": ["10.0.0.0/8"]},
+  "timeouts": {"tunnel_idle": "10m", "dial": 5},
+  "upstream": {"dns": ["1.1.1.1", "8.8.8.8"], "tls_min_version": "1.3", "max_idle_conns": 50},
+  "acl": "acl.txt",
+  "auth": {"htpasswd": "users"},
+  "log": {"access_log": "-", "format": "json"},
+  "via": "file-proxy"
+}`)
+	yamlPath := writeConfig(t, "proxy.yaml", `
+# 与proxy.json相同的配置
+listen:
+  http: ":3128"
+  socks: ":1080"
+  proxy_protocol_from: [10.0.0.0/8]
+timeouts:
+  tunnel_idle: 10m
+  dial: 5
+upstream:
+  dns:
+    - 1.1.1.1
+    - 8.8.8.8
+  tls_min_version: 1.3   # 不加引号的版本号按字符串处理
+  max_idle_conns: 50
+acl: acl.txt
+auth:
+  htpasswd: users
+log:
+  access_log: "-"   # 标准输出
+  format: json
+via: 'file-proxy'
+`)
+
+	want := DefaultConfig()
+	want.Listen = ListenConfig{HTTP: ":3128", SOCKS: ":1080", Admin: "127.0.0.1:9090", ProxyProtocolFrom: []string{"10.0.0.0/8"}}
+	want.Timeouts.TunnelIdle = Duration(10 * time.Minute)
+	want.Timeouts.Dial = Duration(5 * time.Second)
+	want.Upstream.DNS = []string{"1.1.1.1", "8.8.8.8"}
+	want.Upstream.TLSMinVersion = "1.3"
+	want.Upstream.MaxIdleConns = 50
+	want.ACL = "acl.txt"
+	want.Auth.Htpasswd = "users"
+	want.Log.AccessLog, want.Log.Format = "-", "json"
+	want.Via = "file-proxy"
+
+	for _, path := range []string{jsonPath, yamlPath} {
+		t.Run(filepath.Ext(path), func(t *testing.T) {
+			got, err := LoadConfig([]string{"-config", path})
+			if err != nil {
+				t.Fatalf("加载配置失败: %v", err)
+			}
+			want.File = path
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("配置不匹配:\n期望 %+v\n实际 %+v", want, got)
+			}
+		})
+	}
+
+	t.Run("YAML数字写入字符串字段", func(t *testing.T) {
+		path := writeConfig(t, "version.yaml", "upstream:\n  tls_min_version: 1.0\nvia: 42\n")
+		got, err := LoadConfig([]string{"-config", path})
+		if err != nil {
+			t.Fatalf("加载配置失败: %v", err)
+		}
+		if got.Upstream.TLSMinVersion != "1.0" || got.Via != "42" {
+			t.Errorf("字符串字段应保留原文: %q %q", got.Upstream.TLSMinVersion, got.Via)
+		}
+	})
+
+	t.Run("命令行参数优先", func(t *testing.T) {
+		// 参数可以出现在-config之前
+		got, err := LoadConfig([]string{"-via", "cli-proxy", "-config", jsonPath, "-dns", "9.9.9.9", "-tunnel-idle", "0"})
+		if err != nil {
+			t.Fatalf("加载配置失败: %v", err)
+		}
+		if got.Via != "cli-proxy" || !reflect.DeepEqual(got.Upstream.DNS, []string{"9.9.9.9"}) || got.Timeouts.TunnelIdle != 0 {
+			t.Errorf("命令行参数没有覆盖配置文件: %+v", got)
+		}
+		if got.Listen.HTTP != ":3128" {
+			t.Errorf("未指定的参数应使用配置文件中的值: %q", got.Listen.HTTP)
+		}
+	})
+
+	t.Run("只有命令行参数", func(t *testing.T) {
+		got, err := LoadConfig([]string{"-listen", ":9999"})
+		if err != nil {
+			t.Fatalf("加载配置失败: %v", err)
+		}
+		if got.Listen.HTTP != ":9999" || got.Timeouts.TunnelIdle != Duration(defaultTunnelIdleTimeout) {
+			t.Errorf("配置不正确: %+v", got)
+		}
+	})
+}
+
+// TestConfigErrors 测试无效配置被拒绝
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		args    []string
+	}{
+		{"未知配置项", "a.json", `{"listen": {"htpp": ":80"}}`, nil},
+		{"JSON格式错误", "a.json", `{"listen": `, nil},
+		{"无效的时长", "a.json", `{"timeouts": {"dial": "5 minutes"}}`, nil},
+		{"负数时长", "a.json", `{"timeouts": {"tunnel_idle": "-1s"}}`, nil},
+		{"无效的TLS版本", "a.yaml", "upstream:\n  tls_min_version: \"2.0\"\n", nil},
+		{"无效的日志格式", "a.json", `{"log": {"access_log": "-", "format": "xml"}}`, nil},
+		{"无效的PROXY协议版本", "a.json", `{"upstream": {"send_proxy_protocol": 3}}`, nil},
+		{"无效的可信地址", "a.json", `{}`, []string{"-proxy-protocol-from", "not-an-ip"}},
+		{"负数限制", "a.json", `{"limits": {"conns": -1}}`, nil},
+		{"负数请求体上限", "a.json", `{}`, []string{"-limit-body", "-1"}},
+		{"无效的本地地址", "a.json", `{"upstream": {"source_addrs": ["eth0"]}}`, nil},
+		{"空监听地址", "a.json", `{"listen": {"http": ""}}`, nil},
+		{"HTTPS代理缺少私钥", "a.json", `{"listen": {"tls_cert": "proxy.pem"}}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, tt.file, tt.content)
+			if _, err := LoadConfig(append([]string{"-config", path}, tt.args...)); err == nil {
+				t.Error("期望返回错误")
+			}
+		})
+	}
+	if _, err := LoadConfig([]string{"-config", filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Error("配置文件不存在时应返回错误")
+	}
+}
+
+// TestRestartRequired 测试识别需要重启才能生效的修改
+func TestRestartRequired(t *testing.T) {
+	old := DefaultConfig()
+	c := DefaultConfig()
+	c.Via = "other"
+	c.Timeouts.TunnelIdle = 0
+	old.Listen.TLSCert, old.Listen.TLSKey = "a.pem", "a-key.pem"
+	c.Listen.TLSCert, c.Listen.TLSKey = "b.pem", "b-key.pem"
+	if changed := c.restartRequired(old); len(changed) != 0 {
+		t.Errorf("可以热加载的修改不应要求重启: %v", changed)
+	}
+	c.Listen.TLSCert, c.Listen.TLSKey = "", ""
+	if changed := c.restartRequired(old); !reflect.DeepEqual(changed, []string{"listen"}) {
+		t.Errorf("关闭HTTPS应要求重启: %v", changed)
+	}
+	c.Listen.SOCKS = ":1080"
+	c.Timeouts.Read = 0
+	c.Cache.MemMB = 10
+	if changed := c.restartRequired(old); !reflect.DeepEqual(changed, []string{"listen", "timeouts.read/write/idle", "cache"}) {
+		t.Errorf("需要重启的配置项不正确: %v", changed)
+	}
+}
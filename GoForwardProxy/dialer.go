@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// resolvedTarget 已解析并通过访问控制检查的目标地址
+type resolvedTarget struct {
+	addr string
+	ips  []net.IP
+}
+
+// authorizeTarget 解析目标地址并进行访问控制检查，结果保存在返回的上下文中供拨号使用，
+// 保证检查和连接使用同一次DNS解析的结果，避免DNS重绑定绕过检查
+func (p *ForwardProxy) authorizeTarget(ctx context.Context, addr string) (context.Context, error) {
+	if p.policy == nil {
+		return ctx, nil
+	}
+	ips, err := p.resolveTarget(ctx, addr)
+	if err != nil {
+		p.metrics.observeDialError(err)
+		return ctx, err
+	}
+	return context.WithValue(ctx, resolvedTargetKey, &resolvedTarget{addr: addr, ips: ips}), nil
+}
+
+// resolveTarget 解析目标主机，返回通过访问控制检查的IP列表，未设置规则时返回全部IP
+func (p *ForwardProxy) resolveTarget(ctx context.Context, addr string) ([]net.IP, error) {
+	ips, _, err := p.resolveTargetTTL(ctx, addr)
+	return ips, err
+}
+
+// resolveTargetTTL 同resolveTarget，同时返回解析结果还可以使用的时间，0表示未知
+func (p *ForwardProxy) resolveTargetTTL(ctx context.Context, addr string) ([]net.IP, time.Duration, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("无效的端口: %s", portStr)
+	}
+	method := ""
+	if info := requestInfoFrom(ctx); info != nil {
+		method = info.method
+	}
+
+	ips, ttl, err := p.lookupIPTTL(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if p.policy == nil {
+		return ips, ttl, nil
+	}
+	var allowed []net.IP
+	var denied error
+	for _, ip := range ips {
+		if err := p.policy.check(accessTarget{host: host, ip: ip, port: port, method: method}); err != nil {
+			denied = err
+			continue
+		}
+		allowed = append(allowed, ip)
+	}
+	if len(allowed) == 0 {
+		return nil, 0, denied
+	}
+	return allowed, ttl, nil
+}
+
+// dialContext 所有出站连接的拨号入口，http.Transport和CONNECT隧道共用
+func (p *ForwardProxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if info := requestInfoFrom(ctx); info != nil && info.viaParent.dialing(addr) {
+		// 目标已在proxyForRequest中检查过，这里连接的是上级代理本身
+		conn, err := p.dialParent(ctx, info.viaParent)
+		if err != nil {
+			p.metrics.observeDialError(err)
+		}
+		return conn, err
+	}
+	var ips []net.IP
+	if p.policy != nil {
+		if target, ok := ctx.Value(resolvedTargetKey).(*resolvedTarget); ok && target.addr == addr {
+			ips = target.ips
+		} else {
+			// 重定向等未预先检查的地址在这里检查
+			var err error
+			if ips, err = p.resolveTarget(ctx, addr); err != nil {
+				p.metrics.observeDialError(err)
+				return nil, err
+			}
+		}
+	}
+	conn, err := p.dialRoute(ctx, network, addr, ips)
+	if err != nil {
+		p.metrics.observeDialError(err)
+	}
+	return conn, err
+}
+
+// canonicalAddr 返回URL对应的 host:port，缺省端口按协议补全
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// writeDialError 根据出站错误类型返回403或502，证书问题单独说明
+func writeDialError(w http.ResponseWriter, r *http.Request, err error) {
+	var denied *AccessDeniedError
+	if errors.As(err, &denied) {
+		logf(r.Context(), "%v", denied)
+		http.Error(w, denied.Error(), http.StatusForbidden)
+		return
+	}
+	var tlsErr *upstreamTLSError
+	if errors.As(err, &tlsErr) {
+		writeTLSError(w, r, tlsErr)
+		return
+	}
+	logf(r.Context(), "请求失败: %v", err)
+	http.Error(w, fmt.Sprintf("请求失败: %v", err), http.StatusBadGateway)
+}
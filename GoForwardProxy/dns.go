@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNS报文常量（RFC 1035、RFC 3596）
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeSOA   = 6
+	dnsTypeAAAA  = 28
+	dnsClassIN   = 1
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeNXDomain = 3
+
+	dnsHeaderLen  = 12
+	dnsMaxUDPSize = 512
+)
+
+// defaultDNSTimeout 单个DNS服务器的查询超时
+const defaultDNSTimeout = 5 * time.Second
+
+// errDNSTruncated UDP响应被截断，需要改用TCP
+var errDNSTruncated = errors.New("DNS响应被截断")
+
+// DNSClient 直接向DNS服务器查询A和AAAA记录的解析器，返回记录的TTL
+type DNSClient struct {
+	Servers []string      // DNS服务器地址 host:port，按顺序尝试
+	Timeout time.Duration // 单个服务器的查询超时，0时使用默认值
+}
+
+// NewDNSClient 创建DNS客户端，服务器地址缺少端口时使用53
+func NewDNSClient(servers []string) *DNSClient {
+	c := &DNSClient{Timeout: defaultDNSTimeout}
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		c.Servers = append(c.Servers, s)
+	}
+	return c
+}
+
+// dnsAnswer 一次查询的结果
+type dnsAnswer struct {
+	ips      []net.IP
+	ttl      time.Duration
+	notFound bool
+}
+
+// Resolve 同时查询A和AAAA记录，TTL取所有相关记录的最小值
+func (c *DNSClient) Resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if len(c.Servers) == 0 {
+		return nil, 0, errors.New("没有配置DNS服务器")
+	}
+	type result struct {
+		answer *dnsAnswer
+		err    error
+	}
+	results := make(chan result, 2)
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		go func(qtype uint16) {
+			answer, err := c.query(ctx, host, qtype)
+			results <- result{answer, err}
+		}(qtype)
+	}
+
+	// 有记录时TTL取各记录的最小值，都不存在时取否定缓存时间的最小值
+	var ips []net.IP
+	var ttl, negativeTTL time.Duration
+	var lastErr error
+	found, notFound := false, false
+	for i := 0; i < 2; i++ {
+		r := <-results
+		switch {
+		case r.err != nil:
+			lastErr = r.err
+		case r.answer.notFound:
+			if !notFound || r.answer.ttl < negativeTTL {
+				negativeTTL = r.answer.ttl
+			}
+			notFound = true
+		default:
+			if !found || r.answer.ttl < ttl {
+				ttl = r.answer.ttl
+			}
+			found = true
+			ips = append(ips, r.answer.ips...)
+		}
+	}
+	if found {
+		return ips, ttl, nil
+	}
+	if lastErr != nil {
+		return nil, 0, lastErr
+	}
+	return nil, negativeTTL, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// query 依次向各服务器查询一种记录类型
+func (c *DNSClient) query(ctx context.Context, host string, qtype uint16) (*dnsAnswer, error) {
+	msg, id, err := buildDNSQuery(host, qtype)
+	if err != nil {
+		return nil, err
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+	var lastErr error
+	for _, server := range c.Servers {
+		qctx, cancel := context.WithTimeout(ctx, timeout)
+		answer, err := exchangeDNS(qctx, "udp", server, msg, id)
+		if errors.Is(err, errDNSTruncated) {
+			answer, err = exchangeDNS(qctx, "tcp", server, msg, id)
+		}
+		cancel()
+		if err == nil {
+			return answer, nil
+		}
+		lastErr = &net.DNSError{Err: err.Error(), Name: host, Server: server, IsTimeout: errors.Is(err, context.DeadlineExceeded)}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// exchangeDNS 通过UDP或TCP发送查询并解析响应
+func exchangeDNS(ctx context.Context, network, server string, msg []byte, id uint16) (*dnsAnswer, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		// TCP报文前带两字节长度（RFC 1035 4.2.2）
+		framed := make([]byte, 2+len(msg))
+		binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+		copy(framed[2:], msg)
+		if _, err := conn.Write(framed); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+		return parseDNSResponse(resp, id)
+	}
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		answer, err := parseDNSResponse(buf[:n], id)
+		if errors.Is(err, errDNSMismatch) {
+			// 忽略不匹配的响应，防止伪造
+			continue
+		}
+		return answer, err
+	}
+}
+
+// buildDNSQuery 构造开启递归的查询报文
+func buildDNSQuery(host string, qtype uint16) ([]byte, uint16, error) {
+	var idBuf [2]byte
+	if _, err := rand.Read(idBuf[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBuf[:])
+
+	msg := make([]byte, dnsHeaderLen, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)      // QDCOUNT
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("无效的主机名: %s", host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	return msg, id, nil
+}
+
+// errDNSMismatch 响应ID与查询不一致
+var errDNSMismatch = errors.New("DNS响应ID不匹配")
+
+// errDNSMalformed 响应格式错误
+var errDNSMalformed = errors.New("DNS响应格式错误")
+
+// parseDNSResponse 解析响应中的A、AAAA记录和TTL，域名不存在时使用SOA计算否定缓存时间（RFC 2308）
+func parseDNSResponse(msg []byte, id uint16) (*dnsAnswer, error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, errDNSMalformed
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != id || msg[2]&0x80 == 0 {
+		return nil, errDNSMismatch
+	}
+	if msg[2]&0x02 != 0 {
+		return nil, errDNSTruncated
+	}
+	rcode := msg[3] & 0x0f
+	if rcode != dnsRcodeSuccess && rcode != dnsRcodeNXDomain {
+		return nil, fmt.Errorf("DNS服务器返回错误码%d", rcode)
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:]))
+
+	off := dnsHeaderLen
+	for i := 0; i < qdcount; i++ {
+		var err error
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+
+	answer := &dnsAnswer{}
+	var minTTL uint32
+	first := true
+	for i := 0; i < ancount+nscount; i++ {
+		var err error
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, errDNSMalformed
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, errDNSMalformed
+		}
+		rdata := msg[off : off+rdlen]
+		off += rdlen
+
+		if i >= ancount {
+			// 权威部分只关心SOA，取SOA的TTL和MINIMUM中较小的一个
+			if rtype == dnsTypeSOA && rdlen >= 4 {
+				if minimum := binary.BigEndian.Uint32(rdata[rdlen-4:]); minimum < ttl {
+					ttl = minimum
+				}
+			} else {
+				continue
+			}
+		} else {
+			switch rtype {
+			case dnsTypeA:
+				if rdlen != net.IPv4len {
+					return nil, errDNSMalformed
+				}
+				answer.ips = append(answer.ips, net.IP(append([]byte(nil), rdata...)))
+			case dnsTypeAAAA:
+				if rdlen != net.IPv6len {
+					return nil, errDNSMalformed
+				}
+				answer.ips = append(answer.ips, net.IP(append([]byte(nil), rdata...)))
+			case dnsTypeCNAME:
+			default:
+				continue
+			}
+		}
+		if first || ttl < minTTL {
+			minTTL = ttl
+			first = false
+		}
+	}
+	answer.notFound = rcode == dnsRcodeNXDomain || len(answer.ips) == 0
+	answer.ttl = time.Duration(minTTL) * time.Second
+	return answer, nil
+}
+
+// skipDNSName 跳过报文中的域名，支持压缩指针
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSMalformed
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			if off+2 > len(msg) {
+				return 0, errDNSMalformed
+			}
+			return off + 2, nil
+		default:
+			off += 1 + l
+		}
+	}
+}
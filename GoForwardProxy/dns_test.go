@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeDNSReply 根据查询构造响应：
+// a.test 有A记录(TTL 300)，missing.test 不存在(SOA MINIMUM 30)，big.test 的UDP响应被截断
+func fakeDNSReply(query []byte, tcp bool) []byte {
+	end := dnsHeaderLen
+	for query[end] != 0 {
+		end += 1 + int(query[end])
+	}
+	end += 5
+	var name string
+	for off := dnsHeaderLen; query[off] != 0; off += 1 + int(query[off]) {
+		if name != "" {
+			name += "."
+		}
+		name += string(query[off+1 : off+1+int(query[off])])
+	}
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+
+	resp := append([]byte(nil), query[:end]...)
+	resp[2], resp[3] = 0x81, 0x80
+	var ancount, nscount uint16
+	switch {
+	case name == "missing.test":
+		resp[3] |= dnsRcodeNXDomain
+		nscount = 1
+		resp = append(resp, 0xc0, 0x0c, 0, dnsTypeSOA, 0, dnsClassIN, 0, 0, 0x02, 0x58, 0, 22, 0, 0)
+		resp = append(resp, make([]byte, 16)...)
+		resp = binary.BigEndian.AppendUint32(resp, 30)
+	case name == "big.test" && !tcp:
+		resp[2] |= 0x02
+	case qtype == dnsTypeA:
+		ancount = 1
+		resp = append(resp, 0xc0, 0x0c, 0, dnsTypeA, 0, dnsClassIN)
+		resp = binary.BigEndian.AppendUint32(resp, 300)
+		resp = append(resp, 0, 4, 10, 0, 0, 1)
+	}
+	binary.BigEndian.PutUint16(resp[6:], ancount)
+	binary.BigEndian.PutUint16(resp[8:], nscount)
+	return resp
+}
+
+// startFakeDNS 在同一端口上启动UDP和TCP的DNS服务器
+func startFakeDNS(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听UDP失败: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Skipf("无法在同一端口监听TCP: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(fakeDNSReply(buf[:n], false), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := fakeDNSReply(query, true)
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+			}()
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// TestDNSClient 测试DNS查询、TTL、否定缓存时间和截断后改用TCP
+func TestDNSClient(t *testing.T) {
+	client := NewDNSClient([]string{startFakeDNS(t)})
+	client.Timeout = 2 * time.Second
+
+	tests := []struct {
+		host         string
+		wantIP       string
+		wantTTL      time.Duration
+		wantNotFound bool
+	}{
+		{"a.test", "10.0.0.1", 300 * time.Second, false},
+		{"big.test", "10.0.0.1", 300 * time.Second, false},
+		{"missing.test", "", 30 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			ips, ttl, err := client.Resolve(context.Background(), tt.host)
+			if tt.wantNotFound {
+				var dnsErr *net.DNSError
+				if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+					t.Fatalf("期望域名不存在, 实际 %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			} else if len(ips) != 1 || ips[0].String() != tt.wantIP {
+				t.Errorf("IP不匹配: %v", ips)
+			}
+			if ttl != tt.wantTTL {
+				t.Errorf("TTL不匹配, 期望 %s, 实际 %s", tt.wantTTL, ttl)
+			}
+		})
+	}
+}
+
+// TestNewDNSClientDefaultPort 测试服务器地址缺省端口
+func TestNewDNSClientDefaultPort(t *testing.T) {
+	client := NewDNSClient([]string{"192.0.2.1", "192.0.2.2:5353", "2001:db8::1"})
+	want := []string{"192.0.2.1:53", "192.0.2.2:5353", net.JoinHostPort("2001:db8::1", strconv.Itoa(53))}
+	for i, s := range client.Servers {
+		if s != want[i] {
+			t.Errorf("服务器地址不匹配, 期望 %s, 实际 %s", want[i], s)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errFaultTruncated 故障注入规则要求在此处截断数据
+var errFaultTruncated = errors.New("故障注入截断")
+
+// FaultRule 故障注入规则，匹配的请求按Percent的比例注入故障，用于在集成测试中模拟不稳定的网络。
+// CONNECT和WebSocket等隧道同样适用，Path不为空的规则不匹配CONNECT请求
+type FaultRule struct {
+	ID      string  `json:"id"`                // 规则ID，为空时自动生成，添加同ID的规则会替换原规则
+	Host    string  `json:"host,omitempty"`    // 主机模式，支持*.example.com，为空匹配所有主机
+	Path    string  `json:"path,omitempty"`    // 路径前缀，为空匹配所有路径
+	Method  string  `json:"method,omitempty"`  // 请求方法，为空匹配所有方法
+	Percent float64 `json:"percent,omitempty"` // 注入比例（0-100），0表示全部注入
+
+	LatencyMS int   `json:"latency_ms,omitempty"` // 转发前的额外延迟，单位毫秒
+	Bandwidth int64 `json:"bandwidth,omitempty"`  // 响应数据的带宽上限，单位字节/秒
+	Reset     bool  `json:"reset,omitempty"`      // 直接重置客户端连接
+	Truncate  int64 `json:"truncate,omitempty"`   // 响应数据超过该字节数时截断并中断连接
+	Status    int   `json:"status,omitempty"`     // 不转发请求，直接返回该状态码
+
+	Hits int64 `json:"hits"` // 已注入的次数，添加规则时忽略
+}
+
+// validate 检查规则是否有效
+func (f *FaultRule) validate() error {
+	if f.Percent < 0 || f.Percent > 100 {
+		return fmt.Errorf("注入比例应在0到100之间: %v", f.Percent)
+	}
+	if f.LatencyMS < 0 || f.Bandwidth < 0 || f.Truncate < 0 {
+		return errors.New("延迟、带宽和截断长度不能为负数")
+	}
+	if f.Status != 0 && (f.Status < 200 || f.Status > 599) {
+		return fmt.Errorf("无效的状态码: %d", f.Status)
+	}
+	if f.Reset && f.Status != 0 {
+		return errors.New("reset和status不能同时使用")
+	}
+	if f.LatencyMS == 0 && f.Bandwidth == 0 && !f.Reset && f.Truncate == 0 && f.Status == 0 {
+		return errors.New("规则没有指定任何故障")
+	}
+	return nil
+}
+
+// matches 判断请求是否匹配规则的主机、路径和方法
+func (f *FaultRule) matches(r *http.Request) bool {
+	if f.Method != "" && !strings.EqualFold(f.Method, r.Method) {
+		return false
+	}
+	if f.Host != "" && !matchDomain(f.Host, hostOnly(r.URL.Host)) {
+		return false
+	}
+	if f.Path != "" && (r.Method == http.MethodConnect || !strings.HasPrefix(r.URL.Path, f.Path)) {
+		return false
+	}
+	return true
+}
+
+// String 返回规则注入的故障，用于日志
+func (f *FaultRule) String() string {
+	var parts []string
+	if f.LatencyMS > 0 {
+		parts = append(parts, fmt.Sprintf("延迟%dms", f.LatencyMS))
+	}
+	if f.Bandwidth > 0 {
+		parts = append(parts, fmt.Sprintf("带宽%d字节/秒", f.Bandwidth))
+	}
+	if f.Reset {
+		parts = append(parts, "重置连接")
+	}
+	if f.Truncate > 0 {
+		parts = append(parts, fmt.Sprintf("%d字节后截断", f.Truncate))
+	}
+	if f.Status != 0 {
+		parts = append(parts, fmt.Sprintf("返回%d", f.Status))
+	}
+	return strings.Join(parts, "，")
+}
+
+// faultEntry 注册表中的规则及其命中次数
+type faultEntry struct {
+	rule FaultRule
+	hits int64
+}
+
+// FaultInjector 故障注入规则表，按添加顺序匹配，可在运行时通过管理接口修改
+type FaultInjector struct {
+	mu     sync.Mutex
+	rules  []*faultEntry
+	nextID int
+
+	roll func() float64 // 返回[0,100)的随机数，测试时可替换
+}
+
+// NewFaultInjector 创建空的故障注入规则表
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{roll: func() float64 { return rand.Float64() * 100 }}
+}
+
+// Add 添加规则，ID为空时自动生成，已有同ID的规则时原位替换
+func (fi *FaultInjector) Add(rule FaultRule) (FaultRule, error) {
+	if err := rule.validate(); err != nil {
+		return rule, err
+	}
+	rule.Hits = 0
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if rule.ID == "" {
+		fi.nextID++
+		rule.ID = strconv.Itoa(fi.nextID)
+	}
+	for i, e := range fi.rules {
+		if e.rule.ID == rule.ID {
+			fi.rules[i] = &faultEntry{rule: rule}
+			return rule, nil
+		}
+	}
+	fi.rules = append(fi.rules, &faultEntry{rule: rule})
+	return rule, nil
+}
+
+// Remove 删除规则，规则不存在时返回false
+func (fi *FaultInjector) Remove(id string) bool {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	for i, e := range fi.rules {
+		if e.rule.ID == id {
+			fi.rules = append(fi.rules[:i], fi.rules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Clear 删除所有规则
+func (fi *FaultInjector) Clear() {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.rules = nil
+}
+
+// Get 返回单个规则
+func (fi *FaultInjector) Get(id string) (FaultRule, bool) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	for _, e := range fi.rules {
+		if e.rule.ID == id {
+			return e.snapshot(), true
+		}
+	}
+	return FaultRule{}, false
+}
+
+// List 按匹配顺序返回所有规则
+func (fi *FaultInjector) List() []FaultRule {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	rules := make([]FaultRule, 0, len(fi.rules))
+	for _, e := range fi.rules {
+		rules = append(rules, e.snapshot())
+	}
+	return rules
+}
+
+func (e *faultEntry) snapshot() FaultRule {
+	rule := e.rule
+	rule.Hits = atomic.LoadInt64(&e.hits)
+	return rule
+}
+
+// match 返回第一个匹配且按比例命中的规则，没有时返回nil
+func (fi *FaultInjector) match(r *http.Request) *FaultRule {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	for _, e := range fi.rules {
+		if !e.rule.matches(r) {
+			continue
+		}
+		if e.rule.Percent > 0 && e.rule.Percent < 100 && fi.roll() >= e.rule.Percent {
+			continue
+		}
+		atomic.AddInt64(&e.hits, 1)
+		rule := e.rule
+		return &rule
+	}
+	return nil
+}
+
+// injectFault 对匹配故障规则的请求注入延迟、连接重置或合成状态码，返回true表示请求已处理完毕。
+// 带宽和截断故障记录在请求上下文中，在转发响应数据时生效
+func (p *ForwardProxy) injectFault(w http.ResponseWriter, r *http.Request) bool {
+	f := p.faults.match(r)
+	if f == nil {
+		return false
+	}
+	logf(r.Context(), "注入故障(规则%s): %s %s，%s", f.ID, r.Method, r.URL, f)
+
+	if f.LatencyMS > 0 {
+		timer := time.NewTimer(time.Duration(f.LatencyMS) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return true
+		}
+	}
+	if f.Reset {
+		resetClient(w)
+		return true
+	}
+	if f.Status != 0 {
+		w.Header().Set("X-Fault-Injected", f.ID)
+		http.Error(w, fmt.Sprintf("故障注入: 规则%s", f.ID), f.Status)
+		return true
+	}
+	if f.Bandwidth > 0 || f.Truncate > 0 {
+		if info := requestInfoFrom(r.Context()); info != nil {
+			info.fault = f
+		}
+	}
+	return false
+}
+
+// resetClient 劫持并以RST关闭客户端连接，不支持劫持时中断处理器
+func resetClient(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	resetConn(conn)
+}
+
+// resetConn 关闭连接并尽量让对端收到RST而不是正常的FIN
+func resetConn(conn net.Conn) {
+	raw := conn
+	for {
+		switch c := raw.(type) {
+		case *tls.Conn:
+			raw = c.NetConn()
+			continue
+		case *bufferedConn:
+			raw = c.Conn
+			continue
+		case *net.TCPConn:
+			c.SetLinger(0)
+		}
+		break
+	}
+	conn.Close()
+}
+
+// faultShaper 按故障规则限制响应数据的带宽和总长度
+type faultShaper struct {
+	bandwidth int64
+	truncate  int64
+	done      <-chan struct{}
+	start     time.Time
+	sent      int64
+}
+
+func newFaultShaper(f *FaultRule, done <-chan struct{}) *faultShaper {
+	return &faultShaper{bandwidth: f.Bandwidth, truncate: f.Truncate, done: done, start: time.Now()}
+}
+
+// next 返回下一次最多可以传输的字节数，已达到截断长度时返回errFaultTruncated
+func (s *faultShaper) next(n int) (int, error) {
+	if s.truncate > 0 {
+		left := s.truncate - s.sent
+		if left <= 0 {
+			return 0, errFaultTruncated
+		}
+		if int64(n) > left {
+			n = int(left)
+		}
+	}
+	if s.bandwidth > 0 {
+		// 每次最多传输十分之一秒的数据，使速率平稳
+		chunk := s.bandwidth / 10
+		if chunk < 1 {
+			chunk = 1
+		}
+		if int64(n) > chunk {
+			n = int(chunk)
+		}
+	}
+	return n, nil
+}
+
+// advance 记录已传输n字节，并等待到带宽上限允许的时间，done关闭时提前返回
+func (s *faultShaper) advance(n int) error {
+	s.sent += int64(n)
+	if s.bandwidth <= 0 {
+		return nil
+	}
+	due := s.start.Add(time.Duration(float64(s.sent) / float64(s.bandwidth) * float64(time.Second)))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-s.done:
+		return io.ErrClosedPipe
+	}
+}
+
+// faultChunk 返回上下文中带宽故障每次传输的字节数，没有带宽故障时返回0
+func faultChunk(ctx context.Context) int {
+	info := requestInfoFrom(ctx)
+	if info == nil || info.fault == nil || info.fault.Bandwidth <= 0 {
+		return 0
+	}
+	n, _ := (&faultShaper{bandwidth: info.fault.Bandwidth}).next(1 << 30)
+	return n
+}
+
+// shapedWriter 按故障规则限速和截断写入的响应数据
+type shapedWriter struct {
+	w      io.Writer
+	shaper *faultShaper
+}
+
+// faultWriter 返回受上下文中故障规则约束的Writer，没有带宽或截断故障时直接返回w
+func faultWriter(ctx context.Context, w io.Writer) io.Writer {
+	info := requestInfoFrom(ctx)
+	if info == nil || info.fault == nil {
+		return w
+	}
+	return &shapedWriter{w: w, shaper: newFaultShaper(info.fault, ctx.Done())}
+}
+
+func (f *shapedWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n, err := f.shaper.next(len(b))
+		if err != nil {
+			return written, err
+		}
+		m, err := f.w.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		if err := f.shaper.advance(m); err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// faultConn 隧道目标一端的连接，按故障规则限速和截断从目标读取的数据
+type faultConn struct {
+	net.Conn
+	shaper *faultShaper
+}
+
+func (c *faultConn) Read(b []byte) (int, error) {
+	n, err := c.shaper.next(len(b))
+	if err != nil {
+		return 0, err
+	}
+	m, err := c.Conn.Read(b[:n])
+	if m > 0 {
+		if werr := c.shaper.advance(m); werr != nil {
+			return m, werr
+		}
+	}
+	return m, err
+}
+
+// CloseWrite 半关闭底层连接
+func (c *faultConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// handleFaultList 列出、添加或清空故障注入规则
+func (p *ForwardProxy) handleFaultList(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, p.faults.List())
+	case http.MethodPost:
+		var rule FaultRule
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&rule); err != nil {
+			http.Error(w, fmt.Sprintf("无效的规则: %v", err), http.StatusBadRequest)
+			return
+		}
+		rule, err := p.faults.Add(rule)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("无效的规则: %v", err), http.StatusBadRequest)
+			return
+		}
+		logf(r.Context(), "管理接口添加了故障规则%s: %s", rule.ID, &rule)
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, rule)
+	case http.MethodDelete:
+		p.faults.Clear()
+		logf(r.Context(), "管理接口清空了故障规则")
+		fmt.Fprintln(w, "已清空故障规则")
+	default:
+		http.Error(w, "只允许GET、POST和DELETE方法", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleFault 查看或删除单个故障注入规则
+func (p *ForwardProxy) handleFault(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/faults/")
+	switch r.Method {
+	case http.MethodGet:
+		rule, ok := p.faults.Get(id)
+		if !ok {
+			http.Error(w, "故障规则不存在", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, rule)
+	case http.MethodDelete:
+		if !p.faults.Remove(id) {
+			http.Error(w, "故障规则不存在", http.StatusNotFound)
+			return
+		}
+		logf(r.Context(), "管理接口删除了故障规则%s", id)
+		fmt.Fprintf(w, "已删除故障规则%s\n", id)
+	default:
+		http.Error(w, "只允许GET和DELETE方法", http.StatusMethodNotAllowed)
+	}
+}
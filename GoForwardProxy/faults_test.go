@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFaultInjection 测试各类故障对经过代理的HTTP请求的效果
+func TestFaultInjection(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	backendHits := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendHits++
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		io.WriteString(w, body)
+	}))
+	defer backend.Close()
+
+	proxy := NewForwardProxy()
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyURL, _ := url.Parse(proxyServer.URL)
+
+	tests := []struct {
+		name       string
+		rule       FaultRule
+		path       string
+		wantStatus int
+		wantErr    bool
+		wantBody   int
+		minElapsed time.Duration
+		wantHits   int
+	}{
+		{"不匹配的路径", FaultRule{Path: "/api", Status: 503}, "/static", 200, false, 1000, 0, 1},
+		{"合成状态码", FaultRule{Path: "/api", Status: 503}, "/api/users", 503, false, -1, 0, 0},
+		{"延迟", FaultRule{LatencyMS: 200}, "/", 200, false, 1000, 200 * time.Millisecond, 1},
+		{"带宽上限", FaultRule{Bandwidth: 2000}, "/", 200, false, 1000, 400 * time.Millisecond, 1},
+		{"连接重置", FaultRule{Reset: true}, "/", 0, true, 0, 0, 0},
+		{"截断响应体", FaultRule{Truncate: 100}, "/", 200, true, 100, 0, 1},
+		{"不匹配的方法", FaultRule{Method: "POST", Reset: true}, "/", 200, false, 1000, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy.faults.Clear()
+			if _, err := proxy.faults.Add(tt.rule); err != nil {
+				t.Fatalf("添加规则失败: %v", err)
+			}
+			backendHits = 0
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}}
+
+			start := time.Now()
+			resp, err := client.Get(backend.URL + tt.path)
+			if err != nil {
+				if !tt.wantErr {
+					t.Fatalf("请求失败: %v", err)
+				}
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("状态码期望 %d, 实际 %d", tt.wantStatus, resp.StatusCode)
+			}
+			data, err := io.ReadAll(resp.Body)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("读取响应体的错误不符合预期: %v", err)
+			}
+			if tt.wantBody >= 0 && len(data) != tt.wantBody {
+				t.Errorf("响应体长度期望 %d, 实际 %d", tt.wantBody, len(data))
+			}
+			if elapsed := time.Since(start); elapsed < tt.minElapsed {
+				t.Errorf("耗时期望至少 %s, 实际 %s", tt.minElapsed, elapsed)
+			}
+			if backendHits != tt.wantHits {
+				t.Errorf("后端请求次数期望 %d, 实际 %d", tt.wantHits, backendHits)
+			}
+			if tt.wantStatus == 503 && resp.Header.Get("X-Fault-Injected") == "" {
+				t.Error("合成响应缺少X-Fault-Injected头")
+			}
+		})
+	}
+}
+
+// TestFaultPercent 测试按比例注入故障
+func TestFaultPercent(t *testing.T) {
+	fi := NewFaultInjector()
+	rolls := []float64{10, 90, 49.9, 50}
+	fi.roll = func() float64 {
+		v := rolls[0]
+		rolls = rolls[1:]
+		return v
+	}
+	fi.Add(FaultRule{ID: "half", Host: "*.example.com", Percent: 50, Status: 500})
+	r := httptest.NewRequest(http.MethodGet, "http://api.example.com/", nil)
+
+	var hits []bool
+	for i := 0; i < 4; i++ {
+		hits = append(hits, fi.match(r) != nil)
+	}
+	if fmt.Sprint(hits) != "[true false true false]" {
+		t.Errorf("按比例注入不正确: %v", hits)
+	}
+	if rule, _ := fi.Get("half"); rule.Hits != 2 {
+		t.Errorf("命中次数期望 2, 实际 %d", rule.Hits)
+	}
+	if fi.match(httptest.NewRequest(http.MethodGet, "http://other.org/", nil)) != nil {
+		t.Error("不匹配的主机不应注入故障")
+	}
+}
+
+// TestFaultTunnel 测试CONNECT隧道中的截断故障
+func TestFaultTunnel(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	proxy := NewForwardProxy()
+	proxy.faults.Add(FaultRule{Method: http.MethodConnect, Truncate: 5})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	conn, br := dialConnect(t, strings.TrimPrefix(proxyServer.URL, "http://"), echoAddr)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "hello world")
+	data, _ := io.ReadAll(br)
+	if string(data) != "hello" {
+		t.Errorf("隧道数据应在5字节后截断, 实际 %q", data)
+	}
+}
+
+// TestFaultMITM 测试拦截模式下故障规则只在解密后的请求上生效一次
+func TestFaultMITM(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatalf("生成CA失败: %v", err)
+	}
+	proxy := NewForwardProxy()
+	proxy.EnableMITM(ca, nil)
+	upstreamPool := x509.NewCertPool()
+	upstreamPool.AddCert(backend.Certificate())
+	proxy.SetTLSPolicy(&TLSPolicy{RootCAs: upstreamPool})
+	client := newProxyTestClient(t, proxy)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate())
+	client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: pool}
+
+	rule, _ := proxy.faults.Add(FaultRule{Host: "127.0.0.1", Status: http.StatusServiceUnavailable})
+	resp, err := client.Get(backend.URL + "/api")
+	if err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("X-Fault-Injected") != rule.ID {
+		t.Errorf("HTTPS请求应返回合成状态码, 实际 %d", resp.StatusCode)
+	}
+	if got, _ := proxy.faults.Get(rule.ID); got.Hits != 1 {
+		t.Errorf("命中次数期望 1, 实际 %d", got.Hits)
+	}
+}
+
+// TestAdminFaults 测试通过管理接口管理故障规则
+func TestAdminFaults(t *testing.T) {
+	proxy := NewForwardProxy()
+	admin := httptest.NewServer(proxy.AdminHandler())
+	defer admin.Close()
+
+	do := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, admin.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("请求管理接口失败: %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"添加规则", "POST", "/faults", `{"id":"slow","host":"*.example.com","latency_ms":100}`, 201},
+		{"自动生成ID", "POST", "/faults", `{"status":502}`, 201},
+		{"无效的规则", "POST", "/faults", `{"percent":150,"status":500}`, 400},
+		{"没有故障", "POST", "/faults", `{"host":"example.com"}`, 400},
+		{"未知字段", "POST", "/faults", `{"delay":100}`, 400},
+		{"查看规则", "GET", "/faults/slow", "", 200},
+		{"删除规则", "DELETE", "/faults/slow", "", 200},
+		{"规则已删除", "GET", "/faults/slow", "", 404},
+		{"不允许的方法", "PUT", "/faults", "", 405},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := do(tt.method, tt.path, tt.body); status != tt.wantStatus {
+				t.Errorf("状态码期望 %d, 实际 %d: %s", tt.wantStatus, status, body)
+			}
+		})
+	}
+
+	_, body := do("GET", "/faults", "")
+	var rules []FaultRule
+	if err := json.Unmarshal([]byte(body), &rules); err != nil {
+		t.Fatalf("解析规则列表失败: %v", err)
+	}
+	if len(rules) != 1 || rules[0].ID != "1" || rules[0].Status != 502 {
+		t.Errorf("规则列表不正确: %+v", rules)
+	}
+	do("DELETE", "/faults", "")
+	if len(proxy.faults.List()) != 0 {
+		t.Error("清空后仍有规则")
+	}
+}
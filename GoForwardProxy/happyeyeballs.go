@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// defaultFallbackDelay 上一个连接尝试还没有结果时开始尝试下一个地址的等待时间，
+// 即RFC 8305中建议的Connection Attempt Delay
+const defaultFallbackDelay = 250 * time.Millisecond
+
+// SetSourceAddrs 设置出站连接默认绑定的本地地址，路由规则中的source优先。
+// 每个地址族使用第一个同族地址，没有同族地址时由系统选择
+func (p *ForwardProxy) SetSourceAddrs(addrs []net.IP) {
+	p.sourceAddrs = addrs
+}
+
+// SetFallbackDelay 设置happy eyeballs中开始尝试下一个地址的等待时间，0表示逐个地址依次尝试
+func (p *ForwardProxy) SetFallbackDelay(delay time.Duration) {
+	p.fallbackDelay = delay
+}
+
+// ParseSourceAddrs 解析本地地址列表
+func ParseSourceAddrs(addrs []string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("无效的本地地址: %q", addr)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// ipFamily 返回地址族的名称
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// sourceFor 返回与目标ip同族的本地地址，没有时返回nil
+func sourceFor(sources []net.IP, ip net.IP) net.IP {
+	for _, src := range sources {
+		if (src.To4() != nil) == (ip.To4() != nil) {
+			return src
+		}
+	}
+	return nil
+}
+
+// interleaveFamilies 按RFC 8305交替排列两个地址族的地址，第一个地址所在的地址族优先，
+// 同一地址族内保持解析结果的顺序
+func interleaveFamilies(ips []net.IP) []net.IP {
+	if len(ips) < 2 {
+		return ips
+	}
+	var first, second []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (ips[0].To4() != nil) {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// dialAddrs 连接ips中的地址（RFC 8305 happy eyeballs）：按地址族交替排列后依次发起连接，
+// 上一个尝试失败或超过fallbackDelay仍没有结果时开始下一个，多个尝试并行进行，
+// 第一个成功的连接胜出，其余的被取消。每个连接绑定sources中与目标同族的本地地址
+func (p *ForwardProxy) dialAddrs(ctx context.Context, network string, ips []net.IP, port string, sources []net.IP) (net.Conn, error) {
+	ips = interleaveFamilies(ips)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		ip   net.IP
+		conn net.Conn
+		err  error
+	}
+	// 带缓冲，胜出后仍在进行的尝试不会阻塞
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := p.dialSource(ctx, network, ip, port, sources)
+			results <- result{ip, conn, err}
+		}()
+	}
+
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	if p.fallbackDelay > 0 && len(ips) > 1 {
+		timer = time.NewTimer(p.fallbackDelay)
+		defer timer.Stop()
+	}
+	// restartTimer 开始一个新的尝试后重新计时
+	restartTimer := func() {
+		if timer == nil {
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(p.fallbackDelay)
+		timeout = timer.C
+	}
+
+	start()
+	if timer != nil {
+		timeout = timer.C
+	}
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-timeout:
+			timeout = nil
+			if next < len(ips) {
+				start()
+				restartTimer()
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				logf(ctx, "已连接%s（%s，本地地址%s）", res.conn.RemoteAddr(), ipFamily(res.ip), res.conn.LocalAddr())
+				// 关闭其余尝试随后建立的连接
+				cancel()
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			lastErr = res.err
+			if next < len(ips) && ctx.Err() == nil {
+				logf(ctx, "连接%s失败（%s），尝试下一个地址: %v", net.JoinHostPort(res.ip.String(), port), ipFamily(res.ip), res.err)
+				start()
+				restartTimer()
+			}
+		}
+	}
+	return nil, lastErr
+}
+
+// dialSource 连接单个地址，绑定与目标同族的本地地址
+func (p *ForwardProxy) dialSource(ctx context.Context, network string, ip net.IP, port string, sources []net.IP) (net.Conn, error) {
+	dialer := *p.dialer
+	if src := sourceFor(sources, ip); src != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: src}
+	}
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestInterleaveFamilies 测试按地址族交替排列地址
+func TestInterleaveFamilies(t *testing.T) {
+	tests := []struct {
+		ips  string
+		want string
+	}{
+		{"2001:db8::1,2001:db8::2,192.0.2.1,192.0.2.2", "2001:db8::1,192.0.2.1,2001:db8::2,192.0.2.2"},
+		{"192.0.2.1,2001:db8::1,2001:db8::2", "192.0.2.1,2001:db8::1,2001:db8::2"},
+		{"192.0.2.1,192.0.2.2", "192.0.2.1,192.0.2.2"},
+		{"2001:db8::1", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		ips, _ := ParseSourceAddrs(strings.Split(tt.ips, ","))
+		var got []string
+		for _, ip := range interleaveFamilies(ips) {
+			got = append(got, ip.String())
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("interleaveFamilies(%s) = %s, 期望 %s", tt.ips, strings.Join(got, ","), tt.want)
+		}
+	}
+}
+
+// TestSourceFor 测试按目标地址族选择本地地址
+func TestSourceFor(t *testing.T) {
+	sources, _ := ParseSourceAddrs([]string{"2001:db8::10", "192.0.2.10", "192.0.2.11"})
+	if src := sourceFor(sources, net.ParseIP("198.51.100.1")); !src.Equal(net.ParseIP("192.0.2.10")) {
+		t.Errorf("IPv4目标应使用第一个IPv4本地地址, 实际 %v", src)
+	}
+	if src := sourceFor(sources, net.ParseIP("2001:db8::1")); !src.Equal(net.ParseIP("2001:db8::10")) {
+		t.Errorf("IPv6目标应使用IPv6本地地址, 实际 %v", src)
+	}
+	if src := sourceFor(sources[1:], net.ParseIP("2001:db8::1")); src != nil {
+		t.Errorf("没有同族的本地地址时应由系统选择, 实际 %v", src)
+	}
+}
+
+// slowDialer 连接slow地址时一直等待到被取消，cancelled记录被取消的尝试
+func slowDialer(slow string, cancelled chan<- string) *net.Dialer {
+	return &net.Dialer{
+		Timeout: 5 * time.Second,
+		ControlContext: func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			if !strings.HasPrefix(address, slow+":") {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				cancelled <- address
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+				return fmt.Errorf("连接%s超时", address)
+			}
+		},
+	}
+}
+
+// TestHappyEyeballs 测试上一个地址没有响应或连接失败时尝试下一个地址，胜出后取消其余尝试
+func TestHappyEyeballs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	// 127.0.0.3上的端口没有监听，连接立即被拒绝
+	refused, _ := net.Listen("tcp", "127.0.0.3:0")
+	_, refusedPort, _ := net.SplitHostPort(refused.Addr().String())
+	refused.Close()
+
+	tests := []struct {
+		name    string
+		ips     string
+		port    string
+		delay   time.Duration
+		maxTime time.Duration
+		wantErr bool
+	}{
+		{"没有响应时等待后并行尝试", "127.0.0.2,127.0.0.1", port, 50 * time.Millisecond, time.Second, false},
+		{"连接失败时立即尝试下一个", "127.0.0.3,127.0.0.1", port, time.Minute, time.Second, false},
+		{"依次尝试", "127.0.0.3,127.0.0.1", port, 0, time.Second, false},
+		{"全部失败", "127.0.0.3", refusedPort, 50 * time.Millisecond, time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cancelled := make(chan string, 1)
+			proxy := NewForwardProxy()
+			proxy.dialer = slowDialer("127.0.0.2", cancelled)
+			proxy.SetFallbackDelay(tt.delay)
+			ips, _ := ParseSourceAddrs(strings.Split(tt.ips, ","))
+			start := time.Now()
+			conn, err := proxy.dialAddrs(context.Background(), "tcp", ips, tt.port, nil)
+			if elapsed := time.Since(start); elapsed > tt.maxTime {
+				t.Errorf("连接耗时过长: %v", elapsed)
+			}
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Error("期望返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("连接失败: %v", err)
+			}
+			defer conn.Close()
+			if got := conn.RemoteAddr().String(); got != "127.0.0.1:"+port {
+				t.Errorf("应连接到可用的地址, 实际 %s", got)
+			}
+			if strings.HasPrefix(tt.ips, "127.0.0.2") {
+				select {
+				case <-cancelled:
+				case <-time.After(time.Second):
+					t.Error("胜出后没有取消其余的连接尝试")
+				}
+			}
+		})
+	}
+}
+
+// TestSourceAddr 测试按路由规则和全局设置绑定出站连接的本地地址
+func TestSourceAddr(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, hostOnly(r.RemoteAddr))
+	}))
+	defer backend.Close()
+	echoAddr := startEchoServer(t)
+
+	router, err := ParseRoutes([]byte("127.0.0.1/32 DIRECT source=2001:db8::10,127.0.0.3\n"))
+	if err != nil {
+		t.Fatalf("解析路由规则失败: %v", err)
+	}
+	tests := []struct {
+		name    string
+		router  *Router
+		sources string
+		want    string
+	}{
+		{"全局设置", nil, "127.0.0.2", "127.0.0.2"},
+		{"路由规则优先", router, "127.0.0.2", "127.0.0.3"},
+		{"没有同族地址", nil, "2001:db8::10", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := NewForwardProxy()
+			sources, _ := ParseSourceAddrs(strings.Split(tt.sources, ","))
+			proxy.SetSourceAddrs(sources)
+			if tt.router != nil {
+				proxy.SetRouter(tt.router)
+			}
+
+			resp, err := newProxyTestClient(t, proxy).Get(backend.URL)
+			if err != nil {
+				t.Fatalf("请求失败: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != tt.want {
+				t.Errorf("HTTP请求的本地地址应为 %s, 实际 %s", tt.want, body)
+			}
+
+			// CONNECT隧道使用同样的本地地址
+			conn, err := proxy.dialTunnel(context.Background(), echoAddr)
+			if err != nil {
+				t.Fatalf("连接隧道目标失败: %v", err)
+			}
+			conn.Close()
+			if got := hostOnly(conn.LocalAddr().String()); got != tt.want {
+				t.Errorf("隧道的本地地址应为 %s, 实际 %s", tt.want, got)
+			}
+		})
+	}
+}
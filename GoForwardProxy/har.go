@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 格式（http://www.softwareishard.com/blog/har-12-spec/）中用到的部分
+
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// harPostData 请求体。HAR没有为请求体定义编码字段，二进制内容使用自定义的_encoding
+type harPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []harNameValue `json:"params"`
+	Text     string         `json:"text"`
+	Encoding string         `json:"_encoding,omitempty"`
+	Comment  string         `json:"comment,omitempty"`
+}
+
+// harContent 响应体，保存上游发送的原始字节（不解压），不是UTF-8文本时使用base64
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// harTimings 各阶段耗时（毫秒），-1表示不适用
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// harTruncated 内容超过记录上限时的说明
+const harTruncated = "内容超过记录上限，已截断"
+
+// harBody 返回HAR中的文本和编码
+func harBody(b []byte) (text, encoding string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+// harDecode 还原harBody编码的内容
+func harDecode(text, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(text), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return nil, fmt.Errorf("不支持的编码 %q", encoding)
+}
+
+// harHeaders 按名称排序转换header，同名的多个值分别列出
+func harHeaders(h http.Header) []harNameValue {
+	pairs := []harNameValue{}
+	for _, name := range sortedKeys(h) {
+		for _, value := range h[name] {
+			pairs = append(pairs, harNameValue{Name: name, Value: value})
+		}
+	}
+	return pairs
+}
+
+// sortedKeys 返回按名称排序的键，http.Header和url.Values都可以使用
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// harQuery 转换URL中的查询参数
+func harQuery(u *url.URL) []harNameValue {
+	query := u.Query()
+	pairs := []harNameValue{}
+	for _, name := range sortedKeys(query) {
+		for _, value := range query[name] {
+			pairs = append(pairs, harNameValue{Name: name, Value: value})
+		}
+	}
+	return pairs
+}
+
+// capturedBody 记录经过的数据，超过limit的部分只计数
+type capturedBody struct {
+	buf   bytes.Buffer
+	size  int64
+	limit int64
+}
+
+func (c *capturedBody) capture(b []byte) {
+	c.size += int64(len(b))
+	if room := c.limit - int64(c.buf.Len()); room > 0 {
+		if int64(len(b)) > room {
+			b = b[:room]
+		}
+		c.buf.Write(b)
+	}
+}
+
+func (c *capturedBody) truncated() bool {
+	return c.size > int64(c.buf.Len())
+}
+
+// harRequestBody 读取请求体时记录内容
+type harRequestBody struct {
+	io.ReadCloser
+	body *capturedBody
+}
+
+func (b *harRequestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.body.capture(p[:n])
+	return n, err
+}
+
+// harResponseWriter 记录写回客户端的状态码、响应头和响应体
+type harResponseWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   capturedBody
+}
+
+func (w *harResponseWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *harResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.body.capture(b[:n])
+	return n, err
+}
+
+// Unwrap 供http.ResponseController使用
+func (w *harResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// harTrace 通过httptrace记录连接上游各阶段的时间
+type harTrace struct {
+	mu           sync.Mutex
+	connectStart time.Time
+	connectDone  time.Time
+	gotConn      time.Time
+	reused       bool
+	wroteRequest time.Time
+	firstByte    time.Time
+}
+
+func (t *harTrace) clientTrace() *httptrace.ClientTrace {
+	now := func(field *time.Time) {
+		t.mu.Lock()
+		*field = time.Now()
+		t.mu.Unlock()
+	}
+	return &httptrace.ClientTrace{
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			// 依次尝试多个地址时从第一次开始计算
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+			t.mu.Unlock()
+		},
+		ConnectDone: func(string, string, error) { now(&t.connectDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.gotConn, t.reused = time.Now(), info.Reused
+			t.mu.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { now(&t.wroteRequest) },
+		GotFirstResponseByte: func() { now(&t.firstByte) },
+	}
+}
+
+// timings 计算HAR的各阶段耗时。没有访问上游时（缓存命中或出错）全部计入receive
+func (t *harTrace) timings(start, end time.Time) harTimings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ms := func(from, to time.Time) float64 {
+		if d := to.Sub(from); d > 0 {
+			return float64(d) / float64(time.Millisecond)
+		}
+		return 0
+	}
+	timings := harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1}
+	if t.gotConn.IsZero() || t.firstByte.IsZero() {
+		timings.Receive = ms(start, end)
+		return timings
+	}
+	// 自定义的解析器和TLS拨号不经过httptrace，DNS和TLS握手时间计入connect
+	blocked := ms(start, t.gotConn)
+	if !t.reused && !t.connectStart.IsZero() && !t.connectDone.IsZero() {
+		timings.Connect = ms(t.connectStart, t.gotConn)
+		blocked = ms(start, t.connectStart)
+	}
+	timings.Blocked = blocked
+	sent := t.wroteRequest
+	if sent.IsZero() || sent.After(t.firstByte) {
+		sent = t.firstByte
+	}
+	timings.Send = ms(t.gotConn, sent)
+	timings.Wait = ms(sent, t.firstByte)
+	timings.Receive = ms(t.firstByte, end)
+	return timings
+}
+
+// total 返回各阶段耗时之和，ssl已经包含在connect中
+func (t harTimings) total() float64 {
+	total := t.Send + t.Wait + t.Receive
+	for _, v := range []float64{t.Blocked, t.DNS, t.Connect} {
+		if v > 0 {
+			total += v
+		}
+	}
+	return total
+}
+
+// harFile 一个正在写入的HAR文件。文件始终是完整的JSON：新记录写在结尾的"]}}"之前，再重新写上结尾
+type harFile struct {
+	f       *os.File
+	end     int64 // 结尾的偏移
+	entries int
+}
+
+// harTrailer HAR文件的结尾
+const harTrailer = "\n]}}\n"
+
+// createHARFile 创建HAR文件并写入开头
+func createHARFile(path string) (*harFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	creator, _ := json.Marshal(harCreator{Name: "GoForwardProxy", Version: harCreatorVersion()})
+	head := fmt.Sprintf(`{"log":{"version":"1.2","creator":%s,"entries":[`, creator)
+	if _, err := f.WriteString(head + harTrailer); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &harFile{f: f, end: int64(len(head))}, nil
+}
+
+// harCreatorVersion 返回构建信息中的版本，没有时为"devel"
+func harCreatorVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "devel"
+}
+
+func (h *harFile) append(e *harEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	sep := "\n"
+	if h.entries > 0 {
+		sep = ",\n"
+	}
+	chunk := sep + string(data)
+	if _, err := h.f.WriteAt([]byte(chunk+harTrailer), h.end); err != nil {
+		return err
+	}
+	h.end += int64(len(chunk))
+	h.entries++
+	return nil
+}
+
+// HARRecorder 把handleHTTP处理的请求和响应写入HAR 1.2文件，包括header、
+// 不超过上限的请求体和响应体以及各阶段耗时。每次启动为一个会话，
+// 整个会话写入一个文件，或者每个客户端IP各写一个文件
+type HARRecorder struct {
+	dir       string
+	session   string // 会话文件名前缀，为启动时间
+	perClient bool
+	maxBody   int64
+
+	mu    sync.Mutex
+	files map[string]*harFile
+}
+
+// NewHARRecorder 创建录制到dir目录的HARRecorder，maxBody为每个请求体和响应体最多记录的字节数
+func NewHARRecorder(dir string, perClient bool, maxBody int64) (*HARRecorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &HARRecorder{
+		dir:       dir,
+		session:   time.Now().Format("20060102-150405"),
+		perClient: perClient,
+		maxBody:   maxBody,
+		files:     make(map[string]*harFile),
+	}, nil
+}
+
+// path 返回客户端对应的文件路径
+func (h *HARRecorder) path(client string) string {
+	name := h.session
+	if h.perClient {
+		// IPv6地址中的冒号不能出现在Windows文件名中
+		name += "-" + strings.ReplaceAll(hostOnly(client), ":", "_")
+	}
+	return filepath.Join(h.dir, name+".har")
+}
+
+// Add 写入一条记录
+func (h *HARRecorder) Add(client string, e *harEntry) error {
+	path := h.path(client)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	file, ok := h.files[path]
+	if !ok {
+		var err error
+		if file, err = createHARFile(path); err != nil {
+			return err
+		}
+		h.files[path] = file
+	}
+	return file.append(e)
+}
+
+// Close 关闭所有文件
+func (h *HARRecorder) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var firstErr error
+	for path, file := range h.files {
+		if err := file.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(h.files, path)
+	}
+	return firstErr
+}
+
+// recordHAR 包装请求体和ResponseWriter以记录请求，返回处理结束后需要调用的函数
+func (p *ForwardProxy) recordHAR(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	start := time.Now()
+	reqBody := &capturedBody{limit: p.har.maxBody}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &harRequestBody{ReadCloser: r.Body, body: reqBody}
+	}
+	hw := &harResponseWriter{ResponseWriter: w, body: capturedBody{limit: p.har.maxBody}}
+	trace := &harTrace{}
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace.clientTrace()))
+
+	finish := func() {
+		end := time.Now()
+		e := &harEntry{
+			StartedDateTime: start,
+			Request: harRequest{
+				Method:      r.Method,
+				URL:         r.URL.String(),
+				HTTPVersion: r.Proto,
+				Cookies:     []harNameValue{},
+				Headers:     harHeaders(r.Header),
+				QueryString: harQuery(r.URL),
+				HeadersSize: -1,
+				BodySize:    reqBody.size,
+			},
+			Timings: trace.timings(start, end),
+		}
+		if reqBody.size > 0 {
+			post := &harPostData{MimeType: r.Header.Get("Content-Type"), Params: []harNameValue{}}
+			post.Text, post.Encoding = harBody(reqBody.buf.Bytes())
+			if reqBody.truncated() {
+				post.Comment = harTruncated
+			}
+			e.Request.PostData = post
+		}
+
+		header := hw.header
+		if header == nil {
+			header = http.Header{}
+		}
+		// 处理被中断、没有发出响应时状态码为0，与浏览器导出的HAR一致
+		e.Response = harResponse{
+			Status:      hw.status,
+			StatusText:  http.StatusText(hw.status),
+			HTTPVersion: r.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(header),
+			Content:     harContent{Size: hw.body.size, MimeType: header.Get("Content-Type")},
+			RedirectURL: header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    hw.body.size,
+		}
+		e.Response.Content.Text, e.Response.Content.Encoding = harBody(hw.body.buf.Bytes())
+		if hw.body.truncated() {
+			e.Response.Content.Comment = harTruncated
+		}
+		e.Time = e.Timings.total()
+		if info := requestInfoFrom(r.Context()); info != nil && info.upstream != "" && !info.parent {
+			e.ServerIPAddress = hostOnly(info.upstream)
+		}
+		if err := p.har.Add(r.RemoteAddr, e); err != nil {
+			logf(r.Context(), "写入HAR记录失败: %v", err)
+		}
+	}
+	return hw, r, finish
+}
+
+// HARReplayer 从HAR文件回放响应，不访问网络。按方法和URL匹配记录，
+// 同一请求有多条记录时按录制顺序依次返回，用完后重复最后一条
+type HARReplayer struct {
+	mu      sync.Mutex
+	entries map[string][]*harEntry
+	next    map[string]int
+}
+
+// LoadHARReplay 读取HAR文件
+func LoadHARReplay(path string) (*HARReplayer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var har harLog
+	if err := json.Unmarshal(data, &har); err != nil {
+		return nil, fmt.Errorf("解析HAR文件%s失败: %v", path, err)
+	}
+	h := &HARReplayer{entries: make(map[string][]*harEntry), next: make(map[string]int)}
+	for i := range har.Log.Entries {
+		e := &har.Log.Entries[i]
+		if _, err := harDecode(e.Response.Content.Text, e.Response.Content.Encoding); err != nil {
+			return nil, fmt.Errorf("HAR文件%s第%d条记录: %v", path, i+1, err)
+		}
+		u, err := url.Parse(e.Request.URL)
+		if err != nil || !u.IsAbs() {
+			return nil, fmt.Errorf("HAR文件%s第%d条记录: 无效的URL %q", path, i+1, e.Request.URL)
+		}
+		// 被中断的请求没有响应（状态码为0），回放时按没有记录处理
+		if e.Response.Status < 100 {
+			continue
+		}
+		key := replayKey(e.Request.Method, u)
+		h.entries[key] = append(h.entries[key], e)
+	}
+	return h, nil
+}
+
+// replayKey 返回匹配用的键，方法和URL的scheme、主机不区分大小写，默认端口与省略端口等价
+func replayKey(method string, u *url.URL) string {
+	v := *u
+	v.Scheme = strings.ToLower(v.Scheme)
+	v.Host = strings.ToLower(v.Host)
+	if port := v.Port(); (v.Scheme == "http" && port == "80") || (v.Scheme == "https" && port == "443") {
+		v.Host = v.Hostname()
+		if strings.Contains(v.Host, ":") {
+			v.Host = "[" + v.Host + "]"
+		}
+	}
+	v.Fragment, v.RawFragment = "", ""
+	return strings.ToUpper(method) + " " + v.String()
+}
+
+// Len 返回记录数
+func (h *HARReplayer) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, entries := range h.entries {
+		n += len(entries)
+	}
+	return n
+}
+
+// match 返回请求对应的记录
+func (h *HARReplayer) match(r *http.Request) (*harEntry, bool) {
+	key := replayKey(r.Method, r.URL)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := h.entries[key]
+	if len(entries) == 0 {
+		return nil, false
+	}
+	i := h.next[key]
+	if i < len(entries)-1 {
+		h.next[key] = i + 1
+	}
+	return entries[i], true
+}
+
+// serveReplay 用HAR文件中的记录响应请求，没有匹配的记录时返回502
+func (p *ForwardProxy) serveReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		io.Copy(io.Discard, r.Body)
+	}
+	e, ok := p.replay.match(r)
+	if !ok {
+		logf(r.Context(), "回放文件中没有匹配的记录: %s %s", r.Method, r.URL)
+		w.Header().Set("X-HAR-Replay", "miss")
+		http.Error(w, fmt.Sprintf("回放文件中没有 %s %s 的记录", r.Method, r.URL), http.StatusBadGateway)
+		return
+	}
+	body, _ := harDecode(e.Response.Content.Text, e.Response.Content.Encoding)
+	for _, h := range e.Response.Headers {
+		w.Header().Add(h.Name, h.Value)
+	}
+	// 记录的响应体可能被截断，按实际内容重新计算长度
+	removeHopByHopHeaders(w.Header())
+	w.Header().Del("Content-Length")
+	if r.Method != http.MethodHead && bodyAllowed(e.Response.Status) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	}
+	w.WriteHeader(e.Response.Status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// bodyAllowed 判断状态码是否允许响应体
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// readHAR 读取目录中唯一的HAR文件
+func readHAR(t *testing.T, dir string) (string, *harLog) {
+	t.Helper()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	if len(files) != 1 {
+		t.Fatalf("期望1个HAR文件, 实际 %v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("读取HAR文件失败: %v", err)
+	}
+	var har harLog
+	if err := json.Unmarshal(data, &har); err != nil {
+		t.Fatalf("HAR文件不是有效的JSON: %v\n%s", err, data)
+	}
+	return filepath.Base(files[0]), &har
+}
+
+// harHeader 返回记录中的header值
+func harHeader(pairs []harNameValue, name string) string {
+	for _, pair := range pairs {
+		if strings.EqualFold(pair.Name, name) {
+			return pair.Value
+		}
+	}
+	return ""
+}
+
+// TestHARRecord 测试录制请求和响应的header、内容和耗时
+func TestHARRecord(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/binary":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte{0xff, 0xfe, 0x00})
+		default:
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("X-Backend", "yes")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, "收到 %d 字节", len(body))
+		}
+	}))
+	defer backend.Close()
+
+	for _, per := range []string{"session", "client"} {
+		t.Run(per, func(t *testing.T) {
+			dir := t.TempDir()
+			recorder, err := NewHARRecorder(dir, per == "client", 8)
+			if err != nil {
+				t.Fatalf("创建录制失败: %v", err)
+			}
+			defer recorder.Close()
+			proxy := NewForwardProxy()
+			proxy.SetHARRecorder(recorder)
+			client := newProxyTestClient(t, proxy)
+
+			resp, err := client.Post(backend.URL+"/upload?a=1&b=2", "text/plain", strings.NewReader("0123456789abcdef"))
+			if err != nil {
+				t.Fatalf("请求失败: %v", err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+			// 每条记录写入后文件都是完整的HAR
+			if _, har := readHAR(t, dir); len(har.Log.Entries) != 1 {
+				t.Fatalf("期望1条记录, 实际 %d", len(har.Log.Entries))
+			}
+
+			resp, err = client.Get(backend.URL + "/binary")
+			if err != nil {
+				t.Fatalf("请求失败: %v", err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			name, har := readHAR(t, dir)
+			if per == "client" && !strings.HasSuffix(name, "-127.0.0.1.har") {
+				t.Errorf("按客户端划分的文件名不正确: %s", name)
+			}
+			if har.Log.Version != "1.2" || har.Log.Creator.Name != "GoForwardProxy" || len(har.Log.Entries) != 2 {
+				t.Fatalf("HAR内容不正确: %+v", har.Log)
+			}
+
+			post := har.Log.Entries[0]
+			if post.Request.Method != http.MethodPost || post.Request.URL != backend.URL+"/upload?a=1&b=2" || len(post.Request.QueryString) != 2 {
+				t.Errorf("请求记录不正确: %+v", post.Request)
+			}
+			if pd := post.Request.PostData; pd == nil || pd.Text != "01234567" || pd.Comment == "" || post.Request.BodySize != 16 {
+				t.Errorf("请求体应截断为8字节并标注: %+v, 大小 %d", pd, post.Request.BodySize)
+			}
+			if post.Response.Status != http.StatusCreated || harHeader(post.Response.Headers, "X-Backend") != "yes" || harHeader(post.Response.Headers, "Via") == "" {
+				t.Errorf("响应记录不正确: %+v", post.Response)
+			}
+			if c := post.Response.Content; c.Size != int64(len("收到 16 字节")) || c.MimeType != "text/plain" || c.Comment == "" {
+				t.Errorf("响应内容记录不正确: %+v", c)
+			}
+			tm := post.Timings
+			if tm.Send < 0 || tm.Wait < 0 || tm.Receive < 0 || tm.Connect < 0 || post.Time <= 0 {
+				t.Errorf("耗时记录不正确: %+v, 总计 %v", tm, post.Time)
+			}
+			if post.ServerIPAddress != "127.0.0.1" {
+				t.Errorf("服务器地址不正确: %q", post.ServerIPAddress)
+			}
+
+			binary := har.Log.Entries[1].Response.Content
+			if binary.Encoding != "base64" || binary.Text != "//4A" || binary.Comment != "" {
+				t.Errorf("二进制内容应使用base64: %+v", binary)
+			}
+		})
+	}
+}
+
+// TestHARReplay 测试从HAR文件回放响应，不访问网络
+func TestHARReplay(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		w.Header().Set("X-Count", fmt.Sprint(n))
+		if r.URL.Path == "/binary" {
+			w.Write([]byte{0xff, 0x00, 0x01})
+			return
+		}
+		fmt.Fprintf(w, "第%d次", n)
+	}))
+	backendURL := backend.URL
+
+	// 先录制
+	dir := t.TempDir()
+	recorder, _ := NewHARRecorder(dir, false, 1024)
+	proxy := NewForwardProxy()
+	proxy.SetHARRecorder(recorder)
+	client := newProxyTestClient(t, proxy)
+	for _, path := range []string{"/a", "/a", "/binary"} {
+		resp, err := client.Get(backendURL + path)
+		if err != nil {
+			t.Fatalf("请求失败: %v", err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	recorder.Close()
+	backend.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	replay, err := LoadHARReplay(files[0])
+	if err != nil {
+		t.Fatalf("加载回放文件失败: %v", err)
+	}
+	if replay.Len() != 3 {
+		t.Errorf("期望3条记录, 实际 %d", replay.Len())
+	}
+	proxy = NewForwardProxy()
+	proxy.SetHARReplay(replay)
+	proxy.SetPolicy(DefaultPolicy()) // 回放时不进行访问控制检查
+	client = newProxyTestClient(t, proxy)
+
+	get := func(target string) (*http.Response, []byte) {
+		t.Helper()
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatalf("请求失败: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+	// 同一请求的多条记录按顺序返回，用完后重复最后一条
+	for i, want := range []string{"第1次", "第2次", "第2次"} {
+		resp, body := get(backendURL + "/a")
+		if resp.StatusCode != http.StatusOK || string(body) != want {
+			t.Errorf("第%d次回放不正确: %d %q, 期望 %q", i+1, resp.StatusCode, body, want)
+		}
+	}
+	if resp, body := get(backendURL + "/binary"); !bytes.Equal(body, []byte{0xff, 0x00, 0x01}) || resp.Header.Get("X-Count") != "3" {
+		t.Errorf("二进制内容回放不正确: %v %v", body, resp.Header)
+	}
+	if resp, _ := get(backendURL + "/missing"); resp.StatusCode != http.StatusBadGateway || resp.Header.Get("X-HAR-Replay") != "miss" {
+		t.Errorf("没有记录的请求应返回502, 实际 %d", resp.StatusCode)
+	}
+	if atomic.LoadInt32(&hits) != 3 {
+		t.Errorf("回放时不应访问上游, 上游收到 %d 次请求", hits)
+	}
+
+	// 未拦截的CONNECT无法回放
+	proxyURL := client.Transport.(*http.Transport).Proxy
+	u, _ := proxyURL(&http.Request{URL: &url.URL{Scheme: "http", Host: "example.com"}})
+	if status := connectStatus(t, u.Host, "example.com:443"); status != http.StatusBadGateway {
+		t.Errorf("回放模式下未拦截的CONNECT应返回502, 实际 %d", status)
+	}
+}
+
+// TestHARReplayMITM 测试拦截模式下回放HTTPS请求
+func TestHARReplayMITM(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "加密的%s", r.URL.Path)
+	}))
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatalf("生成CA失败: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate())
+	newClient := func(proxy *ForwardProxy) *http.Client {
+		proxy.EnableMITM(ca, nil)
+		client := newProxyTestClient(t, proxy)
+		client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: pool}
+		return client
+	}
+
+	recorder, _ := NewHARRecorder(filepath.Join(dir, "har"), false, 1024)
+	proxy := NewForwardProxy()
+	upstreamPool := x509.NewCertPool()
+	upstreamPool.AddCert(backend.Certificate())
+	proxy.SetTLSPolicy(&TLSPolicy{RootCAs: upstreamPool})
+	proxy.SetHARRecorder(recorder)
+	resp, err := newClient(proxy).Get(backend.URL + "/secret")
+	if err != nil {
+		t.Fatalf("录制请求失败: %v", err)
+	}
+	resp.Body.Close()
+	recorder.Close()
+	backend.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "har", "*.har"))
+	replay, err := LoadHARReplay(files[0])
+	if err != nil {
+		t.Fatalf("加载回放文件失败: %v", err)
+	}
+	proxy = NewForwardProxy()
+	proxy.SetHARReplay(replay)
+	resp, err = newClient(proxy).Get(backend.URL + "/secret")
+	if err != nil {
+		t.Fatalf("回放请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "加密的/secret" {
+		t.Errorf("HTTPS回放内容不正确: %q", body)
+	}
+}
+
+// TestLoadHARReplayErrors 测试无效的回放文件
+func TestLoadHARReplayErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"不是JSON", "not json"},
+		{"相对URL", `{"log": {"entries": [{"request": {"method": "GET", "url": "/a"}, "response": {"status": 200, "content": {}}}]}}`},
+		{"无效的编码", `{"log": {"entries": [{"request": {"method": "GET", "url": "http://a/"}, "response": {"status": 200, "content": {"text": "x", "encoding": "gzip"}}}]}}`},
+		{"无效的base64", `{"log": {"entries": [{"request": {"method": "GET", "url": "http://a/"}, "response": {"status": 200, "content": {"text": "!!", "encoding": "base64"}}}]}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, "replay.har", tt.content)
+			if _, err := LoadHARReplay(path); err == nil {
+				t.Error("期望返回错误")
+			}
+		})
+	}
+	if _, err := LoadHARReplay(filepath.Join(t.TempDir(), "missing.har")); err == nil {
+		t.Error("文件不存在时应返回错误")
+	}
+}
+
+// TestHARReplayAborted 测试状态码为0的中断记录按没有记录处理
+func TestHARReplayAborted(t *testing.T) {
+	path := writeConfig(t, "replay.har", `{"log": {"entries": [
+		{"request": {"method": "GET", "url": "http://example.com/aborted"}, "response": {"status": 0, "content": {}}},
+		{"request": {"method": "GET", "url": "http://example.com/ok"}, "response": {"status": 200, "content": {"text": "ok"}}}
+	]}}`)
+	replay, err := LoadHARReplay(path)
+	if err != nil {
+		t.Fatalf("加载回放文件失败: %v", err)
+	}
+	if replay.Len() != 1 {
+		t.Errorf("期望1条记录, 实际 %d", replay.Len())
+	}
+	proxy := NewForwardProxy()
+	proxy.SetHARReplay(replay)
+	proxy.SetPolicy(DefaultPolicy())
+	resp, err := newProxyTestClient(t, proxy).Get("http://example.com/aborted")
+	if err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get("X-HAR-Replay") != "miss" {
+		t.Errorf("中断的记录应返回502, 实际 %d", resp.StatusCode)
+	}
+}
+
+// TestReplayKey 测试回放匹配时URL的规范化
+func TestReplayKey(t *testing.T) {
+	tests := []struct {
+		method, a, b string
+	}{
+		{"get", "http://Example.com:80/a?x=1", "HTTP://example.com/a?x=1"},
+		{"GET", "https://example.com:443/", "https://example.com/#top"},
+		{"GET", "http://[::1]:80/", "http://[::1]/"},
+	}
+	for _, tt := range tests {
+		a, _ := url.Parse(tt.a)
+		b, _ := url.Parse(tt.b)
+		if ka, kb := replayKey(tt.method, a), replayKey("GET", b); ka != kb {
+			t.Errorf("%s 与 %s 应匹配: %q %q", tt.a, tt.b, ka, kb)
+		}
+	}
+	a, _ := url.Parse("http://example.com:8080/")
+	b, _ := url.Parse("http://example.com/")
+	if replayKey("GET", a) == replayKey("GET", b) {
+		t.Error("非默认端口不应与省略端口匹配")
+	}
+}
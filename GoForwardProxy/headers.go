@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+// hopByHopHeaders 逐跳头部，只对单个连接有意义，代理不能转发（RFC 9110 7.6.1）
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders 删除逐跳头部以及Connection头中列出的头部
+func removeHopByHopHeaders(h http.Header) {
+	for _, value := range h["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// defaultViaName 默认的Via标识，使用主机名
+func defaultViaName() string {
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return "goforwardproxy"
+}
+
+// viaValue 返回本代理追加的Via值，如 "1.1 hostname"
+func (p *ForwardProxy) viaValue(protoMajor, protoMinor int) string {
+	return fmt.Sprintf("%d.%d %s", protoMajor, protoMinor, p.viaName)
+}
+
+// isLoop 判断请求是否已经经过本代理，Via中出现自己的标识即为转发环路
+func (p *ForwardProxy) isLoop(h http.Header) bool {
+	for _, value := range h.Values("Via") {
+		for _, entry := range strings.Split(value, ",") {
+			fields := strings.Fields(entry)
+			if len(fields) >= 2 && strings.EqualFold(fields[1], p.viaName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// appendForwardedFor 将客户端IP追加到X-Forwarded-For
+func appendForwardedFor(h http.Header, remoteAddr string) {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+	if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	h.Set("X-Forwarded-For", ip)
+}
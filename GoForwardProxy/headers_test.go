@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestProxyHopByHopHeaders 测试逐跳头部的删除以及Via和X-Forwarded-For
+func TestProxyHopByHopHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-End-To-End", "1")
+	}))
+	defer backend.Close()
+
+	proxy := NewForwardProxy()
+	proxy.SetViaName("test-proxy")
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   5 * time.Second,
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("Via", "1.0 upstream-proxy")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("X-End-To-End", "1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	resp.Body.Close()
+
+	for _, name := range []string{"X-Client-Hop", "Proxy-Connection", "Keep-Alive", "Te"} {
+		if v := received.Get(name); v != "" {
+			t.Errorf("逐跳头部 %s 被转发到了上游: %q", name, v)
+		}
+	}
+	if received.Get("X-End-To-End") != "1" {
+		t.Error("端到端头部未被转发")
+	}
+	if got := received.Values("Via"); len(got) != 2 || got[1] != "1.1 test-proxy" {
+		t.Errorf("请求Via不正确: %q", got)
+	}
+	if got := received.Get("X-Forwarded-For"); got != "10.0.0.1, 127.0.0.1" {
+		t.Errorf("X-Forwarded-For不正确: %q", got)
+	}
+
+	for _, name := range []string{"X-Backend-Hop", "Keep-Alive"} {
+		if v := resp.Header.Get(name); v != "" {
+			t.Errorf("逐跳头部 %s 被返回给了客户端: %q", name, v)
+		}
+	}
+	if resp.Header.Get("X-End-To-End") != "1" {
+		t.Error("端到端响应头部未被返回")
+	}
+	if got := resp.Header.Get("Via"); got != "1.1 test-proxy" {
+		t.Errorf("响应Via不正确: %q", got)
+	}
+}
+
+// TestProxyLoopDetection 测试Via环路检测
+func TestProxyLoopDetection(t *testing.T) {
+	proxy := NewForwardProxy()
+	proxy.SetViaName("test-proxy")
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Via", "1.1 other, 1.1 Test-Proxy")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusLoopDetected {
+		t.Errorf("状态码不匹配, 期望 %d, 实际 %d", http.StatusLoopDetected, w.Code)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"goproxycommon/accesslog"
+)
+
+// listenerTLSConfig 返回HTTPS代理监听使用的TLS配置，通过ALPN协商HTTP/2或HTTP/1.1。
+// 证书由getCert提供，重新加载配置时可以替换
+func listenerTLSConfig(getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		GetCertificate: getCert,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// completeH2URL HTTP/2没有绝对形式的请求目标，代理请求的目标在:authority（即r.Host）中。
+// :authority不是代理自身时把请求URL补全为绝对URL，之后与HTTP/1.x的代理请求一样处理
+func completeH2URL(r *http.Request) {
+	if r.ProtoMajor != 2 || r.Method == http.MethodConnect || r.URL.IsAbs() || isProxyAuthority(r) {
+		return
+	}
+	u := *r.URL
+	u.Scheme, u.Host = "http", r.Host
+	r.URL = &u
+}
+
+// isProxyAuthority 判断请求的:authority是否指向代理自身：端口与代理监听的端口相同，
+// 并且主机与TLS握手时的SNI相同或者就是代理监听的IP
+func isProxyAuthority(r *http.Request) bool {
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	localHost, localPort, _ := net.SplitHostPort(local.String())
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, "443"
+	}
+	if port != localPort {
+		return false
+	}
+	return host == localHost || r.TLS != nil && strings.EqualFold(host, r.TLS.ServerName)
+}
+
+// canAcceptTunnel 判断能否通过acceptTunnel取得与客户端之间的双向连接
+func canAcceptTunnel(w http.ResponseWriter, r *http.Request) bool {
+	_, ok := w.(http.Hijacker)
+	return ok || r.ProtoMajor == 2
+}
+
+// acceptTunnel 接受CONNECT请求并返回与客户端之间的双向连接。
+// HTTP/1.x劫持底层连接并发送200；HTTP/2下CONNECT是连接上的一个流（RFC 7540 8.3），
+// 请求体和响应体组成双向连接，同一个客户端连接上的多个隧道互不影响。
+// 处理函数必须在wait返回后才能结束，否则流会被提前关闭。只有还没有向客户端发送响应时才返回错误
+func acceptTunnel(w http.ResponseWriter, r *http.Request) (conn net.Conn, wait func(), err error) {
+	if r.ProtoMajor == 2 {
+		stream := newStreamConn(w, r)
+		return stream, stream.wait, nil
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("不支持的代理方式")
+	}
+	// 客户端可能在收到200之前就发送了数据，这些数据已被读入缓冲区
+	clientConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("连接劫持失败: %v", err)
+	}
+	clientConn = withBuffered(clientConn, brw.Reader)
+	// 写入失败时随后的转发或握手会出错并关闭连接
+	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	return clientConn, func() {}, nil
+}
+
+// streamConn 把HTTP/2的CONNECT流包装为net.Conn：读取请求体，写入响应体后立即刷新。
+// 请求体经过net.Pipe转交给Read，读超时只中断当前的读取，与TCP连接的行为一致；
+// 直接设置在流上的读超时到期后整个请求体都会失效
+type streamConn struct {
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	body   io.ReadCloser
+	pr     net.Conn // 读取请求体的一端
+	local  net.Addr
+	remote net.Addr
+
+	mu      sync.Mutex
+	closed  bool
+	bodyErr error      // 读取请求体出错的原因，正常结束时为nil
+	writing int        // 进行中的Write数，处理函数结束后不能再写入响应
+	idle    *sync.Cond // writing变为0时通知
+	done    chan struct{}
+}
+
+// newStreamConn 发送200响应头并返回CONNECT流对应的连接
+func newStreamConn(w http.ResponseWriter, r *http.Request) *streamConn {
+	w.WriteHeader(http.StatusOK)
+	// 之后写入的是隧道数据，由隧道结束时记录访问日志和字节数
+	if lw, ok := w.(*accesslog.ResponseWriter); ok {
+		w = lw.Detach()
+	}
+	pr, pw := net.Pipe()
+	c := &streamConn{
+		w:      w,
+		rc:     http.NewResponseController(w),
+		body:   r.Body,
+		pr:     pr,
+		remote: streamAddr(r.RemoteAddr),
+		done:   make(chan struct{}),
+	}
+	c.idle = sync.NewCond(&c.mu)
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.local = local
+	} else {
+		c.local = streamAddr("")
+	}
+	// 隧道不受http.Server读写超时的限制，与HTTP/1.x劫持后的连接一致
+	c.rc.SetReadDeadline(time.Time{})
+	c.rc.SetWriteDeadline(time.Time{})
+	// 客户端收到响应头后才开始发送数据
+	c.rc.Flush()
+
+	go func() {
+		_, err := io.Copy(pw, c.body)
+		c.mu.Lock()
+		c.bodyErr = err
+		c.mu.Unlock()
+		pw.Close()
+	}()
+	return c
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.pr.Read(b)
+	if err == io.EOF {
+		c.mu.Lock()
+		if c.bodyErr != nil {
+			err = c.bodyErr
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	c.writing++
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.writing--; c.writing == 0 {
+			c.idle.Broadcast()
+		}
+		c.mu.Unlock()
+	}()
+
+	n, err := c.w.Write(b)
+	if err == nil {
+		err = c.rc.Flush()
+	}
+	return n, err
+}
+
+// Close 结束隧道：中断读取，让等待流量控制窗口的写入立即失败，然后通知处理函数返回。
+// HTTP/2的流只能随处理函数一起结束，所以不支持半关闭，转发结束一个方向时整个流都会关闭
+func (c *streamConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	writing := c.writing > 0
+	c.mu.Unlock()
+
+	c.body.Close()
+	c.pr.Close()
+	if writing {
+		c.rc.SetWriteDeadline(time.Now().Add(-time.Second))
+	}
+	close(c.done)
+	return nil
+}
+
+// wait 等待连接关闭并且没有进行中的写入
+func (c *streamConn) wait() {
+	<-c.done
+	c.mu.Lock()
+	for c.writing > 0 {
+		c.idle.Wait()
+	}
+	c.mu.Unlock()
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.pr.SetReadDeadline(t)
+}
+
+// SetWriteDeadline 设置流的写超时，与TCP连接一样，超时后连接不能再使用
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+
+// streamAddr HTTP/2流对应的客户端地址
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tcp" }
+func (a streamAddr) String() string  { return string(a) }
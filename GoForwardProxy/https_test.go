@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startHTTPSProxy 启动支持HTTP/2的HTTPS代理，读写超时设置得很短以检查隧道不受其影响。
+// conns记录客户端建立的连接数
+func startHTTPSProxy(t *testing.T, proxy *ForwardProxy) (server *httptest.Server, conns *int32) {
+	conns = new(int32)
+	server = httptest.NewUnstartedServer(proxy)
+	server.EnableHTTP2 = true
+	server.Config.ReadTimeout = 200 * time.Millisecond
+	server.Config.WriteTimeout = 200 * time.Millisecond
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, conns
+}
+
+// h2Tunnel 客户端一侧的HTTP/2 CONNECT隧道
+type h2Tunnel struct {
+	net.Conn // 只用于满足接口，不会被调用
+	w        io.WriteCloser
+	resp     *http.Response
+	br       *bufio.Reader
+}
+
+// connectH2 通过HTTP/2向代理发送CONNECT请求
+func connectH2(t *testing.T, client *http.Client, proxyURL, target string) *h2Tunnel {
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest(http.MethodConnect, proxyURL, pr)
+	req.Host = target
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("CONNECT请求失败: %v", err)
+	}
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT失败: %s %s", resp.Proto, resp.Status)
+	}
+	return &h2Tunnel{w: pw, resp: resp, br: bufio.NewReader(resp.Body)}
+}
+
+func (c *h2Tunnel) Read(b []byte) (int, error)  { return c.br.Read(b) }
+func (c *h2Tunnel) Write(b []byte) (int, error) { return c.w.Write(b) }
+func (c *h2Tunnel) Close() error {
+	c.w.Close()
+	return c.resp.Body.Close()
+}
+func (c *h2Tunnel) SetDeadline(time.Time) error      { return nil }
+func (c *h2Tunnel) SetReadDeadline(time.Time) error  { return nil }
+func (c *h2Tunnel) SetWriteDeadline(time.Time) error { return nil }
+
+// echo 写入一行并读取回显
+func (c *h2Tunnel) echo(t *testing.T, line string) {
+	t.Helper()
+	if _, err := fmt.Fprintln(c, line); err != nil {
+		t.Fatalf("写入隧道失败: %v", err)
+	}
+	got, err := c.br.ReadString('\n')
+	if err != nil || got != line+"\n" {
+		t.Fatalf("回显不正确: %q %v", got, err)
+	}
+}
+
+// TestHTTP2Connect 测试HTTP/2下多个CONNECT隧道复用同一个客户端连接
+func TestHTTP2Connect(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	proxy := NewForwardProxy()
+	server, conns := startHTTPSProxy(t, proxy)
+	client := server.Client()
+
+	a := connectH2(t, client, server.URL, echoAddr)
+	b := connectH2(t, client, server.URL, echoAddr)
+	defer b.Close()
+	a.echo(t, "a1")
+	b.echo(t, "b1")
+
+	// 超过http.Server的读写超时后隧道仍然可用
+	time.Sleep(300 * time.Millisecond)
+	a.echo(t, "a2")
+	b.echo(t, "b2")
+
+	if n := atomic.LoadInt32(conns); n != 1 {
+		t.Errorf("多个隧道应复用同一个连接, 实际建立了%d个连接", n)
+	}
+	if n := proxy.tunnels.Len(); n != 2 {
+		t.Errorf("活跃隧道数应为2, 实际 %d", n)
+	}
+
+	// 客户端结束请求体后隧道关闭，不影响同一连接上的其他隧道
+	a.w.Close()
+	if _, err := io.ReadAll(a.br); err != nil {
+		t.Errorf("隧道应正常结束: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); proxy.tunnels.Len() != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("隧道关闭后未注销, 活跃隧道 %d 个", proxy.tunnels.Len())
+		}
+	}
+	b.echo(t, "b3")
+
+	// 访问控制在发送200之前生效
+	proxy.SetPolicy(DefaultPolicy())
+	pr, _ := io.Pipe()
+	req, _ := http.NewRequest(http.MethodConnect, server.URL, pr)
+	req.Host = echoAddr
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("CONNECT请求失败: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("被禁止的目标应返回403, 实际 %d", resp.StatusCode)
+	}
+}
+
+// TestHTTP2Request 测试HTTP/2下的普通代理请求和发给代理自身的请求
+func TestHTTP2Request(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "路径 %s", r.URL.Path)
+	}))
+	defer backend.Close()
+	server, _ := startHTTPSProxy(t, NewForwardProxy())
+	client := server.Client()
+
+	// :authority为目标服务器时转发
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/hello", nil)
+	req.Host = strings.TrimPrefix(backend.URL, "http://")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || string(body) != "路径 /hello" {
+		t.Errorf("代理请求不正确: %s %q", resp.Proto, body)
+	}
+
+	// :authority为代理自身时提供PAC文件
+	resp, err = client.Get(server.URL + "/proxy.pac")
+	if err != nil {
+		t.Fatalf("请求PAC失败: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := "HTTPS " + strings.TrimPrefix(server.URL, "https://"); resp.StatusCode != http.StatusOK || !strings.Contains(string(body), want) {
+		t.Errorf("PAC文件应使用 %q: %d\n%s", want, resp.StatusCode, body)
+	}
+}
+
+// TestHTTPSProxyHTTP1 测试客户端通过HTTP/1.1连接HTTPS代理
+func TestHTTPSProxyHTTP1(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "plain")
+	}))
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "tls")
+	}))
+	defer tlsBackend.Close()
+	server, _ := startHTTPSProxy(t, NewForwardProxy())
+
+	proxyURL, _ := url.Parse(server.URL)
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	pool.AddCert(tlsBackend.Certificate())
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{RootCAs: pool}},
+		Timeout:   5 * time.Second,
+	}
+	for _, target := range []struct{ url, want string }{{backend.URL, "plain"}, {tlsBackend.URL, "tls"}} {
+		resp, err := client.Get(target.url)
+		if err != nil {
+			t.Fatalf("通过HTTPS代理请求 %s 失败: %v", target.url, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != target.want {
+			t.Errorf("响应内容不正确, 期望 %q, 实际 %q", target.want, body)
+		}
+	}
+}
+
+// TestHTTP2ConnectMITM 测试HTTP/2的CONNECT流上进行TLS拦截，同一隧道中可以发送多个请求
+func TestHTTP2ConnectMITM(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "路径 %s", r.URL.Path)
+	}))
+	defer backend.Close()
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatalf("生成CA失败: %v", err)
+	}
+	proxy := NewForwardProxy()
+	proxy.EnableMITM(ca, nil)
+	upstreamPool := x509.NewCertPool()
+	upstreamPool.AddCert(backend.Certificate())
+	proxy.SetTLSPolicy(&TLSPolicy{RootCAs: upstreamPool})
+	server, _ := startHTTPSProxy(t, proxy)
+
+	target := strings.TrimPrefix(backend.URL, "https://")
+	stream := connectH2(t, server.Client(), server.URL, target)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate())
+	conn := tls.Client(stream, &tls.Config{RootCAs: pool, ServerName: hostOnly(target)})
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for _, path := range []string{"/a", "/b"} {
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", path, target)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("读取拦截后的响应失败: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "路径 "+path {
+			t.Errorf("响应内容不正确: %q", body)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxThrottleChunk 限速时单次读写的最大字节数，避免一次等待时间过长
+const maxThrottleChunk = 32 << 10
+
+// Limits 每个客户端的限制，0表示不限制
+type Limits struct {
+	Rate       int64 // 带宽上限（字节/秒），上下行合计
+	Burst      int64 // 令牌桶容量（字节），0时等于Rate
+	MaxConns   int   // 最大并发连接数
+	DailyQuota int64 // 每日流量配额（字节），按本地时间零点重置
+}
+
+func (l Limits) burst() int64 {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+// LimitError 客户端超出并发连接数或流量配额
+type LimitError struct {
+	Client     string
+	Reason     string
+	RetryAfter time.Duration // 建议客户端重试的等待时间
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("客户端%s%s", e.Client, e.Reason)
+}
+
+// Limiter 按客户端（认证用户名，未认证时为IP）执行带宽、并发连接和每日配额限制
+type Limiter struct {
+	limits Limits
+
+	mu      sync.Mutex
+	day     string // 当前配额所属的日期
+	clients map[string]*clientLimit
+}
+
+// NewLimiter 创建客户端限制器
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{limits: limits, clients: make(map[string]*clientLimit)}
+}
+
+// clientLimit 单个客户端的限制状态
+type clientLimit struct {
+	limiter *Limiter
+	key     string
+
+	// 以下字段由limiter.mu保护
+	conns int
+	used  int64 // 今日已用流量
+
+	// 令牌桶
+	bucketMu sync.Mutex
+	tokens   float64
+	last     time.Time
+}
+
+// limitKey 返回客户端的限制键：认证用户名，未认证时为客户端IP
+func limitKey(info *requestInfo) string {
+	if info.user != "" {
+		return info.user
+	}
+	host, _, err := net.SplitHostPort(info.client)
+	if err != nil {
+		return info.client
+	}
+	return host
+}
+
+// rollover 日期变化时重置配额并清理空闲客户端，调用者需持有l.mu
+func (l *Limiter) rollover(now time.Time) {
+	day := now.Format("2006-01-02")
+	if day == l.day {
+		return
+	}
+	l.day = day
+	for key, c := range l.clients {
+		c.used = 0
+		if c.conns == 0 {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// Acquire 为客户端占用一个连接，超出并发连接数或今日配额时返回*LimitError
+func (l *Limiter) Acquire(key string) (*clientLimit, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.rollover(now)
+
+	c, ok := l.clients[key]
+	if !ok {
+		c = &clientLimit{limiter: l, key: key, tokens: float64(l.limits.burst()), last: now}
+		l.clients[key] = c
+	}
+	if l.limits.DailyQuota > 0 && c.used >= l.limits.DailyQuota {
+		return nil, &LimitError{Client: key, Reason: "今日流量配额已用完", RetryAfter: untilMidnight(now)}
+	}
+	if l.limits.MaxConns > 0 && c.conns >= l.limits.MaxConns {
+		return nil, &LimitError{Client: key, Reason: fmt.Sprintf("并发连接数超过上限%d", l.limits.MaxConns), RetryAfter: time.Second}
+	}
+	c.conns++
+	return c, nil
+}
+
+// untilMidnight 返回距离下一个本地零点的时间
+func untilMidnight(now time.Time) time.Duration {
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location()).Sub(now)
+}
+
+// retain 为转交给隧道的连接额外占用一个计数，不检查上限
+func (c *clientLimit) retain() {
+	c.limiter.mu.Lock()
+	defer c.limiter.mu.Unlock()
+	c.conns++
+}
+
+// Release 释放Acquire或retain占用的连接
+func (c *clientLimit) Release() {
+	c.limiter.mu.Lock()
+	defer c.limiter.mu.Unlock()
+	c.conns--
+}
+
+// charge 计入n字节的流量，配额已用完时返回*LimitError
+func (c *clientLimit) charge(n int) error {
+	l := c.limiter
+	if l.limits.DailyQuota <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.rollover(now)
+	if c.used >= l.limits.DailyQuota {
+		return &LimitError{Client: c.key, Reason: "今日流量配额已用完", RetryAfter: untilMidnight(now)}
+	}
+	c.used += int64(n)
+	return nil
+}
+
+// reserve 从令牌桶中取出n个令牌，返回需要等待的时间
+func (c *clientLimit) reserve(n int) time.Duration {
+	rate := c.limiter.limits.Rate
+	if rate <= 0 {
+		return 0
+	}
+	c.bucketMu.Lock()
+	defer c.bucketMu.Unlock()
+	now := time.Now()
+	c.tokens += now.Sub(c.last).Seconds() * float64(rate)
+	if burst := float64(c.limiter.limits.burst()); c.tokens > burst {
+		c.tokens = burst
+	}
+	c.last = now
+	// 允许令牌为负，由等待时间偿还
+	c.tokens -= float64(n)
+	if c.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-c.tokens / float64(rate) * float64(time.Second))
+}
+
+// chunk 返回限速时单次读写的最大字节数
+func (c *clientLimit) chunk() int {
+	n := int64(maxThrottleChunk)
+	if burst := c.limiter.limits.burst(); burst > 0 && burst < n {
+		n = burst
+	}
+	return int(n)
+}
+
+// wait 计入n字节的流量并按带宽上限等待，done关闭时提前返回
+func (c *clientLimit) wait(n int, done <-chan struct{}) error {
+	if err := c.charge(n); err != nil {
+		return err
+	}
+	delay := c.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		return io.ErrClosedPipe
+	}
+}
+
+// throttledWriter 按客户端的带宽和配额限制写入
+type throttledWriter struct {
+	w     io.Writer
+	limit *clientLimit
+	done  <-chan struct{}
+}
+
+// limitWriter 返回受上下文中客户端限制约束的Writer，没有限制时直接返回w
+func limitWriter(ctx context.Context, w io.Writer) io.Writer {
+	info := requestInfoFrom(ctx)
+	if info == nil || info.limit == nil {
+		return w
+	}
+	return &throttledWriter{w: w, limit: info.limit, done: ctx.Done()}
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if chunk := t.limit.chunk(); n > chunk {
+			n = chunk
+		}
+		if err := t.limit.wait(n, t.done); err != nil {
+			return written, err
+		}
+		m, err := t.w.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// writeLimitError 返回429，并通过Retry-After告知客户端何时可以重试
+func writeLimitError(w http.ResponseWriter, err *LimitError) {
+	seconds := int64(err.RetryAfter / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newLimitTestProxy 创建开启客户端限制的代理以及通过它访问的客户端
+func newLimitTestProxy(t *testing.T, limits Limits) (string, *http.Client) {
+	proxy := NewForwardProxy()
+	proxy.SetLimiter(NewLimiter(limits))
+	client := newProxyTestClient(t, proxy)
+	client.Timeout = 10 * time.Second
+	proxyURL, _ := client.Transport.(*http.Transport).Proxy(nil)
+	return proxyURL.Host, client
+}
+
+// TestLimitConcurrentConns 测试并发连接数上限
+func TestLimitConcurrentConns(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	proxyAddr, client := newLimitTestProxy(t, Limits{MaxConns: 1})
+
+	conn, _ := dialConnect(t, proxyAddr, echoAddr)
+
+	resp, err := client.Get("http://" + echoAddr + "/")
+	if err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("超过并发上限应返回429, 实际 %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("429响应应包含Retry-After")
+	}
+
+	// 隧道关闭后释放连接计数
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for connectStatus(t, proxyAddr, echoAddr) != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("隧道关闭后连接计数没有释放")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// connectStatus 发送CONNECT请求并返回状态码，随后关闭连接
+func connectStatus(t *testing.T, proxyAddr, target string) int {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("连接代理失败: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("读取CONNECT响应失败: %v", err)
+	}
+	return resp.StatusCode
+}
+
+// TestLimitMITMConns 测试拦截的会话在解密后的连接关闭前一直占用连接计数
+func TestLimitMITMConns(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+	target := strings.TrimPrefix(backend.URL, "https://")
+
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatalf("生成CA失败: %v", err)
+	}
+	proxy := NewForwardProxy()
+	proxy.SetLimiter(NewLimiter(Limits{MaxConns: 1}))
+	proxy.EnableMITM(ca, nil)
+	upstreamPool := x509.NewCertPool()
+	upstreamPool.AddCert(backend.Certificate())
+	proxy.SetTLSPolicy(&TLSPolicy{RootCAs: upstreamPool})
+	proxyURL, _ := newProxyTestClient(t, proxy).Transport.(*http.Transport).Proxy(nil)
+
+	// 第一个会话完成一次请求后保持keep-alive连接
+	conn, _ := dialConnect(t, proxyURL.Host, target)
+	defer conn.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate())
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"})
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", target)
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("读取拦截的响应失败: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("拦截的请求失败: %d", resp.StatusCode)
+	}
+
+	if status := connectStatus(t, proxyURL.Host, target); status != http.StatusTooManyRequests {
+		t.Errorf("第二个拦截会话应返回429, 实际 %d", status)
+	}
+
+	// 解密后的连接关闭后释放连接计数
+	tlsConn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for connectStatus(t, proxyURL.Host, target) != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("拦截的会话关闭后连接计数没有释放")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestLimitDailyQuota 测试每日流量配额用完后返回429
+func TestLimitDailyQuota(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Repeat("x", 100))
+	}))
+	defer backend.Close()
+	_, client := newLimitTestProxy(t, Limits{DailyQuota: 50})
+
+	tests := []struct {
+		name       string
+		wantStatus int
+	}{
+		{"配额内", http.StatusOK},
+		{"配额用完", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.Get(backend.URL)
+			if err != nil {
+				t.Fatalf("请求失败: %v", err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("状态码不匹配, 期望 %d, 实际 %d", tt.wantStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestLimitBandwidth 测试带宽上限
+func TestLimitBandwidth(t *testing.T) {
+	body := strings.Repeat("x", 60<<10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer backend.Close()
+	_, client := newLimitTestProxy(t, Limits{Rate: 100 << 10, Burst: 10 << 10})
+
+	start := time.Now()
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(data) != len(body) {
+		t.Fatalf("响应体长度不匹配: %d", len(data))
+	}
+	// 超出令牌桶容量的50KB需要约0.5秒
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("限速没有生效, 用时 %s", elapsed)
+	}
+}
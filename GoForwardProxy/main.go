@@ -1,55 +1,297 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
+
+	"goproxycommon/accesslog"
+	"goproxycommon/proxyproto"
 )
 
 // ForwardProxy 正向代理服务器结构体
 type ForwardProxy struct {
 	client *http.Client
+	dialer *net.Dialer
+
+	ca         *CertAuthority // 非空时对CONNECT流量进行TLS拦截
+	mitmBypass []string       // 不进行拦截、直接隧道转发的主机模式
+
+	auth Authenticator // 非空时要求客户端进行代理认证
+
+	policy *Policy // 非空时对所有出站连接进行访问控制
+	router *Router // 非空时按目标选择直连或上级代理
+
+	viaName string // Via头中本代理的标识，用于环路检测
+
+	tlsPolicy *TLSPolicy // 连接上游HTTPS服务器时的证书校验策略
+
+	cache *Cache // 非空时缓存可缓存的GET/HEAD响应
+
+	tunnels           *TunnelRegistry // 活跃的隧道连接
+	tunnelIdleTimeout time.Duration   // 隧道空闲超时，0表示不限制
+	tunnelMaxLifetime time.Duration   // 隧道最长存活时间，0表示不限制
+	bodyIdleTimeout   time.Duration   // 上游响应体空闲超时，0表示不限制
+	mitmServers       *serverSet      // 进行中的HTTPS拦截会话
+	limiter           *Limiter        // 按客户端的带宽、并发连接和配额限制
+	resolver          Resolver        // 出站连接使用的DNS解析器
+	pacProxy          string          // PAC文件中的代理地址，为空时使用请求的Host
+	accessLog         *accesslog.Logger
+	metrics           *Metrics       // 运行指标，由管理接口输出
+	proxyProtoVersion int            // 向隧道目标发送的PROXY协议版本，0表示不发送
+	proxyProtoHosts   []string       // 需要PROXY协议头的隧道目标主机模式
+	faults            *FaultInjector // 故障注入规则，由管理接口修改
+	har               *HARRecorder   // 非空时把HTTP请求和响应录制为HAR文件
+	replay            *HARReplayer   // 非空时从HAR文件回放响应，不访问网络
+	maxRequestBody    int64          // 请求体的大小上限（字节），0表示不限制
+	sourceAddrs       []net.IP       // 出站连接默认绑定的本地地址，路由规则中的设置优先
+	fallbackDelay     time.Duration  // happy eyeballs开始尝试下一个地址的等待时间，0表示依次尝试
+}
+
+// requestInfo 请求上下文中记录的客户端信息
+type requestInfo struct {
+	client string // 客户端地址
+	user   string // 认证后的用户名，未认证时为空
+	method string // 请求方法，用于访问控制
+
+	upstream string // 实际连接的上游地址，用于访问日志
+	parent   bool   // upstream是否为上级代理
+
+	viaParent *parentAttempts // 普通HTTP请求以绝对URL形式经过的HTTP上级代理，未经过时为nil
+
+	limit *clientLimit // 客户端的带宽和配额限制，未开启时为nil
+	fault *FaultRule   // 命中的带宽或截断故障规则，未命中时为nil
+}
+
+type contextKey int
+
+const (
+	requestInfoKey contextKey = iota
+	resolvedTargetKey
+)
+
+// withRequestInfo 将客户端信息写入上下文
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey, info)
+}
+
+// requestInfoFrom 从上下文中读取客户端信息
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+// logf 输出日志，并在每行前附加客户端地址和用户名
+func logf(ctx context.Context, format string, v ...interface{}) {
+	info := requestInfoFrom(ctx)
+	if info == nil {
+		log.Printf(format, v...)
+		return
+	}
+	user := info.user
+	if user == "" {
+		user = "-"
+	}
+	log.Printf("[%s %s] "+format, append([]interface{}{info.client, user}, v...)...)
 }
 
 // NewForwardProxy 创建新的正向代理实例
 func NewForwardProxy() *ForwardProxy {
+	p := &ForwardProxy{
+		viaName:   defaultViaName(),
+		tunnels:   NewTunnelRegistry(),
+		resolver:  NewCachingResolver(nil),
+		tlsPolicy: &TLSPolicy{},
+		metrics:   NewMetrics(),
+		faults:    NewFaultInjector(),
+
+		mitmServers:       &serverSet{},
+		tunnelIdleTimeout: defaultTunnelIdleTimeout,
+		bodyIdleTimeout:   defaultBodyIdleTimeout,
+		fallbackDelay:     defaultFallbackDelay,
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+	}
+
 	// 创建自定义的Transport
 	transport := &http.Transport{
-		// 设置代理服务器的TLS配置
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true, // 在生产环境中应该设置为false
-		},
 		// 设置连接池
 		MaxIdleConns:        100,
 		IdleConnTimeout:     90 * time.Second,
 		DisableCompression:  true,
-		// 自定义拨号函数，支持超时设置
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
+		// 只限制等待响应头的时间，响应体由空闲超时控制，长时间的流式响应不会被中断
+		ResponseHeaderTimeout: defaultResponseHeaderTimeout,
+		// 请求带有Expect: 100-continue时等待上游同意后再发送请求体
+		ExpectContinueTimeout: defaultExpectContinueTimeout,
+		// 普通HTTP请求的出站方式为HTTP上级代理时以绝对URL形式发给上级代理
+		Proxy: p.proxyForRequest,
+		// 自定义拨号函数，统一进行访问控制检查
+		DialContext: p.dialContext,
+		// HTTPS上游按TLS策略校验证书
+		DialTLSContext: p.dialTLS,
 	}
 
-	// 创建HTTP客户端
+	// 创建HTTP客户端，不设置整体超时
 	client := &http.Client{
 		Transport: transport,
-		Timeout:   time.Minute, // 整体请求超时时间
 	}
 
-	return &ForwardProxy{
-		client: client,
-	}
+	p.client = client
+	return p
+}
+
+// EnableMITM 开启TLS拦截模式，bypass中的主机仍然直接隧道转发
+func (p *ForwardProxy) EnableMITM(ca *CertAuthority, bypass []string) {
+	p.ca = ca
+	p.mitmBypass = bypass
+}
+
+// SetAuthenticator 设置代理认证方式，nil表示不需要认证
+func (p *ForwardProxy) SetAuthenticator(auth Authenticator) {
+	p.auth = auth
+}
+
+// SetPolicy 设置出站访问控制规则，nil表示不限制
+func (p *ForwardProxy) SetPolicy(policy *Policy) {
+	p.policy = policy
+}
+
+// SetRouter 设置上级代理路由规则，nil表示全部直连
+func (p *ForwardProxy) SetRouter(router *Router) {
+	p.router = router
+}
+
+// SetViaName 设置Via头中本代理的标识，多个代理级联时需要互不相同
+func (p *ForwardProxy) SetViaName(name string) {
+	p.viaName = name
+}
+
+// SetTunnelTimeouts 设置隧道的空闲超时和最长存活时间，0表示不限制
+func (p *ForwardProxy) SetTunnelTimeouts(idle, maxLifetime time.Duration) {
+	p.tunnelIdleTimeout = idle
+	p.tunnelMaxLifetime = maxLifetime
+}
+
+// SetPACProxy 设置PAC文件中让客户端使用的代理地址
+func (p *ForwardProxy) SetPACProxy(addr string) {
+	p.pacProxy = addr
+}
+
+// SetResolver 设置出站连接使用的DNS解析器
+func (p *ForwardProxy) SetResolver(resolver Resolver) {
+	p.resolver = resolver
+}
+
+// SetLimiter 设置按客户端的带宽、并发连接和流量配额限制
+func (p *ForwardProxy) SetLimiter(limiter *Limiter) {
+	p.limiter = limiter
+}
+
+// SetCache 设置共享HTTP缓存，nil表示不缓存
+func (p *ForwardProxy) SetCache(cache *Cache) {
+	p.cache = cache
+}
+
+// SetHARRecorder 设置HAR录制，nil表示不录制
+func (p *ForwardProxy) SetHARRecorder(recorder *HARRecorder) {
+	p.har = recorder
+}
+
+// SetHARReplay 设置HAR回放，nil表示正常访问上游
+func (p *ForwardProxy) SetHARReplay(replay *HARReplayer) {
+	p.replay = replay
+}
+
+// SetConnPool 设置上游连接池的空闲连接上限和空闲超时，0表示不限制
+func (p *ForwardProxy) SetConnPool(maxIdle, maxIdlePerHost int, idleTimeout time.Duration) {
+	transport := p.client.Transport.(*http.Transport)
+	transport.MaxIdleConns = maxIdle
+	transport.MaxIdleConnsPerHost = maxIdlePerHost
+	transport.IdleConnTimeout = idleTimeout
+}
+
+// SetDialTimeout 设置连接上游的超时，0表示不限制
+func (p *ForwardProxy) SetDialTimeout(timeout time.Duration) {
+	p.dialer.Timeout = timeout
 }
 
 // ServeHTTP 处理代理请求
 func (p *ForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("收到请求: %s %s", r.Method, r.URL)
+	info := &requestInfo{client: r.RemoteAddr, method: r.Method}
+	r = r.WithContext(withRequestInfo(r.Context(), info))
+	completeH2URL(r)
+	p.serveObserved(w, r, p.serve)
+}
+
+// serve 处理已附加客户端信息的代理请求
+func (p *ForwardProxy) serve(w http.ResponseWriter, r *http.Request) {
+	info := requestInfoFrom(r.Context())
+	if isLocalRequest(r) {
+		// 发给代理自身的请求（PAC/WPAD）不需要代理认证，也不转发
+		p.handleLocal(w, r)
+		return
+	}
+
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	info.user = user
+	logf(r.Context(), "收到请求: %s %s", r.Method, r.URL)
+
+	if p.limiter != nil {
+		limit, err := p.limiter.Acquire(limitKey(info))
+		if err != nil {
+			logf(r.Context(), "拒绝请求: %v", err)
+			writeLimitError(w, err.(*LimitError))
+			return
+		}
+		defer limit.Release()
+		info.limit = limit
+	}
+
+	if p.isLoop(r.Header) {
+		logf(r.Context(), "检测到转发环路: Via %s", strings.Join(r.Header.Values("Via"), ", "))
+		http.Error(w, "检测到转发环路", http.StatusLoopDetected)
+		return
+	}
+
+	// 被拦截的CONNECT在解密后的请求上匹配故障规则，避免同一规则命中两次
+	intercepted := r.Method == http.MethodConnect && p.shouldIntercept(r.URL.Host)
+	if !intercepted && p.injectFault(w, r) {
+		return
+	}
+
+	if r.Method == methodPurge && p.cache != nil {
+		// 清除缓存条目
+		p.handlePurge(w, r)
+		return
+	}
 
 	if r.Method == http.MethodConnect {
+		if p.replay != nil && !p.shouldIntercept(r.URL.Host) {
+			// 加密的隧道无法回放，HTTPS请求需要开启拦截模式
+			logf(r.Context(), "回放模式下拒绝未拦截的CONNECT: %s", r.URL.Host)
+			http.Error(w, "回放模式下只能回放HTTP请求和被拦截的HTTPS请求", http.StatusBadGateway)
+			return
+		}
+		if p.shouldIntercept(r.URL.Host) {
+			// 拦截并解密HTTPS请求
+			p.handleMITM(w, r)
+			return
+		}
 		// 处理HTTPS请求
 		p.handleHTTPS(w, r)
 	} else {
@@ -60,95 +302,290 @@ func (p *ForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // handleHTTP 处理HTTP请求
 func (p *ForwardProxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
-	// 创建新的请求
-	req, err := http.NewRequest(r.Method, r.URL.String(), r.Body)
+	// 录制为HAR，协议升级后的数据不是HTTP响应，不录制
+	if p.har != nil && upgradeType(r.Header) == "" {
+		var finish func()
+		w, r, finish = p.recordHAR(w, r)
+		defer finish()
+	}
+	// 回放模式下不进行访问控制检查，也不解析域名
+	if p.replay != nil {
+		p.serveReplay(w, r)
+		return
+	}
+
+	// 访问控制检查
+	ctx, err := p.authorizeTarget(r.Context(), canonicalAddr(r.URL))
+	if err != nil {
+		writeDialError(w, r, err)
+		return
+	}
+
+	// 创建新的请求，请求体在setUpstreamBody中设置
+	req, err := http.NewRequestWithContext(ctx, r.Method, r.URL.String(), nil)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("创建请求失败: %v", err), http.StatusBadGateway)
 		return
 	}
+	if err := p.setUpstreamBody(w, r, req); err != nil {
+		writeBodyTooLarge(w, r, err)
+		return
+	}
 
-	// 复制原始请求的header
+	// 复制原始请求的header，去掉逐跳头部并追加Via和X-Forwarded-For
 	for key, values := range r.Header {
 		for _, value := range values {
 			req.Header.Add(key, value)
 		}
 	}
+	removeHopByHopHeaders(req.Header)
+	req.Trailer = r.Trailer
+	req.Header.Add("Via", p.viaValue(r.ProtoMajor, r.ProtoMinor))
+	appendForwardedFor(req.Header, r.RemoteAddr)
+	if info := requestInfoFrom(ctx); info != nil {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotConn: func(ci httptrace.GotConnInfo) { info.setPeer(ci.Conn) },
+		}))
+	}
+
+	// WebSocket等协议升级请求在握手后转为双向转发
+	if upgradeType(r.Header) != "" {
+		p.handleUpgrade(w, r, req)
+		return
+	}
+
+	// GET/HEAD请求经过缓存处理
+	if p.cache != nil && cacheableRequest(r) {
+		p.handleCached(w, r, req)
+		return
+	}
 
 	// 发送请求
-	resp, err := p.client.Do(req)
+	resp, err := p.doUpstream(req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("请求失败: %v", err), http.StatusBadGateway)
+		if !writeBodyTooLarge(w, r, err) {
+			writeDialError(w, r, err)
+		}
 		return
 	}
 	defer resp.Body.Close()
 
-	// 复制响应header
+	// 非安全方法成功后使缓存中的对应条目失效
+	if p.cache != nil && !isSafeMethod(r.Method) && resp.StatusCode < 400 {
+		p.cache.Invalidate(cacheKey(req.URL))
+	}
+
+	p.copyResponse(w, r, resp)
+}
+
+// copyResponse 将上游响应写回客户端
+func (p *ForwardProxy) copyResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) error {
+	// 复制响应header，去掉逐跳头部并追加Via
+	removeHopByHopHeaders(resp.Header)
 	for key, values := range resp.Header {
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
+	w.Header().Add("Via", p.viaValue(resp.ProtoMajor, resp.ProtoMinor))
+
+	// 声明上游的trailer，响应体结束后再填入值
+	for key := range resp.Trailer {
+		w.Header().Add("Trailer", key)
+	}
 
 	// 写入状态码
 	w.WriteHeader(resp.StatusCode)
 
 	// 复制响应体
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		log.Printf("复制响应体失败: %v", err)
+	if err := p.copyBody(w, r, resp); err != nil {
+		logf(r.Context(), "复制响应体失败: %v", err)
+		return err
 	}
+	for key, values := range resp.Trailer {
+		w.Header()[key] = values
+	}
+	return nil
 }
 
 // handleHTTPS 处理HTTPS请求
 func (p *ForwardProxy) handleHTTPS(w http.ResponseWriter, r *http.Request) {
-	// 劫持客户端连接
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
+	if !canAcceptTunnel(w, r) {
 		http.Error(w, "不支持的代理方式", http.StatusInternalServerError)
 		return
 	}
 
-	clientConn, _, err := hijacker.Hijack()
+	// 访问控制检查并连接目标服务器，在发送200之前完成以便返回错误状态码
+	ctx, err := p.authorizeTarget(r.Context(), r.URL.Host)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("连接劫持失败: %v", err), http.StatusServiceUnavailable)
+		writeDialError(w, r, err)
 		return
 	}
-
-	// 连接目标服务器
-	targetConn, err := net.Dial("tcp", r.URL.Host)
+	targetConn, err := p.dialTunnel(ctx, r.URL.Host)
 	if err != nil {
-		clientConn.Close()
-		log.Printf("连接目标服务器失败: %v", err)
+		writeDialError(w, r, err)
 		return
 	}
 
-	// 发送200 Connection Established
-	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	// 劫持客户端连接（HTTP/2下使用CONNECT流）并发送200 Connection Established
+	clientConn, wait, err := acceptTunnel(w, r)
+	if err != nil {
+		targetConn.Close()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
 	// 双向转发数据
-	go transfer(targetConn, clientConn)
-	go transfer(clientConn, targetConn)
+	p.relay(r.Context(), clientConn, targetConn, r.URL.Host)
+	wait()
+}
+
+// defaultTunnelIdleTimeout 隧道默认的空闲超时
+const defaultTunnelIdleTimeout = 5 * time.Minute
+
+// transfer 从source向destination转发数据，source正常结束时半关闭destination的写方向
+func transfer(destination, source net.Conn) error {
+	if _, err := io.Copy(destination, source); err != nil {
+		return err
+	}
+	if cw, ok := destination.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return destination.Close()
 }
 
-// transfer 在两个连接之间转发数据
-func transfer(destination io.WriteCloser, source io.ReadCloser) {
-	defer destination.Close()
-	defer source.Close()
-	io.Copy(destination, source)
+// listen 监听TCP地址，trusted非空时解析来自这些地址的PROXY协议头
+func listen(addr string, trusted []*net.IPNet) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil || len(trusted) == 0 {
+		return l, err
+	}
+	return proxyproto.NewListener(l, trusted), nil
+}
+
+// splitList 解析逗号分隔的列表，忽略空白项
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func main() {
-	proxy := NewForwardProxy()
+	args := os.Args[1:]
+	config, err := LoadConfig(args)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatalf("加载配置失败: %v", err)
+	}
+	if config.File != "" {
+		log.Printf("已加载配置文件: %s", config.File)
+	}
+	proxy, users, err := config.NewProxy(nil)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if proxy.accessLog != nil {
+		defer proxy.accessLog.Close()
+	}
+	if proxy.har != nil {
+		defer proxy.har.Close()
+	}
+	trustedLBs, _ := proxyproto.ParseCIDRs(strings.Join(config.Listen.ProxyProtocolFrom, ","))
+	reloader := NewReloader(args, config, proxy)
+
 	server := &http.Server{
-		Addr:    ":8080",
-		Handler: proxy,
+		Addr:    config.Listen.HTTP,
+		Handler: reloader,
 		// 设置超时
-		ReadTimeout:    1 * time.Minute,
-		WriteTimeout:   1 * time.Minute,
-		IdleTimeout:    2 * time.Minute,
+		ReadTimeout:    time.Duration(config.Timeouts.Read),
+		WriteTimeout:   time.Duration(config.Timeouts.Write),
+		IdleTimeout:    time.Duration(config.Timeouts.Idle),
+	}
+	if config.Listen.TLSCert != "" {
+		cert, err := config.listenCertificate()
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		reloader.SetCertificate(cert)
+		server.TLSConfig = listenerTLSConfig(reloader.GetCertificate)
+	}
+
+	var socks *SOCKS5Server
+	if config.Listen.SOCKS != "" {
+		socks = NewSOCKS5Server(proxy, users)
+		reloader.SetSOCKS5Server(socks)
+		go func() {
+			log.Printf("SOCKS5代理服务器启动在 %s", config.Listen.SOCKS)
+			l, err := listen(config.Listen.SOCKS, trustedLBs)
+			if err != nil {
+				log.Fatalf("SOCKS5服务器启动失败: %v", err)
+			}
+			if err := socks.Serve(l); err != nil && err != ErrSOCKS5ServerClosed {
+				log.Fatalf("SOCKS5服务器启动失败: %v", err)
+			}
+		}()
 	}
 
-	log.Printf("正向代理服务器启动在 :8080")
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("服务器启动失败: %v", err)
+	if config.Listen.Admin != "" {
+		go func() {
+			log.Printf("管理接口启动在 %s", config.Listen.Admin)
+			// 隧道、指标和故障规则在重新加载后沿用，管理接口不需要跟随替换
+			if err := http.ListenAndServe(config.Listen.Admin, proxy.AdminHandler()); err != nil {
+				log.Fatalf("管理接口启动失败: %v", err)
+			}
+		}()
 	}
+
+	go func() {
+		l, err := listen(server.Addr, trustedLBs)
+		if err != nil {
+			log.Fatalf("服务器启动失败: %v", err)
+		}
+		if server.TLSConfig != nil {
+			log.Printf("正向代理服务器启动在 %s（HTTPS，支持HTTP/2）", server.Addr)
+			// 证书由TLSConfig.GetCertificate提供，重新加载配置时更新
+			err = server.ServeTLS(l, "", "")
+		} else {
+			log.Printf("正向代理服务器启动在 %s", server.Addr)
+			err = server.Serve(l)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("服务器启动失败: %v", err)
+		}
+	}()
+
+	// 配置文件修改或收到SIGHUP时重新加载配置
+	stopWatch := make(chan struct{})
+	go reloader.Watch(configPollInterval, stopWatch)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloader.reload("收到SIGHUP")
+		}
+	}()
+
+	// 收到退出信号后停止接受新连接，等待进行中的请求和隧道结束
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	close(stopWatch)
+	signal.Stop(hup)
+	shutdownGrace := time.Duration(reloader.Config().Timeouts.ShutdownGrace)
+	log.Printf("收到信号 %v，停止接受新连接，最多等待 %s", sig, shutdownGrace)
+	go func() {
+		<-signals
+		log.Fatalf("再次收到退出信号，立即退出")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+	logShutdownSummary(reloader.Proxy().Shutdown(ctx, server, socks))
+	log.Printf("正向代理服务器已退出")
 }
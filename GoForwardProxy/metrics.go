@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"goproxycommon/accesslog"
+)
+
+// metricsContentType Prometheus文本格式的Content-Type
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// upstreamLatencyBuckets 上游请求耗时直方图的分桶上限（秒）
+var upstreamLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics 代理的运行指标，通过管理接口的 /metrics 以Prometheus文本格式输出
+type Metrics struct {
+	requests        counterVec // 按方法、状态码和目标类别统计的请求数
+	dialErrors      counterVec // 按原因统计的出站连接失败数
+	upstreamLatency *histogram // handleHTTP发往上游的请求耗时
+
+	httpBytesOut   int64 // 写回客户端的HTTP响应体字节数
+	tunnelBytesIn  int64 // 隧道中从客户端发往目标的字节数
+	tunnelBytesOut int64 // 隧道中从目标发往客户端的字节数
+}
+
+// NewMetrics 创建空的指标集合
+func NewMetrics() *Metrics {
+	return &Metrics{upstreamLatency: newHistogram(upstreamLatencyBuckets)}
+}
+
+// observeRequest 记录一个处理完的请求
+func (m *Metrics) observeRequest(r *http.Request, w *accesslog.ResponseWriter) {
+	status := w.Status()
+	if w.Hijacked() {
+		status = hijackedStatus(r.Method)
+	} else if status == 0 {
+		status = http.StatusOK
+	}
+	m.requests.add(labels("method", metricMethod(r.Method), "status", strconv.Itoa(status), "host_class", hostClass(r)), 1)
+	atomic.AddInt64(&m.httpBytesOut, w.Bytes())
+}
+
+// observeDialError 记录一次出站连接失败
+func (m *Metrics) observeDialError(err error) {
+	m.dialErrors.add(labels("reason", dialErrorReason(err)), 1)
+}
+
+// WriteTo 以Prometheus文本格式输出全部指标，activeTunnels为当前活跃隧道数
+func (m *Metrics) WriteTo(w io.Writer, activeTunnels int) {
+	writeHeader(w, "goforwardproxy_requests_total", "counter", "处理的代理请求数")
+	m.requests.write(w, "goforwardproxy_requests_total")
+
+	writeHeader(w, "goforwardproxy_upstream_request_duration_seconds", "histogram", "HTTP请求发往上游到收到响应头的耗时")
+	m.upstreamLatency.write(w, "goforwardproxy_upstream_request_duration_seconds")
+
+	writeHeader(w, "goforwardproxy_tunnels_active", "gauge", "活跃的隧道数，包括CONNECT、SOCKS5和协议升级")
+	fmt.Fprintf(w, "goforwardproxy_tunnels_active %d\n", activeTunnels)
+
+	writeHeader(w, "goforwardproxy_bytes_total", "counter", "转发的字节数")
+	fmt.Fprintf(w, "goforwardproxy_bytes_total{%s} %d\n", labels("kind", "http", "direction", "out"), atomic.LoadInt64(&m.httpBytesOut))
+	fmt.Fprintf(w, "goforwardproxy_bytes_total{%s} %d\n", labels("kind", "tunnel", "direction", "in"), atomic.LoadInt64(&m.tunnelBytesIn))
+	fmt.Fprintf(w, "goforwardproxy_bytes_total{%s} %d\n", labels("kind", "tunnel", "direction", "out"), atomic.LoadInt64(&m.tunnelBytesOut))
+
+	writeHeader(w, "goforwardproxy_dial_errors_total", "counter", "出站连接失败数")
+	m.dialErrors.write(w, "goforwardproxy_dial_errors_total")
+}
+
+// handleMetrics 输出Prometheus指标
+func (p *ForwardProxy) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "只允许GET方法", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	p.metrics.WriteTo(w, p.tunnels.Len())
+}
+
+// metricMethod 返回用作标签的请求方法，非标准方法统一记为OTHER，避免标签数量无限增长
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace, methodPurge:
+		return method
+	}
+	return "OTHER"
+}
+
+// hostClass 返回请求目标的类别：local（代理自身）、loopback、private、public（IP地址）或domain（域名）
+func hostClass(r *http.Request) string {
+	if isLocalRequest(r) {
+		return "local"
+	}
+	ip := net.ParseIP(r.URL.Hostname())
+	switch {
+	case ip == nil:
+		return "domain"
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsPrivate(), ip.IsLinkLocalUnicast():
+		return "private"
+	}
+	return "public"
+}
+
+// dialErrorReason 返回出站连接失败的原因分类
+func dialErrorReason(err error) string {
+	var denied *AccessDeniedError
+	var rejected *upstreamError
+	var dnsErr *net.DNSError
+	var tlsErr *upstreamTLSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &denied):
+		return "denied"
+	case errors.As(err, &rejected):
+		return "upstream"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &tlsErr):
+		return "tls"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	}
+	return "other"
+}
+
+// labelEscaper 按Prometheus文本格式转义标签值
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels 将成对的标签名和值渲染为 name="value",... 的形式
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	return b.String()
+}
+
+// writeHeader 输出指标的HELP和TYPE行
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// counterVec 按标签组合区分的计数器
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]uint64 // 键为渲染后的标签
+}
+
+func (c *counterVec) add(labels string, n uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]uint64)
+	}
+	c.values[labels] += n
+}
+
+// write 按标签排序输出，保证每次输出的顺序稳定
+func (c *counterVec) write(w io.Writer, name string) {
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	values := make([]uint64, len(keys))
+	sort.Strings(keys)
+	for i, k := range keys {
+		values[i] = c.values[k]
+	}
+	c.mu.Unlock()
+	for i, k := range keys {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, k, values[i])
+	}
+}
+
+// histogram 固定分桶的直方图
+type histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64 // 每个分桶的计数（非累积），最后一个为+Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// write 输出累积分桶、总和与总数
+func (h *histogram) write(w io.Writer, name string) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// scrapeMetrics 通过管理接口读取指标
+func scrapeMetrics(t *testing.T, proxy *ForwardProxy) string {
+	rec := httptest.NewRecorder()
+	proxy.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("读取指标失败: %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != metricsContentType {
+		t.Errorf("Content-Type不匹配: %s", ct)
+	}
+	return rec.Body.String()
+}
+
+// TestMetrics 测试请求计数、上游耗时、隧道、字节数和连接失败指标
+func TestMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer backend.Close()
+	echoAddr := startEchoServer(t)
+
+	// 获取一个没有监听的端口，用于产生连接被拒绝的错误
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	proxy := NewForwardProxy()
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+
+	for _, target := range []string{backend.URL, "http://" + closedAddr} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatalf("请求失败: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	conn, br := dialConnect(t, proxyURL.Host, echoAddr)
+	conn.Write([]byte("ping"))
+	io.ReadFull(br, make([]byte, 4))
+
+	// 隧道关闭前即可看到活跃隧道和实时字节数
+	body := scrapeMetrics(t, proxy)
+	wants := []string{
+		`goforwardproxy_requests_total{method="GET",status="200",host_class="loopback"} 1`,
+		`goforwardproxy_requests_total{method="GET",status="502",host_class="loopback"} 1`,
+		`goforwardproxy_requests_total{method="CONNECT",status="200",host_class="loopback"} 1`,
+		`goforwardproxy_upstream_request_duration_seconds_bucket{le="+Inf"} 2`,
+		`goforwardproxy_upstream_request_duration_seconds_count 2`,
+		`goforwardproxy_tunnels_active 1`,
+		`goforwardproxy_bytes_total{kind="tunnel",direction="in"} 4`,
+		`goforwardproxy_bytes_total{kind="tunnel",direction="out"} 4`,
+		`goforwardproxy_dial_errors_total{reason="refused"} 1`,
+		`# TYPE goforwardproxy_upstream_request_duration_seconds histogram`,
+	}
+	for _, want := range wants {
+		if !strings.Contains(body, want) {
+			t.Errorf("指标中缺少 %q:\n%s", want, body)
+		}
+	}
+
+	conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); proxy.tunnels.Len() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if body := scrapeMetrics(t, proxy); !strings.Contains(body, "goforwardproxy_tunnels_active 0\n") {
+		t.Errorf("隧道关闭后活跃隧道数应为0:\n%s", body)
+	}
+}
+
+// TestMetricsNotOnProxyPort 测试指标不能通过代理端口访问
+func TestMetricsNotOnProxyPort(t *testing.T) {
+	proxyServer := httptest.NewServer(NewForwardProxy())
+	defer proxyServer.Close()
+
+	resp, err := http.Get(proxyServer.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("代理端口不应提供指标, 状态码 %d", resp.StatusCode)
+	}
+}
+
+// TestHostClass 测试目标类别
+func TestHostClass(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://www.example.com/", "domain"},
+		{"http://127.0.0.1:8080/", "loopback"},
+		{"http://[::1]/", "loopback"},
+		{"http://192.168.1.10/", "private"},
+		{"http://169.254.169.254/", "private"},
+		{"http://93.184.216.34/", "public"},
+		{"/proxy.pac", "local"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		if got := hostClass(r); got != tt.want {
+			t.Errorf("%s: 期望 %s, 实际 %s", tt.url, tt.want, got)
+		}
+	}
+}
+
+// TestDialErrorReason 测试出站连接失败的原因分类
+func TestDialErrorReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&AccessDeniedError{}, "denied"},
+		{&upstreamError{upstream: "parent:3128", msg: "403 Forbidden"}, "upstream"},
+		{&net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}, "dns"},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, "refused"},
+		{context.DeadlineExceeded, "timeout"},
+		{fmt.Errorf("拨号: %w", context.Canceled), "canceled"},
+		{errors.New("未知错误"), "other"},
+	}
+	for _, tt := range tests {
+		if got := dialErrorReason(tt.err); got != tt.want {
+			t.Errorf("%v: 期望 %s, 实际 %s", tt.err, tt.want, got)
+		}
+	}
+}
+
+// TestMetricsFormat 测试标签转义和直方图分桶
+func TestMetricsFormat(t *testing.T) {
+	if got := labels("path", "a\"b\\c\nd"); got != `path="a\"b\\c\nd"` {
+		t.Errorf("标签转义错误: %s", got)
+	}
+
+	h := newHistogram([]float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		h.observe(v)
+	}
+	var b strings.Builder
+	h.write(&b, "x")
+	want := "x_bucket{le=\"0.1\"} 2\nx_bucket{le=\"1\"} 3\nx_bucket{le=\"+Inf\"} 4\nx_sum 2.65\nx_count 4\n"
+	if b.String() != want {
+		t.Errorf("直方图输出不匹配:\n期望 %q\n实际 %q", want, b.String())
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertAuthority 本地CA，用于为被拦截的主机动态签发证书
+type CertAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+
+	certFile, keyFile string // LoadOrCreateCA加载的文件
+
+	// MaxCerts 最多缓存的叶子证书数量，超过时淘汰最久未使用的证书，0表示不限制
+	MaxCerts int
+
+	mu       sync.Mutex
+	cache    map[string]*list.Element // 按主机名缓存的叶子证书，值为*leafCert
+	lru      *list.List               // 最近使用的在前
+	inflight map[string]*certIssue
+}
+
+// defaultMaxCerts 默认最多缓存的叶子证书数量，主机名来自客户端的SNI，需要限制
+const defaultMaxCerts = 1024
+
+// leafCert 缓存的叶子证书
+type leafCert struct {
+	host string
+	cert *tls.Certificate
+}
+
+// certIssue 进行中的证书签发，同一主机的并发握手共用一次结果
+type certIssue struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// LoadOrCreateCA 从文件加载CA证书和私钥，文件不存在时生成新的CA并写入磁盘
+func LoadOrCreateCA(certFile, keyFile string) (*CertAuthority, error) {
+	certPEM, certErr := os.ReadFile(certFile)
+	keyPEM, keyErr := os.ReadFile(keyFile)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		var err error
+		certPEM, keyPEM, err = generateCA()
+		if err != nil {
+			return nil, fmt.Errorf("生成CA失败: %v", err)
+		}
+		if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+			return nil, fmt.Errorf("写入CA证书失败: %v", err)
+		}
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return nil, fmt.Errorf("写入CA私钥失败: %v", err)
+		}
+		log.Printf("已生成新的本地CA: %s", certFile)
+	} else if certErr != nil {
+		return nil, fmt.Errorf("读取CA证书失败: %v", certErr)
+	} else if keyErr != nil {
+		return nil, fmt.Errorf("读取CA私钥失败: %v", keyErr)
+	}
+	ca, err := NewCertAuthority(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	ca.certFile, ca.keyFile = certFile, keyFile
+	return ca, nil
+}
+
+// loadedFrom 判断CA是否由LoadOrCreateCA从这两个文件加载，并且证书文件没有被替换
+func (ca *CertAuthority) loadedFrom(certFile, keyFile string) bool {
+	if ca.certFile != certFile || ca.keyFile != keyFile {
+		return false
+	}
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(data)
+	return block != nil && bytes.Equal(block.Bytes, ca.cert.Raw)
+}
+
+// NewCertAuthority 使用PEM格式的证书和私钥创建CA
+func NewCertAuthority(certPEM, keyPEM []byte) (*CertAuthority, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("解析CA证书失败: %v", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("解析CA证书失败: %v", err)
+	}
+	if !cert.IsCA {
+		return nil, errors.New("证书不是CA证书")
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("不支持的CA私钥类型")
+	}
+	return &CertAuthority{
+		cert:     cert,
+		key:      key,
+		MaxCerts: defaultMaxCerts,
+		cache:    make(map[string]*list.Element),
+		lru:      list.New(),
+		inflight: make(map[string]*certIssue),
+	}, nil
+}
+
+// generateCA 生成自签名的CA证书和私钥（PEM格式）
+func generateCA() (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "GoForwardProxy Local CA", Organization: []string{"GoForwardProxy"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// randomSerial 生成128位随机证书序列号
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// Certificate 返回CA证书
+func (ca *CertAuthority) Certificate() *x509.Certificate {
+	return ca.cert
+}
+
+// CertFor 返回指定主机的叶子证书，优先使用缓存。签发在锁外进行，
+// 不同主机的握手互不阻塞，同一主机的并发握手只签发一次
+func (ca *CertAuthority) CertFor(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	ca.mu.Lock()
+	if el, ok := ca.cache[host]; ok {
+		cert := el.Value.(*leafCert).cert
+		if time.Now().Before(cert.Leaf.NotAfter) {
+			ca.lru.MoveToFront(el)
+			ca.mu.Unlock()
+			return cert, nil
+		}
+		ca.lru.Remove(el)
+		delete(ca.cache, host)
+	}
+	issue, ok := ca.inflight[host]
+	if ok {
+		ca.mu.Unlock()
+		<-issue.done
+		return issue.cert, issue.err
+	}
+	issue = &certIssue{done: make(chan struct{})}
+	ca.inflight[host] = issue
+	ca.mu.Unlock()
+
+	issue.cert, issue.err = ca.issue(host)
+
+	ca.mu.Lock()
+	delete(ca.inflight, host)
+	if issue.err == nil {
+		ca.cache[host] = ca.lru.PushFront(&leafCert{host: host, cert: issue.cert})
+		for ca.MaxCerts > 0 && ca.lru.Len() > ca.MaxCerts {
+			oldest := ca.lru.Back()
+			ca.lru.Remove(oldest)
+			delete(ca.cache, oldest.Value.(*leafCert).host)
+		}
+	}
+	ca.mu.Unlock()
+	close(issue.done)
+	return issue.cert, issue.err
+}
+
+// issue 为指定主机签发叶子证书
+func (ca *CertAuthority) issue(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.AddDate(1, 0, 0)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("签发证书失败: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// matchDomain 判断主机名是否匹配域名模式，支持 "*.example.com" 通配符
+func matchDomain(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		return strings.HasSuffix(host, suffix) || host == pattern[2:]
+	}
+	return host == pattern
+}
+
+// shouldIntercept 判断CONNECT目标是否需要进行TLS拦截
+func (p *ForwardProxy) shouldIntercept(hostport string) bool {
+	if p.ca == nil {
+		return false
+	}
+	host := hostOnly(hostport)
+	for _, pattern := range p.mitmBypass {
+		if matchDomain(pattern, host) {
+			return false
+		}
+	}
+	return true
+}
+
+// hostOnly 去掉地址中的端口部分
+func hostOnly(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// mitmReadHeaderTimeout 解密后的连接上读取请求头的超时时间
+const mitmReadHeaderTimeout = 30 * time.Second
+
+// handleMITM 终止客户端TLS并将解密后的请求交给handleHTTP处理
+func (p *ForwardProxy) handleMITM(w http.ResponseWriter, r *http.Request) {
+	if !canAcceptTunnel(w, r) {
+		http.Error(w, "不支持的代理方式", http.StatusInternalServerError)
+		return
+	}
+
+	target := r.URL.Host
+	// 回放模式下解密后的请求不访问上游，不需要检查目标
+	if p.replay == nil {
+		if _, err := p.authorizeTarget(r.Context(), target); err != nil {
+			writeDialError(w, r, err)
+			return
+		}
+	}
+
+	clientConn, wait, err := acceptTunnel(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	// HTTP/2的CONNECT流在解密后的连接关闭前不能结束
+	defer wait()
+
+	info := requestInfoFrom(r.Context())
+	// HTTP/1的CONNECT在解密后的连接仍然打开时就会返回，额外占用一个连接计数直到连接关闭
+	release := func() {}
+	if info.limit != nil {
+		info.limit.retain()
+		var once sync.Once
+		release = func() { once.Do(info.limit.Release) }
+	}
+
+	tlsConn := tls.Server(clientConn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = hostOnly(target)
+			}
+			return p.ca.CertFor(name)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+	hsCtx, cancel := context.WithTimeout(r.Context(), tlsHandshakeTimeout)
+	err = tlsConn.HandshakeContext(hsCtx)
+	cancel()
+	if err != nil {
+		logf(r.Context(), "TLS拦截握手失败 %s: %v", target, err)
+		tlsConn.Close()
+		release()
+		return
+	}
+
+	// 在解密后的连接上提供HTTP服务，支持keep-alive，空闲时与隧道一样按空闲超时关闭
+	server := &http.Server{
+		ReadHeaderTimeout: mitmReadHeaderTimeout,
+		IdleTimeout:       p.tunnelIdleTimeout,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			inner := *info
+			inner.method = req.Method
+			inner.fault = nil
+			req = req.WithContext(withRequestInfo(req.Context(), &inner))
+			req.URL.Scheme = "https"
+			req.URL.Host = target
+			logf(req.Context(), "拦截请求: %s %s", req.Method, req.URL)
+			p.serveObserved(w, req, p.serveIntercepted)
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				release()
+			}
+		},
+	}
+	p.mitmServers.track(server)
+	server.Serve(&oneConnListener{conn: tlsConn})
+}
+
+// serveIntercepted 处理TLS拦截后解密的请求
+func (p *ForwardProxy) serveIntercepted(w http.ResponseWriter, r *http.Request) {
+	if p.injectFault(w, r) {
+		return
+	}
+	p.handleHTTP(w, r)
+}
+
+// oneConnListener 只返回一个连接的监听器，用于在单个连接上运行http.Server
+type oneConnListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn == nil {
+		return nil, io.EOF
+	}
+	return conn, nil
+}
+
+func (l *oneConnListener) Close() error { return nil }
+
+func (l *oneConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
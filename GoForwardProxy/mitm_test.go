@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoadOrCreateCA 测试CA的生成与重新加载
+func TestLoadOrCreateCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.pem")
+	keyFile := filepath.Join(dir, "ca-key.pem")
+
+	ca, err := LoadOrCreateCA(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("生成CA失败: %v", err)
+	}
+	reloaded, err := LoadOrCreateCA(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("重新加载CA失败: %v", err)
+	}
+	if !ca.Certificate().Equal(reloaded.Certificate()) {
+		t.Error("重新加载的CA证书与生成的不一致")
+	}
+
+	leaf, err := ca.CertFor("Example.COM.")
+	if err != nil {
+		t.Fatalf("签发证书失败: %v", err)
+	}
+	if cached, _ := ca.CertFor("example.com"); cached != leaf {
+		t.Error("同一主机的证书未被缓存")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate())
+	if _, err := leaf.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: pool}); err != nil {
+		t.Errorf("叶子证书验证失败: %v", err)
+	}
+}
+
+// TestCertForCache 测试并发签发合并以及按最近使用淘汰叶子证书
+func TestCertForCache(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatalf("生成CA失败: %v", err)
+	}
+	ca.MaxCerts = 2
+
+	// 同一主机的并发握手得到同一张证书
+	certs := make(chan *tls.Certificate, 8)
+	for i := 0; i < cap(certs); i++ {
+		go func() {
+			cert, _ := ca.CertFor("a.example.com")
+			certs <- cert
+		}()
+	}
+	first := <-certs
+	for i := 1; i < cap(certs); i++ {
+		if cert := <-certs; cert != first || cert == nil {
+			t.Fatal("同一主机的并发请求应共用一次签发")
+		}
+	}
+
+	b, _ := ca.CertFor("b.example.com")
+	ca.CertFor("a.example.com") // a最近使用，c加入时淘汰b
+	ca.CertFor("c.example.com")
+	if cert, _ := ca.CertFor("a.example.com"); cert != first {
+		t.Error("最近使用的证书不应被淘汰")
+	}
+	if cert, _ := ca.CertFor("b.example.com"); cert == b {
+		t.Error("最久未使用的证书应被淘汰")
+	}
+}
+
+// TestProxyMITM 测试TLS拦截模式以及bypass列表
+func TestProxyMITM(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "路径 %s", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatalf("生成CA失败: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		bypass     []string
+		wantIssuer string
+	}{
+		{name: "拦截", bypass: nil, wantIssuer: ca.Certificate().Subject.CommonName},
+		{name: "bypass直接隧道", bypass: []string{"127.0.0.1"}, wantIssuer: backend.Certificate().Issuer.CommonName},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := NewForwardProxy()
+			proxy.EnableMITM(ca, tt.bypass)
+			// 拦截模式下代理自己校验上游证书
+			upstreamPool := x509.NewCertPool()
+			upstreamPool.AddCert(backend.Certificate())
+			proxy.SetTLSPolicy(&TLSPolicy{RootCAs: upstreamPool})
+			proxyServer := httptest.NewServer(proxy)
+			defer proxyServer.Close()
+
+			proxyURL, _ := url.Parse(proxyServer.URL)
+			pool := x509.NewCertPool()
+			pool.AddCert(ca.Certificate())
+			pool.AddCert(backend.Certificate())
+			client := &http.Client{
+				Transport: &http.Transport{
+					Proxy:           http.ProxyURL(proxyURL),
+					TLSClientConfig: &tls.Config{RootCAs: pool},
+				},
+				Timeout: 5 * time.Second,
+			}
+
+			resp, err := client.Get(backend.URL + "/hello")
+			if err != nil {
+				t.Fatalf("请求失败: %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "路径 /hello" {
+				t.Errorf("响应内容不正确: %s", body)
+			}
+			issuer := resp.TLS.PeerCertificates[0].Issuer.CommonName
+			if issuer != tt.wantIssuer {
+				t.Errorf("证书签发者不正确, 期望 %q, 实际 %q", tt.wantIssuer, issuer)
+			}
+		})
+	}
+}
+
+// TestMITMIdleTimeout 测试解密后的keep-alive连接按隧道空闲超时关闭
+func TestMITMIdleTimeout(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+	target := strings.TrimPrefix(backend.URL, "https://")
+
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatalf("生成CA失败: %v", err)
+	}
+	proxy := NewForwardProxy()
+	proxy.EnableMITM(ca, nil)
+	proxy.SetTunnelTimeouts(100*time.Millisecond, 0)
+	upstreamPool := x509.NewCertPool()
+	upstreamPool.AddCert(backend.Certificate())
+	proxy.SetTLSPolicy(&TLSPolicy{RootCAs: upstreamPool})
+	proxyURL, _ := newProxyTestClient(t, proxy).Transport.(*http.Transport).Proxy(nil)
+
+	conn, _ := dialConnect(t, proxyURL.Host, target)
+	defer conn.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate())
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"})
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", target)
+	br := bufio.NewReader(tlsConn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("读取拦截的响应失败: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// 空闲超时后代理关闭连接，读取得到EOF而不是截止时间错误
+	tlsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadByte(); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("空闲的拦截连接应被关闭, 实际 %v", err)
+	}
+}
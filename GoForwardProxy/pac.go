@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// pacContentType PAC文件的MIME类型
+const pacContentType = "application/x-ns-proxy-autoconfig"
+
+// PAC 根据路由规则生成代理自动配置脚本：代理会直连的目标让客户端也直连，
+// 其余目标（包括经上级代理转发的）都交给proxyAddr，保证客户端和代理的判断一致。
+// https为true时让客户端通过TLS连接代理
+func (r *Router) PAC(proxyAddr string, https bool) string {
+	var b strings.Builder
+	b.WriteString("// 由GoForwardProxy根据路由规则生成\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\thost = host.toLowerCase();\n")
+	proxy := fmt.Sprintf("PROXY %s", proxyAddr)
+	if https {
+		proxy = fmt.Sprintf("HTTPS %s", proxyAddr)
+	}
+	if r != nil {
+		// 与Router.match一致，按顺序第一条命中的规则生效
+		for i := range r.Routes {
+			route := &r.Routes[i]
+			if len(route.Upstreams) == 0 {
+				continue
+			}
+			action := proxy
+			if route.Upstreams[0].Scheme == "direct" {
+				action = "DIRECT"
+			}
+			conds := pacConditions(route)
+			if len(conds) == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, "\tif (%s)\n\t\treturn %q;\n", strings.Join(conds, " ||\n\t    "), action)
+		}
+	}
+	fmt.Fprintf(&b, "\treturn %q;\n}\n", proxy)
+	return b.String()
+}
+
+// pacConditions 将路由的域名和CIDR转换为PAC中的判断条件
+func pacConditions(route *Route) []string {
+	var conds []string
+	for _, pattern := range route.Domains {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		switch {
+		case pattern == "*":
+			conds = append(conds, "true")
+		case strings.HasPrefix(pattern, "*."):
+			conds = append(conds, fmt.Sprintf("dnsDomainIs(host, %q) || host == %q", pattern[1:], pattern[2:]))
+		default:
+			conds = append(conds, fmt.Sprintf("host == %q", pattern))
+		}
+	}
+	for _, cidr := range route.CIDRs {
+		if ip4 := cidr.IP.To4(); ip4 != nil {
+			conds = append(conds, fmt.Sprintf("isInNet(host, %q, %q)", ip4.String(), net.IP(cidr.Mask).String()))
+		} else {
+			// IPv6只有支持isInNetEx扩展的客户端才能判断
+			conds = append(conds, fmt.Sprintf("(typeof isInNetEx == \"function\" && isInNetEx(host, %q))", cidr.String()))
+		}
+	}
+	return conds
+}
+
+// isLocalRequest 判断请求是否发给代理自身而不是需要转发的目标
+func isLocalRequest(r *http.Request) bool {
+	if r.Method == http.MethodConnect {
+		return false
+	}
+	if !r.URL.IsAbs() {
+		return true
+	}
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && canonicalAddr(r.URL) == local.String()
+}
+
+// handleLocal 处理发给代理自身的请求，提供PAC和WPAD文件
+func (p *ForwardProxy) handleLocal(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/proxy.pac", "/wpad.dat":
+	default:
+		http.Error(w, "这是代理服务器，请配置客户端通过代理访问", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "只允许GET方法", http.StatusMethodNotAllowed)
+		return
+	}
+	proxyAddr := p.pacProxy
+	if proxyAddr == "" {
+		// 使用客户端访问代理时的地址
+		proxyAddr = r.Host
+	}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && proxyAddr == "" {
+		proxyAddr = local.String()
+	}
+	w.Header().Set("Content-Type", pacContentType)
+	w.Header().Set("Cache-Control", "max-age=300")
+	if r.Method == http.MethodGet {
+		fmt.Fprint(w, p.router.PAC(proxyAddr, r.TLS != nil))
+	}
+}
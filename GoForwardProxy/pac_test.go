@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRouterPAC 测试由路由规则生成PAC脚本
+func TestRouterPAC(t *testing.T) {
+	router, err := ParseRoutes([]byte(`
+*.corp.example.com,10.0.0.0/8,fd00::/8 DIRECT
+*.example.com http://parent:3128
+intranet DIRECT
+`))
+	if err != nil {
+		t.Fatalf("解析路由规则失败: %v", err)
+	}
+	pac := router.PAC("proxy.local:8080", false)
+
+	wants := []string{
+		"function FindProxyForURL(url, host) {",
+		`dnsDomainIs(host, ".corp.example.com") || host == "corp.example.com"`,
+		`isInNet(host, "10.0.0.0", "255.0.0.0")`,
+		`isInNetEx(host, "fd00::/8")`,
+		`host == "intranet"`,
+		`return "DIRECT";`,
+		`return "PROXY proxy.local:8080";`,
+	}
+	for _, want := range wants {
+		if !strings.Contains(pac, want) {
+			t.Errorf("PAC中缺少 %q:\n%s", want, pac)
+		}
+	}
+	// 规则顺序与路由匹配顺序一致
+	if strings.Index(pac, "corp.example.com") > strings.Index(pac, `".example.com"`) {
+		t.Errorf("PAC规则顺序与路由规则不一致:\n%s", pac)
+	}
+
+	if pac := (*Router)(nil).PAC("proxy.local:8080", false); !strings.Contains(pac, `return "PROXY proxy.local:8080";`) {
+		t.Errorf("没有路由规则时应全部走代理:\n%s", pac)
+	}
+	if pac := router.PAC("proxy.local:8443", true); !strings.Contains(pac, `return "HTTPS proxy.local:8443";`) || strings.Contains(pac, "PROXY") {
+		t.Errorf("HTTPS代理应使用HTTPS指令:\n%s", pac)
+	}
+}
+
+// TestServePAC 测试代理自身提供PAC和WPAD文件，且不需要代理认证
+func TestServePAC(t *testing.T) {
+	proxy := NewForwardProxy()
+	users, _ := ParseHtpasswd([]byte("alice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n"))
+	proxy.SetAuthenticator(&BasicAuth{Realm: "test", Store: users})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	host := strings.TrimPrefix(proxyServer.URL, "http://")
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/proxy.pac", http.StatusOK},
+		{"/wpad.dat", http.StatusOK},
+		{"/other", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get(proxyServer.URL + tt.path)
+			if err != nil {
+				t.Fatalf("请求失败: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("状态码不匹配, 期望 %d, 实际 %d", tt.wantStatus, resp.StatusCode)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != pacContentType {
+				t.Errorf("Content-Type不匹配: %s", ct)
+			}
+			if !strings.Contains(string(body), "PROXY "+host) {
+				t.Errorf("PAC中的代理地址应为 %s:\n%s", host, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"goproxycommon/proxyproto"
+)
+
+// SetProxyProtocol 设置向哪些隧道目标发送PROXY协议头，version为1或2，0表示不发送
+func (p *ForwardProxy) SetProxyProtocol(version int, hosts []string) error {
+	if version != 0 && version != 1 && version != 2 {
+		return fmt.Errorf("不支持的PROXY协议版本: %d", version)
+	}
+	p.proxyProtoVersion = version
+	p.proxyProtoHosts = hosts
+	return nil
+}
+
+// sendsProxyHeader 判断隧道目标是否需要PROXY协议头
+func (p *ForwardProxy) sendsProxyHeader(addr string) bool {
+	if p.proxyProtoVersion == 0 {
+		return false
+	}
+	host := hostOnly(addr)
+	for _, pattern := range p.proxyProtoHosts {
+		if matchDomain(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialTunnel 连接CONNECT或SOCKS5隧道的目标，目标需要时先发送PROXY协议头告知真实的客户端地址。
+// 经上级代理连接时协议头中的目标地址为上级代理的地址
+func (p *ForwardProxy) dialTunnel(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := p.dialContext(ctx, "tcp", addr)
+	if err != nil || !p.sendsProxyHeader(addr) {
+		return conn, err
+	}
+	var src net.Addr
+	if info := requestInfoFrom(ctx); info != nil {
+		if a, err := net.ResolveTCPAddr("tcp", info.client); err == nil {
+			src = a
+		}
+	}
+	if err := proxyproto.WriteHeader(conn, p.proxyProtoVersion, src, conn.RemoteAddr()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("发送PROXY协议头失败: %v", err)
+	}
+	return conn, nil
+}
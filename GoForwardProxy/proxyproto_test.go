@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"goproxycommon/proxyproto"
+)
+
+// startProxyProtoEcho 启动读取PROXY协议头并返回其中客户端地址的服务器
+func startProxyProtoEcho(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				h, err := proxyproto.Read(bufio.NewReader(conn))
+				if err != nil || h == nil {
+					fmt.Fprint(conn, "no header\n")
+					return
+				}
+				fmt.Fprintf(conn, "v%d %s\n", h.Version, h.Source)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// TestProxyProtocol 测试监听器解析负载均衡器的PROXY协议头，并向隧道目标发送真实客户端地址
+func TestProxyProtocol(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer backend.Close()
+	echoAddr := startProxyProtoEcho(t)
+
+	proxy := NewForwardProxy()
+	if err := proxy.SetProxyProtocol(1, []string{"127.0.0.1"}); err != nil {
+		t.Fatalf("设置PROXY协议失败: %v", err)
+	}
+	trusted, _ := proxyproto.ParseCIDRs("127.0.0.1")
+	l, err := listen("127.0.0.1:0", trusted)
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	server := &http.Server{Handler: proxy}
+	go server.Serve(l)
+	defer server.Close()
+
+	// dialLB 模拟负载均衡器，先发送PROXY协议头
+	dialLB := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("连接代理失败: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		proxyproto.WriteHeader(conn, 2,
+			&net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 40000},
+			&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 8080})
+		return conn, bufio.NewReader(conn)
+	}
+
+	t.Run("HTTP请求", func(t *testing.T) {
+		conn, br := dialLB()
+		fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", backend.URL, strings.TrimPrefix(backend.URL, "http://"))
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("读取响应失败: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "203.0.113.9" {
+			t.Errorf("X-Forwarded-For应为真实客户端地址, 实际 %q", body)
+		}
+	})
+
+	t.Run("CONNECT隧道", func(t *testing.T) {
+		conn, br := dialLB()
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echoAddr, echoAddr)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT失败: %v", err)
+		}
+		line, _ := br.ReadString('\n')
+		if line != "v1 203.0.113.9:40000\n" {
+			t.Errorf("隧道目标收到的协议头不正确: %q", line)
+		}
+	})
+}
+
+// TestSendsProxyHeader 测试只向匹配的隧道目标发送协议头
+func TestSendsProxyHeader(t *testing.T) {
+	proxy := NewForwardProxy()
+	if err := proxy.SetProxyProtocol(3, nil); err == nil {
+		t.Error("不支持的版本应返回错误")
+	}
+	proxy.SetProxyProtocol(2, []string{"*.internal.example.com", "10.0.0.5"})
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"db.internal.example.com:5432", true},
+		{"10.0.0.5:22", true},
+		{"www.example.com:443", false},
+	}
+	for _, tt := range tests {
+		if got := proxy.sendsProxyHeader(tt.addr); got != tt.want {
+			t.Errorf("%s: 期望 %v, 实际 %v", tt.addr, tt.want, got)
+		}
+	}
+}
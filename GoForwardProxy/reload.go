@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// configPollInterval 检查配置文件是否修改的间隔
+const configPollInterval = 2 * time.Second
+
+// Reloader 持有当前生效的配置和代理实例，把请求交给当前实例处理。
+// 重新加载时先完整检查并创建新实例，成功后原子替换；进行中的请求和隧道继续使用旧实例，不会被中断
+type Reloader struct {
+	args  []string // 原始命令行参数，重新加载时仍然覆盖配置文件
+	proxy atomic.Pointer[ForwardProxy]
+	cert  atomic.Pointer[tls.Certificate] // HTTPS代理的证书，未开启时为nil
+
+	mu      sync.Mutex
+	socks   *SOCKS5Server // 非空时重新加载后同步更新
+	config  *Config
+	started *Config   // 启动时的配置，用于提示需要重启的修改
+	loaded  fileStamp // 最近一次加载时配置文件的状态
+}
+
+// fileStamp 用于判断文件是否被修改
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// stampFile 返回文件当前的状态，文件不存在时返回零值
+func stampFile(path string) fileStamp {
+	st, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: st.ModTime(), size: st.Size()}
+}
+
+func (s fileStamp) equal(o fileStamp) bool {
+	return s.modTime.Equal(o.modTime) && s.size == o.size
+}
+
+// NewReloader 创建Reloader，config和proxy为启动时加载的配置和代理实例
+func NewReloader(args []string, config *Config, proxy *ForwardProxy) *Reloader {
+	r := &Reloader{args: args, config: config, started: config}
+	if config.File != "" {
+		r.loaded = stampFile(config.File)
+	}
+	r.proxy.Store(proxy)
+	return r
+}
+
+// SetSOCKS5Server 设置重新加载时需要同步更新的SOCKS5服务器
+func (r *Reloader) SetSOCKS5Server(socks *SOCKS5Server) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.socks = socks
+}
+
+// Proxy 返回当前生效的代理实例
+func (r *Reloader) Proxy() *ForwardProxy {
+	return r.proxy.Load()
+}
+
+// Config 返回当前生效的配置
+func (r *Reloader) Config() *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.config
+}
+
+// ServeHTTP 使用当前的代理实例处理请求
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.proxy.Load().ServeHTTP(w, req)
+}
+
+// SetCertificate 设置HTTPS代理的证书
+func (r *Reloader) SetCertificate(cert *tls.Certificate) {
+	r.cert.Store(cert)
+}
+
+// GetCertificate 返回当前的HTTPS代理证书，用作tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := r.cert.Load()
+	if cert == nil {
+		return nil, fmt.Errorf("没有配置HTTPS代理证书")
+	}
+	return cert, nil
+}
+
+// Reload 重新读取配置文件和命令行参数，检查失败时保留原配置并返回错误
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.config.File != "" {
+		r.loaded = stampFile(r.config.File)
+	}
+	config, err := LoadConfig(r.args)
+	if err != nil {
+		return err
+	}
+	cert, err := config.listenCertificate()
+	if err != nil {
+		return err
+	}
+	old := r.proxy.Load()
+	proxy, users, err := config.NewProxy(old)
+	if err != nil {
+		return err
+	}
+	for _, name := range config.restartRequired(r.started) {
+		log.Printf("配置项 %s 的修改需要重启才能生效", name)
+	}
+
+	r.proxy.Store(proxy)
+	// 新证书只对之后的TLS握手生效，已建立的连接不受影响
+	if cert != nil {
+		r.cert.Store(cert)
+	}
+	if r.socks != nil {
+		r.socks.Update(proxy, users)
+	}
+	r.config = config
+	// 旧实例上进行中的请求不受影响，只关闭它的空闲上游连接
+	old.client.Transport.(*http.Transport).CloseIdleConnections()
+	return nil
+}
+
+// reload 重新加载配置并输出结果
+func (r *Reloader) reload(reason string) {
+	if err := r.Reload(); err != nil {
+		log.Printf("%s，重新加载配置失败，继续使用原配置: %v", reason, err)
+		return
+	}
+	log.Printf("%s，配置已重新加载", reason)
+}
+
+// Watch 每隔interval检查配置文件，与最近一次加载时相比修改时间或大小变化后重新加载，
+// stop关闭时返回。没有配置文件时直接返回
+func (r *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	path := r.Config().File
+	if path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		changed := !stampFile(path).equal(r.loaded)
+		r.mu.Unlock()
+		if changed {
+			r.reload("配置文件 " + path + " 已修改")
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReload 测试重新加载配置：新配置对新请求生效，已建立的隧道不受影响，无效配置不生效
+func TestReload(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Via"))
+	}))
+	defer backend.Close()
+	echoAddr := startEchoServer(t)
+
+	dir := t.TempDir()
+	allowACL := filepath.Join(dir, "allow.txt")
+	denyACL := filepath.Join(dir, "deny.txt")
+	os.WriteFile(allowACL, []byte("allow\n"), 0o644)
+	os.WriteFile(denyACL, []byte("deny cidr=127.0.0.0/8 reason=已禁止\nallow\n"), 0o644)
+	configPath := filepath.Join(dir, "proxy.json")
+	writeFile := func(content string) {
+		if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+			t.Fatalf("写入配置文件失败: %v", err)
+		}
+	}
+	writeFile(fmt.Sprintf(`{"acl": %q, "via": "file-a"}`, allowACL))
+
+	args := []string{"-config", configPath, "-tunnel-idle", "1m"}
+	config, err := LoadConfig(args)
+	if err != nil {
+		t.Fatalf("加载配置失败: %v", err)
+	}
+	proxy, _, err := config.NewProxy(nil)
+	if err != nil {
+		t.Fatalf("创建代理失败: %v", err)
+	}
+	reloader := NewReloader(args, config, proxy)
+	proxyServer := httptest.NewServer(reloader)
+	defer proxyServer.Close()
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	get := func() (int, string) {
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatalf("请求失败: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if status, via := get(); status != http.StatusOK || !strings.Contains(via, "file-a") {
+		t.Fatalf("初始配置未生效: %d %q", status, via)
+	}
+
+	// 建立隧道后修改配置
+	conn, br := dialConnect(t, proxyURL.Host, echoAddr)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	writeFile(fmt.Sprintf(`{"acl": %q, "via": "file-b"}`, denyACL))
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("重新加载失败: %v", err)
+	}
+	if reloader.Proxy() == proxy {
+		t.Fatal("重新加载后应替换代理实例")
+	}
+	if status, _ := get(); status != http.StatusForbidden {
+		t.Errorf("新的访问控制规则未生效, 状态码 %d", status)
+	}
+	if reloader.Config().Timeouts.TunnelIdle != Duration(time.Minute) {
+		t.Error("重新加载后命令行参数应继续覆盖配置文件")
+	}
+
+	// 原有隧道继续工作，并且仍然可以通过新实例管理
+	fmt.Fprint(conn, "ping\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Errorf("重新加载后隧道中断: %q %v", line, err)
+	}
+	if n := reloader.Proxy().tunnels.Len(); n != 1 {
+		t.Errorf("新实例应沿用活跃隧道, 实际 %d 个", n)
+	}
+
+	// 无效配置不生效
+	current := reloader.Proxy()
+	writeFile(`{"acl": "/nonexistent/acl.txt"}`)
+	if err := reloader.Reload(); err == nil {
+		t.Error("无效配置应返回错误")
+	}
+	writeFile(`{"via": `)
+	if err := reloader.Reload(); err == nil {
+		t.Error("格式错误的配置应返回错误")
+	}
+	if reloader.Proxy() != current {
+		t.Error("重新加载失败时应保留原代理实例")
+	}
+}
+
+// TestReloadWatch 测试配置文件修改后自动重新加载
+func TestReloadWatch(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "proxy.yaml")
+	os.WriteFile(configPath, []byte("via: watch-a\n"), 0o644)
+	args := []string{"-config", configPath}
+	config, err := LoadConfig(args)
+	if err != nil {
+		t.Fatalf("加载配置失败: %v", err)
+	}
+	proxy, _, err := config.NewProxy(nil)
+	if err != nil {
+		t.Fatalf("创建代理失败: %v", err)
+	}
+	reloader := NewReloader(args, config, proxy)
+	stop := make(chan struct{})
+	defer close(stop)
+	go reloader.Watch(10*time.Millisecond, stop)
+
+	os.WriteFile(configPath, []byte("via: watch-b-longer\n"), 0o644)
+	deadline := time.Now().Add(2 * time.Second)
+	for reloader.Proxy().viaName != "watch-b-longer" {
+		if time.Now().After(deadline) {
+			t.Fatalf("配置文件修改后没有重新加载, Via标识 %q", reloader.Proxy().viaName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestReloadCertificate 测试重新加载配置时更新HTTPS代理证书，证书无效时保留原证书
+func TestReloadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "proxy.pem")
+	keyFile := filepath.Join(dir, "proxy-key.pem")
+	writePair := func() (certPEM, keyPEM []byte) {
+		certPEM, keyPEM, err := generateCA()
+		if err != nil {
+			t.Fatalf("生成证书失败: %v", err)
+		}
+		os.WriteFile(certFile, certPEM, 0o644)
+		os.WriteFile(keyFile, keyPEM, 0o600)
+		return certPEM, keyPEM
+	}
+	current := func(r *Reloader) []byte {
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("获取证书失败: %v", err)
+		}
+		return cert.Certificate[0]
+	}
+	der := func(certPEM []byte) []byte {
+		block, _ := pem.Decode(certPEM)
+		return block.Bytes
+	}
+
+	certA, _ := writePair()
+	args := []string{"-listen", "127.0.0.1:0", "-tls-cert", certFile, "-tls-key", keyFile}
+	config, err := LoadConfig(args)
+	if err != nil {
+		t.Fatalf("加载配置失败: %v", err)
+	}
+	proxy, _, err := config.NewProxy(nil)
+	if err != nil {
+		t.Fatalf("创建代理失败: %v", err)
+	}
+	reloader := NewReloader(args, config, proxy)
+	if _, err := reloader.GetCertificate(nil); err == nil {
+		t.Error("没有设置证书时应返回错误")
+	}
+	cert, err := config.listenCertificate()
+	if err != nil {
+		t.Fatalf("加载证书失败: %v", err)
+	}
+	reloader.SetCertificate(cert)
+	if !bytes.Equal(current(reloader), der(certA)) {
+		t.Fatal("证书与文件不一致")
+	}
+
+	certB, keyB := writePair()
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("重新加载失败: %v", err)
+	}
+	if !bytes.Equal(current(reloader), der(certB)) {
+		t.Error("重新加载后应使用新证书")
+	}
+
+	// 证书与私钥不匹配
+	os.WriteFile(keyFile, keyB, 0o600)
+	os.WriteFile(certFile, certA, 0o644)
+	if err := reloader.Reload(); err == nil {
+		t.Error("证书与私钥不匹配时应返回错误")
+	}
+	if !bytes.Equal(current(reloader), der(certB)) {
+		t.Error("重新加载失败时应保留原证书")
+	}
+}
+
+// TestReloadKeepsResolverAndCA 测试重新加载时DNS和CA设置未修改则沿用原来的解析器和CA，静态主机记录仍然更新
+func TestReloadKeepsResolverAndCA(t *testing.T) {
+	dir := t.TempDir()
+	hostsFile := filepath.Join(dir, "hosts")
+	os.WriteFile(hostsFile, []byte("10.0.0.1 a.test\n"), 0o644)
+	caCert := filepath.Join(dir, "ca.pem")
+	caKey := filepath.Join(dir, "ca-key.pem")
+	configPath := filepath.Join(dir, "proxy.json")
+	writeConfig := func(negativeTTL string) {
+		content := fmt.Sprintf(`{"upstream": {"hosts": %q, "dns_negative_ttl": %q}, "mitm": {"enabled": true, "ca_cert": %q, "ca_key": %q}}`,
+			hostsFile, negativeTTL, caCert, caKey)
+		if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+			t.Fatalf("写入配置文件失败: %v", err)
+		}
+	}
+	writeConfig("10s")
+	args := []string{"-config", configPath}
+	config, err := LoadConfig(args)
+	if err != nil {
+		t.Fatalf("加载配置失败: %v", err)
+	}
+	proxy, _, err := config.NewProxy(nil)
+	if err != nil {
+		t.Fatalf("创建代理失败: %v", err)
+	}
+	reloader := NewReloader(args, config, proxy)
+
+	os.WriteFile(hostsFile, []byte("10.0.0.2 a.test\n"), 0o644)
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("重新加载失败: %v", err)
+	}
+	reloaded := reloader.Proxy()
+	if reloaded.resolver != proxy.resolver {
+		t.Error("DNS设置未修改时应沿用原来的解析器")
+	}
+	if reloaded.ca != proxy.ca {
+		t.Error("CA文件未修改时应沿用原来的CA")
+	}
+	if ips, _ := reloaded.lookupIP(context.Background(), "a.test"); len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("静态主机记录应被更新, 实际 %v", ips)
+	}
+
+	// 设置修改后重新创建
+	writeConfig("20s")
+	os.Remove(caCert)
+	os.Remove(caKey)
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("重新加载失败: %v", err)
+	}
+	if reloader.Proxy().resolver == proxy.resolver {
+		t.Error("DNS设置修改后应创建新的解析器")
+	}
+	if reloader.Proxy().ca == proxy.ca {
+		t.Error("CA文件替换后应重新加载CA")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 缓存解析器的默认参数
+const (
+	defaultDNSTTL         = time.Minute      // 上游没有提供TTL时的缓存时间
+	defaultDNSNegativeTTL = 10 * time.Second // 域名不存在时的缓存时间
+	defaultDNSMaxTTL      = time.Hour        // 缓存时间上限
+	defaultDNSMaxEntries  = 10000            // 缓存条目上限
+)
+
+// Resolver 将主机名解析为IP地址
+type Resolver interface {
+	// Resolve 返回host的IP地址以及结果可以缓存的时间，ttl为0表示未知。
+	// 域名不存在时返回IsNotFound为true的*net.DNSError，ttl为否定缓存时间
+	Resolve(ctx context.Context, host string) (ips []net.IP, ttl time.Duration, err error)
+}
+
+// SystemResolver 使用系统解析器，不提供TTL
+type SystemResolver struct{}
+
+// Resolve 通过net.DefaultResolver解析主机名
+func (SystemResolver) Resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, 0, nil
+}
+
+// CachingResolver 带缓存的解析器，遵守上游返回的TTL，并缓存域名不存在的结果。
+// Hosts中的静态记录优先于上游解析
+type CachingResolver struct {
+	Upstream    Resolver
+	DefaultTTL  time.Duration // 上游没有提供TTL时的缓存时间
+	NegativeTTL time.Duration // 上游没有提供否定缓存时间时使用
+	MaxTTL      time.Duration // 缓存时间上限
+	MaxEntries  int           // 缓存条目上限
+
+	mu       sync.Mutex
+	hosts    map[string][]net.IP
+	entries  map[string]*dnsEntry
+	inflight map[string]*dnsLookup
+}
+
+// dnsEntry 缓存的解析结果
+type dnsEntry struct {
+	ips     []net.IP
+	err     error // 非nil时为否定缓存
+	expires time.Time
+}
+
+// dnsLookup 进行中的上游查询，同一主机的并发查询共用一次结果
+type dnsLookup struct {
+	done chan struct{}
+	ips  []net.IP
+	ttl  time.Duration // 结果的缓存时间，未缓存时为0
+	err  error
+}
+
+// NewCachingResolver 创建带缓存的解析器，upstream为nil时使用系统解析器
+func NewCachingResolver(upstream Resolver) *CachingResolver {
+	if upstream == nil {
+		upstream = SystemResolver{}
+	}
+	return &CachingResolver{
+		Upstream:    upstream,
+		DefaultTTL:  defaultDNSTTL,
+		NegativeTTL: defaultDNSNegativeTTL,
+		MaxTTL:      defaultDNSMaxTTL,
+		MaxEntries:  defaultDNSMaxEntries,
+		entries:     make(map[string]*dnsEntry),
+		inflight:    make(map[string]*dnsLookup),
+	}
+}
+
+// sameSettings 判断两个解析器的上游和缓存参数是否相同，不比较静态记录
+func (r *CachingResolver) sameSettings(other *CachingResolver) bool {
+	return reflect.DeepEqual(r.Upstream, other.Upstream) &&
+		r.DefaultTTL == other.DefaultTTL && r.NegativeTTL == other.NegativeTTL &&
+		r.MaxTTL == other.MaxTTL && r.MaxEntries == other.MaxEntries
+}
+
+// SetHosts 替换静态主机记录，键为小写主机名
+func (r *CachingResolver) SetHosts(hosts map[string][]net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts = hosts
+}
+
+// normalizeHost 统一主机名的大小写和末尾的点
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// Resolve 优先返回静态记录和未过期的缓存，否则查询上游
+func (r *CachingResolver) Resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	key := normalizeHost(host)
+	now := time.Now()
+
+	r.mu.Lock()
+	if ips, ok := r.hosts[key]; ok {
+		r.mu.Unlock()
+		return ips, 0, nil
+	}
+	if e, ok := r.entries[key]; ok && now.Before(e.expires) {
+		r.mu.Unlock()
+		return e.ips, e.expires.Sub(now), e.err
+	}
+	lookup, ok := r.inflight[key]
+	if !ok {
+		lookup = &dnsLookup{done: make(chan struct{})}
+		r.inflight[key] = lookup
+		// 查询不随单个请求取消，结果供所有等待者使用
+		go r.lookup(key, lookup)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-lookup.done:
+		return lookup.ips, lookup.ttl, lookup.err
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+// lookup 查询上游并写入缓存
+func (r *CachingResolver) lookup(key string, lookup *dnsLookup) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ips, ttl, err := r.Upstream.Resolve(ctx, key)
+	lookup.ips, lookup.err = ips, err
+
+	var dnsErr *net.DNSError
+	notFound := errors.As(err, &dnsErr) && dnsErr.IsNotFound
+	if ttl <= 0 {
+		ttl = r.DefaultTTL
+		if notFound {
+			ttl = r.NegativeTTL
+		}
+	}
+	if r.MaxTTL > 0 && ttl > r.MaxTTL {
+		ttl = r.MaxTTL
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.inflight, key)
+	// 超时等临时错误不缓存
+	if (err == nil || notFound) && ttl > 0 {
+		r.evict()
+		r.entries[key] = &dnsEntry{ips: ips, err: err, expires: time.Now().Add(ttl)}
+		lookup.ttl = ttl
+	}
+	close(lookup.done)
+}
+
+// evict 缓存已满时清除过期条目，仍然已满时随机清除一条，调用者需持有r.mu
+func (r *CachingResolver) evict() {
+	if r.MaxEntries <= 0 || len(r.entries) < r.MaxEntries {
+		return
+	}
+	now := time.Now()
+	for key, e := range r.entries {
+		if !now.Before(e.expires) {
+			delete(r.entries, key)
+		}
+	}
+	for key := range r.entries {
+		if len(r.entries) < r.MaxEntries {
+			break
+		}
+		delete(r.entries, key)
+	}
+}
+
+// ParseHosts 解析hosts格式的静态记录，每行为 "IP 主机名 [主机名...]"
+func ParseHosts(data []byte) (map[string][]net.IP, error) {
+	hosts := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("第%d行: 缺少主机名", line)
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("第%d行: 无效的IP地址: %s", line, fields[0])
+		}
+		for _, name := range fields[1:] {
+			name = normalizeHost(name)
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// LoadHosts 从文件加载静态主机记录
+func LoadHosts(path string) (map[string][]net.IP, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取主机记录失败: %v", err)
+	}
+	return ParseHosts(data)
+}
+
+// lookupIP 解析主机名，IP地址直接返回
+func (p *ForwardProxy) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, _, err := p.lookupIPTTL(ctx, host)
+	return ips, err
+}
+
+// lookupIPTTL 同lookupIP，同时返回结果还可以使用的时间，0表示未知
+func (p *ForwardProxy) lookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+	ips, ttl, err := p.resolver.Resolve(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(ips) == 0 {
+		return nil, 0, &net.DNSError{Err: "没有可用的地址", Name: host, IsNotFound: true}
+	}
+	return ips, ttl, nil
+}
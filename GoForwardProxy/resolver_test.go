@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingResolver 记录查询次数的解析器
+type countingResolver struct {
+	calls int32
+	ips   []net.IP
+	ttl   time.Duration
+	err   error
+}
+
+func (r *countingResolver) Resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	atomic.AddInt32(&r.calls, 1)
+	return r.ips, r.ttl, r.err
+}
+
+// TestCachingResolver 测试缓存、TTL过期、否定缓存和静态记录
+func TestCachingResolver(t *testing.T) {
+	notFound := &net.DNSError{Err: "no such host", Name: "missing.test", IsNotFound: true}
+	tests := []struct {
+		name      string
+		upstream  *countingResolver
+		host      string
+		wait      time.Duration // 两次查询之间的等待时间
+		wantCalls int32
+		wantErr   bool
+	}{
+		{"TTL内命中缓存", &countingResolver{ips: []net.IP{net.IPv4(10, 0, 0, 1)}, ttl: time.Minute}, "a.test", 0, 1, false},
+		{"TTL过期后重新查询", &countingResolver{ips: []net.IP{net.IPv4(10, 0, 0, 1)}, ttl: 50 * time.Millisecond}, "a.test", 100 * time.Millisecond, 2, false},
+		{"否定缓存", &countingResolver{err: notFound}, "missing.test", 0, 1, true},
+		{"临时错误不缓存", &countingResolver{err: &net.DNSError{Err: "timeout", IsTimeout: true}}, "a.test", 0, 2, true},
+		{"静态记录不查询上游", &countingResolver{}, "Staging.Example.COM.", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewCachingResolver(tt.upstream)
+			r.SetHosts(map[string][]net.IP{"staging.example.com": {net.IPv4(127, 0, 0, 1)}})
+			for i := 0; i < 2; i++ {
+				if i == 1 {
+					time.Sleep(tt.wait)
+				}
+				_, _, err := r.Resolve(context.Background(), tt.host)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("第%d次查询错误不匹配: %v", i+1, err)
+				}
+			}
+			if calls := atomic.LoadInt32(&tt.upstream.calls); calls != tt.wantCalls {
+				t.Errorf("上游查询次数不匹配, 期望 %d, 实际 %d", tt.wantCalls, calls)
+			}
+		})
+	}
+}
+
+// TestParseHosts 测试hosts格式解析
+func TestParseHosts(t *testing.T) {
+	hosts, err := ParseHosts([]byte("# 测试环境\n127.0.0.1 api.example.com API2.example.com # 本地替身\n\n::1 api.example.com\n"))
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if got := fmt.Sprint(hosts["api.example.com"]); got != "[127.0.0.1 ::1]" {
+		t.Errorf("api.example.com 记录不匹配: %s", got)
+	}
+	if got := fmt.Sprint(hosts["api2.example.com"]); got != "[127.0.0.1]" {
+		t.Errorf("api2.example.com 记录不匹配: %s", got)
+	}
+	for _, bad := range []string{"api.example.com", "not-an-ip api.example.com"} {
+		if _, err := ParseHosts([]byte(bad)); err == nil {
+			t.Errorf("%q 应该解析失败", bad)
+		}
+	}
+}
+
+// TestProxyHostsOverride 测试通过静态记录把域名指向本地服务
+func TestProxyHostsOverride(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "host=%s", r.Host)
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	resolver := NewCachingResolver(&countingResolver{err: &net.DNSError{Err: "no such host", IsNotFound: true}})
+	resolver.SetHosts(map[string][]net.IP{"api.example.com": {net.IPv4(127, 0, 0, 1)}})
+	proxy := NewForwardProxy()
+	proxy.SetResolver(resolver)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+	resp, err := client.Get("http://api.example.com:" + port + "/")
+	if err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "host=api.example.com:"+port {
+		t.Errorf("响应不匹配: %d %q", resp.StatusCode, body)
+	}
+}
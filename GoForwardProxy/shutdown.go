@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultShutdownGrace 收到退出信号后等待请求和隧道结束的默认时间
+const defaultShutdownGrace = 30 * time.Second
+
+// shutdownPollInterval 等待隧道结束时的检查间隔
+const shutdownPollInterval = 100 * time.Millisecond
+
+// serverSet 记录HTTPS拦截会话中在单个连接上运行的http.Server，退出时一并关闭
+type serverSet struct {
+	mu      sync.Mutex
+	servers map[*http.Server]struct{}
+}
+
+// track 登记server，其连接关闭或被劫持后自动移除
+func (s *serverSet) track(server *http.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.servers == nil {
+		s.servers = make(map[*http.Server]struct{})
+	}
+	s.servers[server] = struct{}{}
+	// 保留server原有的ConnState回调
+	prev := server.ConnState
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed || state == http.StateHijacked {
+			s.mu.Lock()
+			delete(s.servers, server)
+			s.mu.Unlock()
+		}
+		if prev != nil {
+			prev(conn, state)
+		}
+	}
+}
+
+// shutdown 优雅关闭所有登记的server，ctx结束时强制关闭，返回被强制关闭的数量
+func (s *serverSet) shutdown(ctx context.Context) int {
+	s.mu.Lock()
+	servers := make([]*http.Server, 0, len(s.servers))
+	for server := range s.servers {
+		servers = append(servers, server)
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	dropped := 0
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+				mu.Lock()
+				dropped++
+				mu.Unlock()
+			}
+		}(server)
+	}
+	wg.Wait()
+	return dropped
+}
+
+// DrainTunnels 等待所有隧道自然结束，ctx结束时强制关闭剩余隧道，返回它们关闭前的状态
+func (p *ForwardProxy) DrainTunnels(ctx context.Context) []TunnelInfo {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for p.tunnels.Len() > 0 {
+		select {
+		case <-ctx.Done():
+			remaining := p.tunnels.List()
+			dropped := make([]TunnelInfo, 0, len(remaining))
+			for _, t := range remaining {
+				dropped = append(dropped, t.Info())
+				t.closeWithReason("服务关闭")
+			}
+			return dropped
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// ShutdownSummary 退出时被强制中断的连接
+type ShutdownSummary struct {
+	HTTPInterrupted bool         // 是否有普通HTTP请求未在宽限期内完成
+	MITMSessions    int          // 被强制关闭的HTTPS拦截会话数
+	Tunnels         []TunnelInfo // 被强制关闭的隧道
+}
+
+// Shutdown 停止接受新连接，在ctx结束前等待进行中的请求、拦截会话和隧道完成，
+// 超时后强制关闭剩余连接。server和socks为nil时跳过
+func (p *ForwardProxy) Shutdown(ctx context.Context, server *http.Server, socks *SOCKS5Server) ShutdownSummary {
+	var summary ShutdownSummary
+	if socks != nil {
+		socks.Close()
+	}
+	// http.Server.Shutdown不等待被劫持的连接，隧道和拦截会话单独处理
+	var wg sync.WaitGroup
+	if server != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+				summary.HTTPInterrupted = true
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		summary.MITMSessions = p.mitmServers.shutdown(ctx)
+	}()
+	summary.Tunnels = p.DrainTunnels(ctx)
+	wg.Wait()
+	return summary
+}
+
+// logShutdownSummary 输出退出时被中断的连接
+func logShutdownSummary(summary ShutdownSummary) {
+	if !summary.HTTPInterrupted && summary.MITMSessions == 0 && len(summary.Tunnels) == 0 {
+		log.Printf("所有连接已正常结束")
+		return
+	}
+	if summary.HTTPInterrupted {
+		log.Printf("宽限期内仍有HTTP请求未完成，已强制关闭")
+	}
+	if summary.MITMSessions > 0 {
+		log.Printf("强制关闭了%d个HTTPS拦截会话", summary.MITMSessions)
+	}
+	if len(summary.Tunnels) > 0 {
+		var bytesIn, bytesOut int64
+		for _, t := range summary.Tunnels {
+			bytesIn += t.BytesIn
+			bytesOut += t.BytesOut
+			log.Printf("  隧道#%d %s -> %s，用户 %q，时长 %s，上行 %d 字节，下行 %d 字节", t.ID, t.Client, t.Target, t.User, t.Duration, t.BytesIn, t.BytesOut)
+		}
+		log.Printf("强制关闭了%d个隧道，共上行 %d 字节，下行 %d 字节", len(summary.Tunnels), bytesIn, bytesOut)
+	}
+}
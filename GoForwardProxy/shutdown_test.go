@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startProxyServer 在随机端口上启动http.Server形式的代理
+func startProxyServer(t *testing.T, proxy *ForwardProxy) (*http.Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	server := &http.Server{Handler: proxy}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return server, l.Addr().String()
+}
+
+// TestShutdownDrainsTunnels 测试宽限期内结束的隧道不会被强制关闭
+func TestShutdownDrainsTunnels(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	proxy := NewForwardProxy()
+	server, addr := startProxyServer(t, proxy)
+
+	conn, _ := dialConnect(t, addr, echoAddr)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	summary := proxy.Shutdown(ctx, server, nil)
+	if summary.HTTPInterrupted || len(summary.Tunnels) != 0 {
+		t.Errorf("不应有被强制关闭的连接: %+v", summary)
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Error("关闭后不应再接受新连接")
+	}
+}
+
+// TestShutdownForceClosesTunnels 测试超过宽限期的隧道被强制关闭并记录在汇总中
+func TestShutdownForceClosesTunnels(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	proxy := NewForwardProxy()
+	server, addr := startProxyServer(t, proxy)
+	socks := NewSOCKS5Server(proxy, nil)
+	socksListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- socks.Serve(socksListener) }()
+
+	conn, br := dialConnect(t, addr, echoAddr)
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Fatalf("回显失败: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	summary := proxy.Shutdown(ctx, server, socks)
+	if len(summary.Tunnels) != 1 || summary.Tunnels[0].Target != echoAddr {
+		t.Fatalf("汇总中应包含被强制关闭的隧道: %+v", summary)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadByte(); err == nil {
+		t.Error("强制关闭后客户端连接应该断开")
+	}
+	select {
+	case err := <-served:
+		if err != ErrSOCKS5ServerClosed {
+			t.Errorf("关闭后Serve应返回ErrSOCKS5ServerClosed, 实际 %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("关闭后SOCKS5服务器仍在接受连接")
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS5回复码
+const (
+	socks5ReplyGeneralFailure   = 0x01
+	socks5ReplyNotAllowed       = 0x02
+	socks5ReplyHostUnreachable  = 0x04
+	socks5ReplyConnRefused      = 0x05
+	socks5ReplyCmdNotSupported  = 0x07
+	socks5ReplyAddrNotSupported = 0x08
+)
+
+// socks5HandshakeTimeout 完成握手和请求的最长时间
+const socks5HandshakeTimeout = 30 * time.Second
+
+// UDP转发的限制
+const (
+	udpResolveTimeout = 5 * time.Second // 解析目标主机名的超时时间
+	udpTargetTimeout  = 2 * time.Minute // 超过该时间没有向目标发送数据报后不再转发其回复
+	udpMaxTargets     = 1024            // 每个会话记录的目标地址上限
+	udpMaxResolving   = 16              // 每个会话同时进行的解析数上限
+)
+
+// SOCKS5Server SOCKS5代理服务器（RFC 1928），与ForwardProxy共用拨号、访问控制和日志
+type SOCKS5Server struct {
+	mu        sync.Mutex
+	proxy     *ForwardProxy
+	store     PasswordStore // 非空时要求用户名密码认证（RFC 1929）
+	listeners map[net.Listener]struct{}
+	closed    bool
+}
+
+// ErrSOCKS5ServerClosed Close之后Serve返回的错误
+var ErrSOCKS5ServerClosed = errors.New("SOCKS5服务器已关闭")
+
+// NewSOCKS5Server 创建SOCKS5代理服务器，store为nil时不需要认证
+func NewSOCKS5Server(proxy *ForwardProxy, store PasswordStore) *SOCKS5Server {
+	return &SOCKS5Server{proxy: proxy, store: store}
+}
+
+// Update 替换使用的代理实例和用户存储，已建立的连接继续使用原来的设置
+func (s *SOCKS5Server) Update(proxy *ForwardProxy, store PasswordStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.proxy, s.store = proxy, store
+}
+
+// current 返回当前的代理实例和用户存储
+func (s *SOCKS5Server) current() (*ForwardProxy, PasswordStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.proxy, s.store
+}
+
+// ListenAndServe 监听addr并提供SOCKS5服务
+func (s *SOCKS5Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve 在监听器上接受连接并提供SOCKS5服务
+func (s *SOCKS5Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ErrSOCKS5ServerClosed
+	}
+	defer s.trackListener(l, false)
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrSOCKS5ServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close 停止接受新连接，已建立的隧道不受影响，由ForwardProxy统一关闭
+func (s *SOCKS5Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// trackListener 登记或移除监听器，服务器已关闭时登记失败
+func (s *SOCKS5Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *SOCKS5Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// serveConn 处理单个SOCKS5客户端连接
+func (s *SOCKS5Server) serveConn(conn net.Conn) {
+	info := &requestInfo{client: conn.RemoteAddr().String()}
+	ctx := withRequestInfo(context.Background(), info)
+	// 整个连接使用同一份设置，重新加载配置不影响进行中的连接
+	proxy, store := s.current()
+
+	conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	user, err := negotiate(conn, store)
+	if err != nil {
+		logf(ctx, "SOCKS5握手失败: %v", err)
+		conn.Close()
+		return
+	}
+	info.user = user
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		conn.Close()
+		return
+	}
+	if header[0] != socks5Version {
+		conn.Close()
+		return
+	}
+	host, port, err := readSocks5Addr(conn, header[3])
+	if err != nil {
+		writeSocks5Reply(conn, socks5ReplyAddrNotSupported, nil)
+		conn.Close()
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	if proxy.limiter != nil {
+		limit, err := proxy.limiter.Acquire(limitKey(info))
+		if err != nil {
+			logf(ctx, "拒绝SOCKS5请求: %v", err)
+			writeSocks5Reply(conn, socks5ReplyNotAllowed, nil)
+			conn.Close()
+			return
+		}
+		defer limit.Release()
+		info.limit = limit
+	}
+
+	switch header[1] {
+	case socks5CmdConnect:
+		info.method = "CONNECT"
+		logf(ctx, "收到SOCKS5请求: CONNECT %s", addr)
+		handleSocks5Connect(ctx, proxy, conn, addr)
+	case socks5CmdUDP:
+		info.method = "UDP"
+		logf(ctx, "收到SOCKS5请求: UDP ASSOCIATE %s", addr)
+		handleSocks5UDPAssociate(ctx, proxy, conn, host, port)
+	default:
+		writeSocks5Reply(conn, socks5ReplyCmdNotSupported, nil)
+		conn.Close()
+	}
+}
+
+// negotiate 协商认证方式并在需要时校验用户名密码
+func negotiate(conn net.Conn, store PasswordStore) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", errors.New("不是SOCKS5协议")
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	want := byte(socks5AuthNone)
+	if store != nil {
+		want = socks5AuthPassword
+	}
+	if bytes.IndexByte(methods, want) < 0 {
+		conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return "", errors.New("客户端不支持所需的认证方式")
+	}
+	if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+		return "", err
+	}
+	if want == socks5AuthNone {
+		return "", nil
+	}
+
+	// RFC 1929 用户名密码认证
+	var buf [256]byte
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != 0x01 {
+		conn.Write([]byte{0x01, 0x01})
+		return "", fmt.Errorf("不支持的用户名密码认证版本%d", buf[0])
+	}
+	user := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return "", err
+	}
+	password := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", err
+	}
+	if !store.Verify(string(user), string(password)) {
+		conn.Write([]byte{0x01, 0x01})
+		return "", errBadCredentials
+	}
+	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+		return "", err
+	}
+	return string(user), nil
+}
+
+// handleSocks5Connect 处理CONNECT命令，建立到目标的TCP隧道
+func handleSocks5Connect(ctx context.Context, proxy *ForwardProxy, conn net.Conn, addr string) {
+	dialCtx, err := proxy.authorizeTarget(ctx, addr)
+	var targetConn net.Conn
+	if err == nil {
+		targetConn, err = proxy.dialTunnel(dialCtx, addr)
+	}
+	if err != nil {
+		logf(ctx, "SOCKS5连接%s失败: %v", addr, err)
+		writeSocks5Reply(conn, socks5ErrorReply(err), nil)
+		conn.Close()
+		return
+	}
+
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded, targetConn.LocalAddr()); err != nil {
+		targetConn.Close()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	proxy.relay(ctx, conn, targetConn, addr)
+}
+
+// socks5ErrorReply 将拨号错误转换为SOCKS5回复码
+func socks5ErrorReply(err error) byte {
+	var denied *AccessDeniedError
+	if errors.As(err, &denied) {
+		return socks5ReplyNotAllowed
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socks5ReplyHostUnreachable
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return socks5ReplyConnRefused
+	}
+	return socks5ReplyGeneralFailure
+}
+
+// writeSocks5Reply 写入SOCKS5回复，bound为nil时使用0.0.0.0:0
+func writeSocks5Reply(w io.Writer, code byte, bound net.Addr) error {
+	host, port := "0.0.0.0", 0
+	switch a := bound.(type) {
+	case *net.TCPAddr:
+		host, port = a.IP.String(), a.Port
+	case *net.UDPAddr:
+		host, port = a.IP.String(), a.Port
+	}
+	addr, _ := socks5Addr(host, port) // IP地址编码不会出错
+	reply := append([]byte{socks5Version, code, 0x00}, addr...)
+	_, err := w.Write(reply)
+	return err
+}
+
+// handleSocks5UDPAssociate 处理UDP ASSOCIATE命令，UDP转发直接出站，不经过上级代理
+func handleSocks5UDPAssociate(ctx context.Context, proxy *ForwardProxy, conn net.Conn, host string, port int) {
+	defer conn.Close()
+
+	// 监听器经PROXY协议包装时地址可能不是TCP地址
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	remote, ok2 := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !ok2 {
+		logf(ctx, "控制连接地址不是TCP地址: %v -> %v", conn.RemoteAddr(), conn.LocalAddr())
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return
+	}
+	// 客户端声明的IP只能是控制连接的IP，防止把转发端口指向第三方主机
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && !ip.Equal(remote.IP) {
+		logf(ctx, "UDP ASSOCIATE声明的地址%s与控制连接%s不一致", host, remote.IP)
+		writeSocks5Reply(conn, socks5ReplyNotAllowed, nil)
+		return
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		logf(ctx, "创建UDP转发端口失败: %v", err)
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return
+	}
+	defer relay.Close()
+	// 会话结束时取消进行中的解析
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded, relay.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// 只接受来自控制连接所在客户端IP的数据报，客户端声明了端口时同时校验端口
+	association := &udpAssociation{
+		proxy:      proxy,
+		ctx:        ctx,
+		relay:      relay,
+		clientIP:   remote.IP,
+		clientPort: port,
+		resolved:   make(map[string]udpTarget),
+		resolving:  make(map[string]bool),
+		sent:       make(map[string]time.Time),
+	}
+	go association.run()
+
+	// 控制连接关闭时结束UDP转发
+	io.Copy(io.Discard, conn)
+	logf(ctx, "SOCKS5 UDP转发结束")
+}
+
+// udpAssociation 一个UDP ASSOCIATE会话
+type udpAssociation struct {
+	proxy      *ForwardProxy
+	ctx        context.Context
+	relay      *net.UDPConn
+	clientIP   net.IP
+	clientPort int
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr
+	resolved   map[string]udpTarget // 已通过访问控制检查的目标地址
+	resolving  map[string]bool      // 正在后台解析的目标
+	sent       map[string]time.Time // 目标及最近一次向其发送数据报的时间，只转发这些目标的回复
+}
+
+// udpTarget 已通过访问控制检查的UDP目标
+type udpTarget struct {
+	addr    *net.UDPAddr
+	expires time.Time // 解析结果的过期时间，目标为IP地址时为零值
+}
+
+// run 在客户端和目标之间转发UDP数据报
+func (a *udpAssociation) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if a.isClient(from) {
+			a.forward(buf[:n])
+			continue
+		}
+
+		// 来自目标的数据报，加上SOCKS5头后发回客户端
+		a.mu.Lock()
+		client := a.clientAddr
+		last, known := a.sent[from.String()]
+		a.mu.Unlock()
+		if client == nil || !known || time.Since(last) >= udpTargetTimeout {
+			continue
+		}
+		addr, _ := socks5Addr(from.IP.String(), from.Port)
+		packet := append([]byte{0x00, 0x00, 0x00}, addr...)
+		packet = append(packet, buf[:n]...)
+		a.relay.WriteToUDP(packet, client)
+	}
+}
+
+// isClient 判断数据报是否来自客户端，第一个匹配的地址会被固定为客户端地址
+func (a *udpAssociation) isClient(from *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.clientAddr != nil {
+		return a.clientAddr.IP.Equal(from.IP) && a.clientAddr.Port == from.Port
+	}
+	if !from.IP.Equal(a.clientIP) || (a.clientPort != 0 && from.Port != a.clientPort) {
+		return false
+	}
+	a.clientAddr = from
+	return true
+}
+
+// forward 解析客户端数据报的SOCKS5头并发往目标
+func (a *udpAssociation) forward(packet []byte) {
+	if len(packet) < 4 || packet[2] != 0x00 {
+		// 不支持分片
+		return
+	}
+	r := bytes.NewReader(packet[4:])
+	host, port, err := readSocks5Addr(r, packet[3])
+	if err != nil {
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	data := packet[len(packet)-r.Len():]
+
+	a.mu.Lock()
+	target, ok := a.resolved[addr]
+	if ok && !target.expires.IsZero() && !time.Now().Before(target.expires) {
+		delete(a.resolved, addr)
+		ok = false
+	}
+	a.mu.Unlock()
+	if ok {
+		a.send(data, target.addr)
+		return
+	}
+	if net.ParseIP(host) != nil {
+		// IP地址只需要访问控制检查，不会阻塞
+		a.resolve(addr, port, data)
+		return
+	}
+
+	// 解析主机名可能很慢，在后台进行，不阻塞其他目标的数据报。解析期间发往同一目标的数据报被丢弃
+	a.mu.Lock()
+	busy := a.resolving[addr] || len(a.resolving) >= udpMaxResolving
+	if !busy {
+		a.resolving[addr] = true
+	}
+	a.mu.Unlock()
+	if busy {
+		return
+	}
+	// buf会被下一个数据报覆盖
+	data = append([]byte(nil), data...)
+	go func() {
+		a.resolve(addr, port, data)
+		a.mu.Lock()
+		delete(a.resolving, addr)
+		a.mu.Unlock()
+	}()
+}
+
+// resolve 解析目标并检查访问控制，记录结果后发送数据报
+func (a *udpAssociation) resolve(addr string, port int, data []byte) {
+	ctx, cancel := context.WithTimeout(a.ctx, udpResolveTimeout)
+	defer cancel()
+	ips, ttl, err := a.proxy.resolveTargetTTL(ctx, addr)
+	if err != nil {
+		logf(a.ctx, "SOCKS5 UDP转发到%s失败: %v", addr, err)
+		return
+	}
+	target := udpTarget{addr: &net.UDPAddr{IP: ips[0], Port: port}}
+	if net.ParseIP(hostOnly(addr)) == nil {
+		// 按解析器的TTL重新解析，TTL未知时使用默认的缓存时间
+		if ttl <= 0 {
+			ttl = defaultDNSTTL
+		}
+		target.expires = time.Now().Add(ttl)
+	}
+
+	a.mu.Lock()
+	if _, ok := a.resolved[addr]; !ok {
+		a.evict()
+	}
+	a.resolved[addr] = target
+	a.mu.Unlock()
+	a.send(data, target.addr)
+}
+
+// send 向目标发送数据报，之后一段时间内来自该目标的回复会转发给客户端
+func (a *udpAssociation) send(data []byte, target *net.UDPAddr) {
+	key := target.String()
+	a.mu.Lock()
+	if _, ok := a.sent[key]; !ok {
+		a.evict()
+	}
+	a.sent[key] = time.Now()
+	a.mu.Unlock()
+	a.relay.WriteToUDP(data, target)
+}
+
+// evict 目标记录已满时清除过期条目，仍然已满时随机清除一条，调用者需持有a.mu
+func (a *udpAssociation) evict() {
+	now := time.Now()
+	if len(a.resolved) >= udpMaxTargets {
+		for key, t := range a.resolved {
+			if !t.expires.IsZero() && !now.Before(t.expires) {
+				delete(a.resolved, key)
+			}
+		}
+		for key := range a.resolved {
+			if len(a.resolved) < udpMaxTargets {
+				break
+			}
+			delete(a.resolved, key)
+		}
+	}
+	if len(a.sent) >= udpMaxTargets {
+		for key, last := range a.sent {
+			if now.Sub(last) >= udpTargetTimeout {
+				delete(a.sent, key)
+			}
+		}
+		for key := range a.sent {
+			if len(a.sent) < udpMaxTargets {
+				break
+			}
+			delete(a.sent, key)
+		}
+	}
+}
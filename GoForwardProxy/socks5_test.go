@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startSOCKS5 在随机端口启动SOCKS5服务器
+func startSOCKS5(t *testing.T, proxy *ForwardProxy, store PasswordStore) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go NewSOCKS5Server(proxy, store).Serve(l)
+	return l.Addr().String()
+}
+
+// TestSOCKS5Connect 测试SOCKS5 CONNECT、认证和访问控制
+func TestSOCKS5Connect(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+	backendAddr := strings.TrimPrefix(backend.URL, "http://")
+
+	users, _ := ParseHtpasswd([]byte("alice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n"))
+
+	tests := []struct {
+		name    string
+		policy  *Policy
+		user    *url.Userinfo
+		wantErr string
+	}{
+		{name: "认证成功", user: url.UserPassword("alice", "secret")},
+		{name: "密码错误", user: url.UserPassword("alice", "wrong"), wantErr: "认证失败"},
+		{name: "未提供认证", user: nil, wantErr: "没有可用的认证方式"},
+		{name: "访问控制拒绝", policy: DefaultPolicy(), user: url.UserPassword("alice", "secret"), wantErr: "错误码2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := NewForwardProxy()
+			proxy.SetPolicy(tt.policy)
+			addr := startSOCKS5(t, proxy, users)
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("连接SOCKS5服务器失败: %v", err)
+			}
+			defer conn.Close()
+			err = socks5Connect(conn, &Upstream{Scheme: "socks5", Addr: addr, User: tt.user}, backendAddr)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("期望错误包含 %q, 实际 %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SOCKS5 CONNECT失败: %v", err)
+			}
+
+			fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", backendAddr)
+			data, _ := io.ReadAll(conn)
+			if !bytes.HasSuffix(data, []byte("ok")) {
+				t.Errorf("响应不正确: %s", data)
+			}
+		})
+	}
+}
+
+// TestSOCKS5Upstream 测试ForwardProxy经SOCKS5上级代理转发HTTP请求
+func TestSOCKS5Upstream(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+
+	socksAddr := startSOCKS5(t, NewForwardProxy(), nil)
+	router, err := ParseRoutes([]byte("* socks5://" + socksAddr))
+	if err != nil {
+		t.Fatalf("解析路由规则失败: %v", err)
+	}
+	proxy := NewForwardProxy()
+	proxy.SetRouter(router)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   5 * time.Second,
+	}
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("响应不正确: %s", body)
+	}
+}
+
+// TestSOCKS5AuthVersion 测试拒绝非0x01版本的用户名密码认证
+func TestSOCKS5AuthVersion(t *testing.T) {
+	users, _ := ParseHtpasswd([]byte("alice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n"))
+	addr := startSOCKS5(t, NewForwardProxy(), users)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("连接SOCKS5服务器失败: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{socks5Version, 1, socks5AuthPassword})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socks5AuthPassword {
+		t.Fatalf("协商认证方式失败: %v %v", reply, err)
+	}
+	conn.Write([]byte{0x05, 5, 'a', 'l', 'i', 'c', 'e', 6, 's', 'e', 'c', 'r', 'e', 't'})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, _ := io.ReadAll(conn)
+	if !bytes.Equal(data, []byte{0x01, 0x01}) {
+		t.Errorf("期望认证失败后关闭连接, 实际收到 %v", data)
+	}
+}
+
+// udpAssociate 为client建立UDP ASSOCIATE会话并返回转发地址，测试结束时关闭控制连接
+func udpAssociate(t *testing.T, addr string, client *net.UDPConn) *net.UDPAddr {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("连接SOCKS5服务器失败: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socks5AuthNone {
+		t.Fatalf("协商认证方式失败: %v %v", reply, err)
+	}
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	dst, _ := socks5Addr("127.0.0.1", clientAddr.Port)
+	conn.Write(append([]byte{socks5Version, socks5CmdUDP, 0x00}, dst...))
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil || header[1] != socks5ReplySucceeded {
+		t.Fatalf("UDP ASSOCIATE失败: %v %v", header, err)
+	}
+	relayHost, relayPort, err := readSocks5Addr(conn, header[3])
+	if err != nil {
+		t.Fatalf("读取转发地址失败: %v", err)
+	}
+	relayAddr, _ := net.ResolveUDPAddr("udp", net.JoinHostPort(relayHost, strconv.Itoa(relayPort)))
+	return relayAddr
+}
+
+// TestSOCKS5UDPAssociate 测试UDP ASSOCIATE转发
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	// UDP回显服务器
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("监听UDP失败: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	addr := startSOCKS5(t, NewForwardProxy(), nil)
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("监听UDP失败: %v", err)
+	}
+	defer client.Close()
+	relayAddr := udpAssociate(t, addr, client)
+
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	dst, _ := socks5Addr("127.0.0.1", echoAddr.Port)
+	packet := append([]byte{0x00, 0x00, 0x00}, dst...)
+	packet = append(packet, "ping"...)
+	if _, err := client.WriteToUDP(packet, relayAddr); err != nil {
+		t.Fatalf("发送数据报失败: %v", err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("接收数据报失败: %v", err)
+	}
+	r := bytes.NewReader(buf[4:n])
+	host, port, err := readSocks5Addr(r, buf[3])
+	if err != nil {
+		t.Fatalf("解析数据报头失败: %v", err)
+	}
+	if host != "127.0.0.1" || port != echoAddr.Port {
+		t.Errorf("来源地址不正确: %s:%d", host, port)
+	}
+	if data := buf[n-r.Len() : n]; string(data) != "ping" {
+		t.Errorf("数据不正确: %q", data)
+	}
+
+	// 未发送过数据报的来源不应被转发给客户端
+	stranger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("监听UDP失败: %v", err)
+	}
+	defer stranger.Close()
+	stranger.WriteToUDP([]byte("spoof"), relayAddr)
+	client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, _, err := client.ReadFromUDP(buf); err == nil {
+		t.Errorf("转发了未知来源的数据报: %q", buf[:n])
+	}
+}
+
+// slowResolver 解析slow.test时阻塞到release关闭，其他主机解析为127.0.0.1
+type slowResolver struct {
+	release chan struct{}
+}
+
+func (r *slowResolver) Resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if host == "slow.test" {
+		select {
+		case <-r.release:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+	return []net.IP{net.IPv4(127, 0, 0, 1)}, time.Minute, nil
+}
+
+// TestSOCKS5UDPSlowResolve 测试解析慢的目标不阻塞发往其他目标的数据报
+func TestSOCKS5UDPSlowResolve(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("监听UDP失败: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+	echoPort := echo.LocalAddr().(*net.UDPAddr).Port
+
+	resolver := &slowResolver{release: make(chan struct{})}
+	proxy := NewForwardProxy()
+	proxy.SetResolver(resolver)
+	addr := startSOCKS5(t, proxy, nil)
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("监听UDP失败: %v", err)
+	}
+	defer client.Close()
+	relayAddr := udpAssociate(t, addr, client)
+
+	send := func(host, data string) {
+		dst, _ := socks5Addr(host, echoPort)
+		packet := append([]byte{0x00, 0x00, 0x00}, dst...)
+		client.WriteToUDP(append(packet, data...), relayAddr)
+	}
+	receive := func() string {
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 1024)
+		n, _, err := client.ReadFromUDP(buf)
+		if err != nil {
+			return ""
+		}
+		r := bytes.NewReader(buf[4:n])
+		readSocks5Addr(r, buf[3])
+		return string(buf[n-r.Len() : n])
+	}
+
+	send("slow.test", "slow")
+	send("fast.test", "fast")
+	if data := receive(); data != "fast" {
+		t.Fatalf("解析中的目标阻塞了其他数据报, 收到 %q", data)
+	}
+	close(resolver.release)
+	if data := receive(); data != "slow" {
+		t.Errorf("解析完成后应发送等待的数据报, 收到 %q", data)
+	}
+}
+
+// TestSOCKS5UDPAssociateForeignAddr 测试拒绝声明为第三方IP的UDP ASSOCIATE
+func TestSOCKS5UDPAssociateForeignAddr(t *testing.T) {
+	addr := startSOCKS5(t, NewForwardProxy(), nil)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("连接SOCKS5服务器失败: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socks5AuthNone {
+		t.Fatalf("协商认证方式失败: %v %v", reply, err)
+	}
+	dst, _ := socks5Addr("192.0.2.1", 9)
+	conn.Write(append([]byte{socks5Version, socks5CmdUDP, 0x00}, dst...))
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("读取回复失败: %v", err)
+	}
+	if header[1] != socks5ReplyNotAllowed {
+		t.Errorf("回复码不正确: 期望 %d, 实际 %d", socks5ReplyNotAllowed, header[1])
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultResponseHeaderTimeout 等待上游响应头的默认超时
+	defaultResponseHeaderTimeout = time.Minute
+	// defaultBodyIdleTimeout 上游响应体默认的空闲超时，流式响应只要持续有数据就不会被中断
+	defaultBodyIdleTimeout = time.Minute
+)
+
+// errBodyIdleTimeout 上游响应体超过空闲超时没有数据
+var errBodyIdleTimeout = errors.New("上游响应体空闲超时")
+
+// SetUpstreamTimeouts 设置等待上游响应头的超时和响应体的空闲超时，0表示不限制
+func (p *ForwardProxy) SetUpstreamTimeouts(header, bodyIdle time.Duration) {
+	p.client.Transport.(*http.Transport).ResponseHeaderTimeout = header
+	p.bodyIdleTimeout = bodyIdle
+}
+
+// doUpstream 发送上游请求并记录耗时，响应体读取超过空闲超时没有数据时中止请求
+func (p *ForwardProxy) doUpstream(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	start := time.Now()
+	resp, err := p.client.Do(req.WithContext(ctx))
+	for err != nil && retryParent(req, err) {
+		// HTTP上级代理不可达，proxyForRequest会选择下一个出站方式
+		resp, err = p.client.Do(req.WithContext(ctx))
+	}
+	p.metrics.upstreamLatency.observe(time.Since(start).Seconds())
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if p.bodyIdleTimeout > 0 {
+		resp.Body = newIdleTimeoutBody(resp.Body, p.bodyIdleTimeout, cancel)
+	} else {
+		resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	}
+	return resp, nil
+}
+
+// retryParent 判断请求是否因HTTP上级代理不可达而失败且可以重发：请求体已被关闭，只重发没有请求体的请求
+func retryParent(req *http.Request, err error) bool {
+	var parentErr *parentDialError
+	return errors.As(err, &parentErr) && (req.Body == nil || req.Body == http.NoBody)
+}
+
+// cancelBody 关闭响应体时释放请求的上下文
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// idleTimeoutBody 单次读取阻塞超过timeout时取消请求，只计算等待上游的时间
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	expired int32
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutBody {
+	b := &idleTimeoutBody{ReadCloser: body, timeout: timeout, cancel: cancel}
+	b.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&b.expired, 1)
+		cancel()
+	})
+	b.timer.Stop()
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if err != nil && err != io.EOF && atomic.LoadInt32(&b.expired) == 1 {
+		err = errBodyIdleTimeout
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// isStreaming 判断响应是否需要逐块刷新：Server-Sent Events 或长度未知的响应体
+func isStreaming(resp *http.Response) bool {
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && mediaType == "text/event-stream" {
+		return true
+	}
+	return resp.ContentLength < 0
+}
+
+// copyBody 将上游响应体写回客户端。流式响应每块数据立即刷新；每次写入前按空闲超时
+// 推后写截止时间，使持续有数据的长响应不受服务器整体写超时限制。
+// 返回写入客户端的错误，读取上游出错时中断客户端连接
+func (p *ForwardProxy) copyBody(w http.ResponseWriter, r *http.Request, resp *http.Response) error {
+	rc := http.NewResponseController(w)
+	dst := faultWriter(r.Context(), limitWriter(r.Context(), w))
+	flush := isStreaming(resp)
+	extended := false
+	defer func() {
+		if extended {
+			// 不把延长的截止时间留给同一连接上的后续请求
+			rc.SetWriteDeadline(time.Time{})
+		}
+	}()
+
+	buf := make([]byte, 32*1024)
+	if n := faultChunk(r.Context()); n > 0 && n < len(buf) {
+		// 带宽故障下逐块刷新，客户端才能观察到限速效果
+		buf, flush = buf[:n], true
+	}
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			if p.bodyIdleTimeout > 0 && rc.SetWriteDeadline(time.Now().Add(p.bodyIdleTimeout)) == nil {
+				extended = true
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				if err == errFaultTruncated {
+					logf(r.Context(), "故障注入截断了响应体")
+					panic(http.ErrAbortHandler)
+				}
+				return err
+			}
+			if flush {
+				rc.Flush()
+			}
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		if rerr != nil {
+			// 响应头已经发出，中断客户端连接，避免截断的响应被当成完整响应
+			logf(r.Context(), "读取上游响应体失败: %v", rerr)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStreamingFlush 测试Server-Sent Events每个事件立即到达客户端
+func TestStreamingFlush(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		w.Header().Set("Content-Length", "16")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "bye")
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	resp, err := newProxyTestClient(t, NewForwardProxy()).Get(backend.URL)
+	if err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// 第二部分数据在读到第一个事件之后才发送，没有及时刷新时这里会超时
+	got := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		got <- line
+	}()
+	select {
+	case line := <-got:
+		if line != "data: first\n" {
+			t.Errorf("事件内容不匹配: %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("事件没有被及时刷新到客户端")
+	}
+}
+
+// TestUpstreamTimeouts 测试响应头超时和响应体空闲超时，持续有数据的长响应不受影响
+func TestUpstreamTimeouts(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		wantStatus int
+		wantBody   string
+		wantErr    bool
+	}{
+		{
+			name: "持续输出超过空闲超时的总时长",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < 6; i++ {
+					fmt.Fprint(w, i)
+					w.(http.Flusher).Flush()
+					time.Sleep(50 * time.Millisecond)
+				}
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   "012345",
+		},
+		{
+			name: "响应体空闲超时",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "partial")
+				w.(http.Flusher).Flush()
+				select {
+				case <-r.Context().Done():
+				case <-time.After(3 * time.Second):
+				}
+			},
+			wantStatus: http.StatusOK,
+			wantErr:    true,
+		},
+		{
+			name: "响应头超时",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(3 * time.Second):
+				}
+			},
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewServer(tt.handler)
+			defer backend.Close()
+			proxy := NewForwardProxy()
+			proxy.SetUpstreamTimeouts(200*time.Millisecond, 120*time.Millisecond)
+
+			start := time.Now()
+			resp, err := newProxyTestClient(t, proxy).Get(backend.URL)
+			if err != nil {
+				t.Fatalf("请求失败: %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("状态码不匹配, 期望 %d, 实际 %d", tt.wantStatus, resp.StatusCode)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("期望响应体被中断, 实际读到 %q", body)
+				}
+			} else if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("响应体不匹配: %q %v", body, err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("超时没有生效, 耗时 %s", elapsed)
+			}
+		})
+	}
+}
+
+// TestTrailers 测试请求和响应的trailer都被转发
+func TestTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Checksum")
+		fmt.Fprint(w, "body")
+		w.Header().Set("X-Checksum", "req="+r.Trailer.Get("X-Request-Sum"))
+	}))
+	defer backend.Close()
+
+	req, _ := http.NewRequest("POST", backend.URL, io.NopCloser(strings.NewReader("payload")))
+	req.ContentLength = -1
+	req.Trailer = http.Header{"X-Request-Sum": {"abc"}}
+	resp, err := newProxyTestClient(t, NewForwardProxy()).Do(req)
+	if err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "body" {
+		t.Errorf("响应体不匹配: %q", body)
+	}
+	if got := resp.Trailer.Get("X-Checksum"); got != "req=abc" {
+		t.Errorf("trailer不匹配: %q", got)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// tlsHandshakeTimeout 与上游或拦截的客户端TLS握手的超时时间
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSPolicy 连接上游HTTPS服务器时的证书校验策略
+type TLSPolicy struct {
+	RootCAs    *x509.CertPool // 信任的根证书，nil表示系统根证书
+	MinVersion uint16         // 最低TLS版本，0表示TLS 1.2
+	Hosts      []TLSHostRule  // 按顺序匹配的主机规则，第一条命中的生效
+}
+
+// TLSHostRule 特定主机的TLS设置，未设置的字段沿用全局设置
+type TLSHostRule struct {
+	Domains     []string
+	RootCAs     *x509.CertPool   // 非nil时只信任这些CA，用于内部CA签发的服务
+	Certificate *tls.Certificate // 双向TLS使用的客户端证书
+	MinVersion  uint16
+}
+
+// NewTLSPolicy 创建信任系统根证书以及caFiles中额外CA的策略
+func NewTLSPolicy(caFiles []string) (*TLSPolicy, error) {
+	policy := &TLSPolicy{}
+	if len(caFiles) == 0 {
+		return policy, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, fmt.Errorf("读取系统根证书失败: %v", err)
+	}
+	if err := appendCAFiles(pool, caFiles); err != nil {
+		return nil, err
+	}
+	policy.RootCAs = pool
+	return policy, nil
+}
+
+// appendCAFiles 将PEM格式的CA证书文件加入证书池
+func appendCAFiles(pool *x509.CertPool, files []string) error {
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("读取CA证书失败: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("%s 中没有有效的PEM证书", file)
+		}
+	}
+	return nil
+}
+
+// ParseTLSVersion 解析TLS版本号：1.0、1.1、1.2 或 1.3
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("不支持的TLS版本: %s", s)
+}
+
+// ParseTLSHostRules 解析主机TLS规则文本，每行格式为:
+//
+//	<域名>[,<域名>...] [ca=<CA文件>[,<CA文件>...]] [cert=<证书文件> key=<私钥文件>] [min=1.2|1.3]
+func ParseTLSHostRules(data []byte) ([]TLSHostRule, error) {
+	var rules []TLSHostRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		rule, err := parseTLSHostRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("第%d行: %v", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func parseTLSHostRule(text string) (TLSHostRule, error) {
+	fields := strings.Fields(text)
+	rule := TLSHostRule{Domains: strings.Split(fields[0], ",")}
+	var certFile, keyFile string
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return rule, fmt.Errorf("无效的选项: %s", field)
+		}
+		switch key {
+		case "ca":
+			rule.RootCAs = x509.NewCertPool()
+			if err := appendCAFiles(rule.RootCAs, strings.Split(value, ",")); err != nil {
+				return rule, err
+			}
+		case "cert":
+			certFile = value
+		case "key":
+			keyFile = value
+		case "min":
+			version, err := ParseTLSVersion(value)
+			if err != nil {
+				return rule, err
+			}
+			rule.MinVersion = version
+		default:
+			return rule, fmt.Errorf("未知的选项: %s", key)
+		}
+	}
+	if (certFile == "") != (keyFile == "") {
+		return rule, fmt.Errorf("cert和key必须同时设置")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return rule, fmt.Errorf("加载客户端证书失败: %v", err)
+		}
+		rule.Certificate = &cert
+	}
+	return rule, nil
+}
+
+// LoadTLSHostRules 从文件加载主机TLS规则
+func LoadTLSHostRules(path string) ([]TLSHostRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取TLS规则失败: %v", err)
+	}
+	return ParseTLSHostRules(data)
+}
+
+// config 返回连接host时使用的TLS配置
+func (tp *TLSPolicy) config(host string) *tls.Config {
+	cfg := &tls.Config{ServerName: host, RootCAs: tp.RootCAs, MinVersion: tp.MinVersion}
+	for _, rule := range tp.Hosts {
+		if !rule.matches(host) {
+			continue
+		}
+		if rule.RootCAs != nil {
+			cfg.RootCAs = rule.RootCAs
+		}
+		if rule.Certificate != nil {
+			cfg.Certificates = []tls.Certificate{*rule.Certificate}
+		}
+		if rule.MinVersion != 0 {
+			cfg.MinVersion = rule.MinVersion
+		}
+		break
+	}
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	return cfg
+}
+
+func (r *TLSHostRule) matches(host string) bool {
+	for _, pattern := range r.Domains {
+		if matchDomain(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTLSPolicy 设置连接上游HTTPS服务器时的证书校验策略
+func (p *ForwardProxy) SetTLSPolicy(policy *TLSPolicy) {
+	p.tlsPolicy = policy
+}
+
+// dialTLS 建立到上游HTTPS服务器的连接，按TLS策略校验证书
+func (p *ForwardProxy) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := p.dialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	host := hostOnly(addr)
+	hsCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, p.tlsPolicy.config(host))
+	if err := tlsConn.HandshakeContext(hsCtx); err != nil {
+		conn.Close()
+		err = &upstreamTLSError{host: host, err: err}
+		p.metrics.observeDialError(err)
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// upstreamTLSError 与上游的TLS握手或证书校验失败
+type upstreamTLSError struct {
+	host string
+	err  error
+}
+
+func (e *upstreamTLSError) Error() string {
+	return fmt.Sprintf("与%s的TLS握手失败: %s", e.host, describeTLSError(e.err))
+}
+
+func (e *upstreamTLSError) Unwrap() error {
+	return e.err
+}
+
+// describeTLSError 将常见的证书错误转换为易懂的说明
+func describeTLSError(err error) string {
+	var unknownCA x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var record tls.RecordHeaderError
+	switch {
+	case errors.As(err, &unknownCA):
+		issuer := "未知"
+		if unknownCA.Cert != nil {
+			issuer = unknownCA.Cert.Issuer.String()
+		}
+		return fmt.Sprintf("证书由不受信任的CA签发（签发者: %s），请通过 -tls-ca 或 -tls-hosts 添加该CA", issuer)
+	case errors.As(err, &hostname):
+		return fmt.Sprintf("证书与主机名不匹配: %v", hostname.Error())
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return fmt.Sprintf("证书已过期或尚未生效: %v", invalid.Error())
+	case errors.As(err, &invalid):
+		return fmt.Sprintf("证书无效: %v", invalid.Error())
+	case errors.As(err, &record):
+		return "对方不是TLS服务"
+	}
+	return err.Error()
+}
+
+// writeTLSError 返回说明证书问题的502响应
+func writeTLSError(w http.ResponseWriter, r *http.Request, err *upstreamTLSError) {
+	logf(r.Context(), "%v", err)
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
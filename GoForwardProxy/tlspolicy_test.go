@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writePEM 将DER数据以PEM格式写入文件
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatalf("写入%s失败: %v", path, err)
+	}
+}
+
+// writeClientCert 生成自签名的客户端证书，返回用于校验它的证书池以及证书和私钥文件
+func writeClientCert(t *testing.T, dir string) (*x509.CertPool, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("生成私钥失败: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("生成证书失败: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("编码私钥失败: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool, certFile, keyFile
+}
+
+// proxyGet 直接调用代理处理绝对URL的请求
+func proxyGet(proxy *ForwardProxy, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+	return rec
+}
+
+// TestUpstreamTLSPolicy 测试上游证书校验、按主机覆盖CA和最低TLS版本
+func TestUpstreamTLSPolicy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "ok") })
+	backend := httptest.NewTLSServer(handler)
+	defer backend.Close()
+	tls12 := httptest.NewUnstartedServer(handler)
+	tls12.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	tls12.StartTLS()
+	defer tls12.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(backend.Certificate())
+
+	tests := []struct {
+		name       string
+		policy     *TLSPolicy
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{"默认不信任自签名证书", &TLSPolicy{}, backend.URL, http.StatusBadGateway, "证书由不受信任的CA签发"},
+		{"信任额外的CA", &TLSPolicy{RootCAs: pool}, backend.URL, http.StatusOK, "ok"},
+		{"主机规则指定内部CA", &TLSPolicy{Hosts: []TLSHostRule{{Domains: []string{"127.0.0.1"}, RootCAs: pool}}}, backend.URL, http.StatusOK, "ok"},
+		{"主机规则不匹配", &TLSPolicy{Hosts: []TLSHostRule{{Domains: []string{"*.example.com"}, RootCAs: pool}}}, backend.URL, http.StatusBadGateway, "证书由不受信任的CA签发"},
+		{"主机名不匹配", &TLSPolicy{RootCAs: pool}, strings.Replace(backend.URL, "127.0.0.1", "localhost", 1), http.StatusBadGateway, "证书与主机名不匹配"},
+		{"低于最低TLS版本", &TLSPolicy{RootCAs: pool, MinVersion: tls.VersionTLS13}, tls12.URL, http.StatusBadGateway, "TLS握手失败"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := NewForwardProxy()
+			proxy.SetTLSPolicy(tt.policy)
+			rec := proxyGet(proxy, tt.target)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("状态码不匹配, 期望 %d, 实际 %d: %s", tt.wantStatus, rec.Code, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("响应中缺少 %q: %s", tt.wantBody, rec.Body)
+			}
+		})
+	}
+}
+
+// TestUpstreamClientCertificate 测试按主机规则使用客户端证书连接要求双向TLS的上游
+func TestUpstreamClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	clientPool, certFile, keyFile := writeClientCert(t, dir)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientPool}
+	backend.StartTLS()
+	defer backend.Close()
+	caFile := filepath.Join(dir, "backend-ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", backend.Certificate().Raw)
+
+	tests := []struct {
+		name       string
+		rules      string
+		wantStatus int
+	}{
+		{"使用客户端证书", fmt.Sprintf("127.0.0.1 ca=%s cert=%s key=%s min=1.2", caFile, certFile, keyFile), http.StatusOK},
+		{"没有客户端证书", fmt.Sprintf("127.0.0.1 ca=%s", caFile), http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseTLSHostRules([]byte("# 测试规则\n" + tt.rules + "\n"))
+			if err != nil {
+				t.Fatalf("解析TLS规则失败: %v", err)
+			}
+			proxy := NewForwardProxy()
+			proxy.SetTLSPolicy(&TLSPolicy{Hosts: rules})
+			rec := proxyGet(proxy, backend.URL)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("状态码不匹配, 期望 %d, 实际 %d: %s", tt.wantStatus, rec.Code, rec.Body)
+			}
+			if tt.wantStatus == http.StatusOK && rec.Body.String() != "hello test client" {
+				t.Errorf("响应内容不正确: %s", rec.Body)
+			}
+		})
+	}
+}
+
+// TestParseTLSHostRulesErrors 测试无效的TLS规则
+func TestParseTLSHostRulesErrors(t *testing.T) {
+	tests := []string{
+		"a.example.com cert=client.pem",
+		"a.example.com unknown=1",
+		"a.example.com min=2.0",
+		"a.example.com ca=" + filepath.Join(t.TempDir(), "missing.pem"),
+		"a.example.com ca",
+	}
+	for _, text := range tests {
+		if _, err := ParseTLSHostRules([]byte(text)); err == nil {
+			t.Errorf("%q 应该解析失败", text)
+		}
+	}
+}
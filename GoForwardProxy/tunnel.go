@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tunnel 一个活跃的隧道连接（CONNECT或SOCKS5）
+type Tunnel struct {
+	ID     uint64
+	Client string
+	Target string
+	User   string
+	Start  time.Time
+
+	bytesIn  int64 // 从客户端收到并发往目标的字节数
+	bytesOut int64 // 从目标收到并发往客户端的字节数
+
+	clientConn net.Conn
+	targetConn net.Conn
+
+	closeOnce sync.Once
+	reason    string        // 关闭原因
+	done      chan struct{} // 隧道关闭时关闭
+}
+
+// TunnelInfo 隧道的快照，用于管理接口输出
+type TunnelInfo struct {
+	ID       uint64    `json:"id"`
+	Client   string    `json:"client"`
+	Target   string    `json:"target"`
+	User     string    `json:"user,omitempty"`
+	Start    time.Time `json:"start"`
+	Duration string    `json:"duration"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+}
+
+// Info 返回隧道的当前状态
+func (t *Tunnel) Info() TunnelInfo {
+	return TunnelInfo{
+		ID:       t.ID,
+		Client:   t.Client,
+		Target:   t.Target,
+		User:     t.User,
+		Start:    t.Start,
+		Duration: time.Since(t.Start).Round(time.Millisecond).String(),
+		BytesIn:  atomic.LoadInt64(&t.bytesIn),
+		BytesOut: atomic.LoadInt64(&t.bytesOut),
+	}
+}
+
+// Close 强制关闭隧道的两端连接
+func (t *Tunnel) Close() {
+	t.clientConn.Close()
+	t.targetConn.Close()
+}
+
+// TunnelRegistry 记录所有活跃隧道
+type TunnelRegistry struct {
+	mu      sync.Mutex
+	nextID  uint64
+	tunnels map[uint64]*Tunnel
+}
+
+// NewTunnelRegistry 创建隧道登记表
+func NewTunnelRegistry() *TunnelRegistry {
+	return &TunnelRegistry{tunnels: make(map[uint64]*Tunnel)}
+}
+
+func (r *TunnelRegistry) add(t *Tunnel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	t.ID = r.nextID
+	r.tunnels[t.ID] = t
+}
+
+func (r *TunnelRegistry) remove(t *Tunnel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tunnels, t.ID)
+}
+
+// Len 返回活跃隧道数
+func (r *TunnelRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.tunnels)
+}
+
+// Get 按ID查找隧道
+func (r *TunnelRegistry) Get(id uint64) (*Tunnel, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.tunnels[id]
+	return t, ok
+}
+
+// List 返回所有活跃隧道，按ID排序
+func (r *TunnelRegistry) List() []*Tunnel {
+	r.mu.Lock()
+	tunnels := make([]*Tunnel, 0, len(r.tunnels))
+	for _, t := range r.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	r.mu.Unlock()
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].ID < tunnels[j].ID })
+	return tunnels
+}
+
+// closeWriter 支持半关闭的连接，如 *net.TCPConn 和 *tls.Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// tunnelConn 隧道一端的连接，统计字节数、执行客户端限速并在有数据时刷新空闲计时
+type tunnelConn struct {
+	net.Conn
+	read    *int64 // 为nil时不统计
+	written *int64
+	touch   func()
+	limit   *clientLimit // 为nil时不限速
+	done    <-chan struct{}
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	if c.limit != nil && len(b) > c.limit.chunk() {
+		b = b[:c.limit.chunk()]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if c.read != nil {
+			atomic.AddInt64(c.read, int64(n))
+		}
+		c.touch()
+		if c.limit != nil {
+			if werr := c.limit.wait(n, c.done); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
+
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if c.written != nil {
+		atomic.AddInt64(c.written, int64(n))
+	}
+	return n, err
+}
+
+// CloseWrite 半关闭底层连接，不支持时直接关闭
+func (c *tunnelConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// bufferedConn 先读取bufio中已缓冲的数据，再读取底层连接
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite 半关闭底层连接
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// withBuffered 如果bufio中还有已读取但未处理的数据，返回先读取这些数据的连接
+func withBuffered(conn net.Conn, br *bufio.Reader) net.Conn {
+	if br != nil && br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}
+	}
+	return conn
+}
+
+// closeWithReason 关闭隧道并记录原因，只有第一次调用的原因生效
+func (t *Tunnel) closeWithReason(reason string) {
+	t.closeOnce.Do(func() {
+		t.reason = reason
+		close(t.done)
+		t.Close()
+	})
+}
+
+// relay 登记隧道并在客户端和目标之间双向转发数据，结束时输出汇总日志
+func (p *ForwardProxy) relay(ctx context.Context, clientConn, targetConn net.Conn, target string) {
+	t := &Tunnel{
+		Client:     clientConn.RemoteAddr().String(),
+		Target:     target,
+		Start:      time.Now(),
+		clientConn: clientConn,
+		targetConn: targetConn,
+		done:       make(chan struct{}),
+	}
+	var limit *clientLimit
+	method := http.MethodConnect
+	if info := requestInfoFrom(ctx); info != nil {
+		t.User = info.user
+		method = info.method
+		// 隧道在请求处理结束后继续存在，额外占用一个连接计数直到隧道关闭
+		if limit = info.limit; limit != nil {
+			limit.retain()
+		}
+		// 带宽和截断故障作用于从目标返回的数据
+		if info.fault != nil {
+			targetConn = &faultConn{Conn: targetConn, shaper: newFaultShaper(info.fault, t.done)}
+		}
+	}
+	p.tunnels.add(t)
+
+	// 劫持的连接可能带有http.Server设置的读写截止时间，隧道改由下面的计时器控制
+	clientConn.SetDeadline(time.Time{})
+
+	// 空闲超时在任意方向有数据时重新计时，最长存活时间从建立时开始计算
+	var timers []*time.Timer
+	touch := func() {}
+	if idleTimeout := p.tunnelIdleTimeout; idleTimeout > 0 {
+		idle := time.AfterFunc(idleTimeout, func() { t.closeWithReason("空闲超时") })
+		timers = append(timers, idle)
+		touch = func() { idle.Reset(idleTimeout) }
+	}
+	if p.tunnelMaxLifetime > 0 {
+		timers = append(timers, time.AfterFunc(p.tunnelMaxLifetime, func() { t.closeWithReason("超过最长存活时间") }))
+	}
+
+	client := &tunnelConn{Conn: clientConn, read: &t.bytesIn, written: &t.bytesOut, touch: touch, limit: limit, done: t.done}
+	// 目标一端的计数直接累加到全局指标，隧道关闭前也能反映实时流量
+	server := &tunnelConn{Conn: targetConn, read: &p.metrics.tunnelBytesOut, written: &p.metrics.tunnelBytesIn, touch: touch, limit: limit, done: t.done}
+	errc := make(chan error, 2)
+	go func() { errc <- transfer(server, client) }()
+	go func() { errc <- transfer(client, server) }()
+	go func() {
+		for i := 0; i < 2; i++ {
+			if err := <-errc; err != nil {
+				// 一个方向出错时关闭两端，使另一个方向也尽快结束
+				t.closeWithReason(fmt.Sprintf("转发出错: %v", err))
+			}
+		}
+		t.closeWithReason("正常结束")
+		for _, timer := range timers {
+			timer.Stop()
+		}
+		p.tunnels.remove(t)
+		if limit != nil {
+			limit.Release()
+		}
+		info := t.Info()
+		logf(ctx, "隧道#%d关闭(%s): %s，时长 %s，上行 %d 字节，下行 %d 字节", info.ID, t.reason, info.Target, info.Duration, info.BytesIn, info.BytesOut)
+		p.logTunnel(t, method, targetConn)
+	}()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startHalfCloseServer 启动读到EOF后才回复的服务器，用于验证半关闭
+func startHalfCloseServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := io.ReadAll(conn)
+				fmt.Fprintf(conn, "收到%d字节", len(data))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// TestTunnelHalfClose 测试客户端半关闭后仍能收到目标的响应
+func TestTunnelHalfClose(t *testing.T) {
+	target := startHalfCloseServer(t)
+	proxyServer := httptest.NewServer(NewForwardProxy())
+	defer proxyServer.Close()
+
+	conn, br := dialConnect(t, strings.TrimPrefix(proxyServer.URL, "http://"), target)
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("半关闭失败: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatalf("读取响应失败: %v", err)
+	}
+	if string(reply) != "收到5字节" {
+		t.Errorf("响应不匹配: %q", reply)
+	}
+}
+
+// TestTunnelBufferedData 测试与CONNECT请求一起发送的数据不会丢失
+func TestTunnelBufferedData(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	proxyServer := httptest.NewServer(NewForwardProxy())
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyServer.URL, "http://"))
+	if err != nil {
+		t.Fatalf("连接代理失败: %v", err)
+	}
+	defer conn.Close()
+	// 请求头和隧道数据在同一次写入中发送
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nearly", echoAddr, echoAddr)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	want := "HTTP/1.1 200 Connection Established\r\n\r\nearly"
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("读取失败: %v", err)
+	}
+	if string(buf) != want {
+		t.Errorf("响应不匹配: %q", buf)
+	}
+}
+
+// TestTunnelTimeouts 测试空闲超时和最长存活时间
+func TestTunnelTimeouts(t *testing.T) {
+	tests := []struct {
+		name        string
+		idle        time.Duration
+		maxLifetime time.Duration
+		keepAlive   bool // 是否持续发送数据
+	}{
+		{"空闲超时", 100 * time.Millisecond, 0, false},
+		{"最长存活时间", time.Minute, 300 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			echoAddr := startEchoServer(t)
+			proxy := NewForwardProxy()
+			proxy.SetTunnelTimeouts(tt.idle, tt.maxLifetime)
+			proxyServer := httptest.NewServer(proxy)
+			defer proxyServer.Close()
+
+			conn, br := dialConnect(t, strings.TrimPrefix(proxyServer.URL, "http://"), echoAddr)
+			defer conn.Close()
+			if tt.keepAlive {
+				go func() {
+					for i := 0; i < 100; i++ {
+						if _, err := conn.Write([]byte("x")); err != nil {
+							return
+						}
+						time.Sleep(20 * time.Millisecond)
+					}
+				}()
+			}
+
+			start := time.Now()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.Copy(io.Discard, br); err != nil {
+				t.Fatalf("隧道没有被关闭: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("关闭时间过长: %s", elapsed)
+			}
+		})
+	}
+}
+
+// TestTunnelClearsServerDeadline 测试隧道不受http.Server读写超时的影响
+func TestTunnelClearsServerDeadline(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	proxyServer := httptest.NewUnstartedServer(NewForwardProxy())
+	proxyServer.Config.ReadTimeout = 100 * time.Millisecond
+	proxyServer.Config.WriteTimeout = 100 * time.Millisecond
+	proxyServer.Start()
+	defer proxyServer.Close()
+
+	conn, br := dialConnect(t, strings.TrimPrefix(proxyServer.URL, "http://"), echoAddr)
+	defer conn.Close()
+	time.Sleep(300 * time.Millisecond)
+	conn.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("超过服务器超时后隧道应仍可用: %q %v", buf, err)
+	}
+}
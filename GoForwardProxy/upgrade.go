@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// upgradeHandshakeTimeout 协议升级握手的超时时间，握手完成后由隧道的空闲超时控制
+const upgradeHandshakeTimeout = 30 * time.Second
+
+// upgradeType 返回请求或响应要求升级的协议（如 websocket），不是升级请求时返回空字符串
+func upgradeType(h http.Header) string {
+	for _, value := range h["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(textproto.TrimString(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// hijackedStatus 返回接管连接的请求在日志和指标中记录的状态码：
+// CONNECT隧道记为200，协议升级记为101
+func hijackedStatus(method string) int {
+	switch method {
+	case http.MethodConnect, "":
+		return http.StatusOK
+	}
+	return http.StatusSwitchingProtocols
+}
+
+// handleUpgrade 处理WebSocket等协议升级请求：先向上游完成握手，成功后接管客户端连接，
+// 与CONNECT隧道一样由relay双向转发，req为已构造好的上游请求
+func (p *ForwardProxy) handleUpgrade(w http.ResponseWriter, r *http.Request, req *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "不支持的代理方式", http.StatusInternalServerError)
+		return
+	}
+
+	// 逐跳头部已被删除，重新加上升级所需的头部
+	protocol := upgradeType(r.Header)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+
+	// 记录实际的上游连接，升级后的响应体只提供读写，需要原连接的地址和半关闭
+	var peer net.Conn
+	ctx, cancel := context.WithTimeout(req.Context(), upgradeHandshakeTimeout)
+	defer cancel()
+	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(ci httptrace.GotConnInfo) { peer = ci.Conn },
+	}))
+
+	// 不经过doUpstream：升级后的响应体需要保持可写，空闲由隧道的计时器控制
+	start := time.Now()
+	resp, err := p.client.Transport.RoundTrip(req)
+	p.metrics.upstreamLatency.observe(time.Since(start).Seconds())
+	if err != nil {
+		writeDialError(w, r, err)
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// 上游拒绝升级，按普通响应返回
+		defer resp.Body.Close()
+		p.copyResponse(w, r, resp)
+		return
+	}
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok || peer == nil || !strings.EqualFold(upgradeType(resp.Header), protocol) {
+		resp.Body.Close()
+		logf(r.Context(), "上游返回了无效的协议升级响应: %s", r.URL)
+		http.Error(w, "上游返回了无效的协议升级响应", http.StatusBadGateway)
+		return
+	}
+	targetConn := &upgradedConn{Conn: peer, rwc: upstream}
+
+	clientConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		targetConn.Close()
+		http.Error(w, fmt.Sprintf("连接劫持失败: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	clientConn = withBuffered(clientConn, brw.Reader)
+
+	// 转发101响应，保留Connection和Upgrade，去掉其他逐跳头部
+	header := resp.Header.Clone()
+	removeHopByHopHeaders(header)
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", resp.Header.Get("Upgrade"))
+	header.Add("Via", p.viaValue(resp.ProtoMajor, resp.ProtoMinor))
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "HTTP/1.1 %s\r\n", resp.Status)
+	header.Write(&head)
+	head.WriteString("\r\n")
+	if _, err := clientConn.Write(head.Bytes()); err != nil {
+		logf(r.Context(), "写入协议升级响应失败: %v", err)
+		clientConn.Close()
+		targetConn.Close()
+		return
+	}
+
+	logf(r.Context(), "协议升级为%s: %s", protocol, r.URL)
+	p.relay(r.Context(), clientConn, targetConn, r.URL.String())
+}
+
+// upgradedConn 协议升级后的上游连接，读写经过Transport返回的响应体（其中可能已缓冲了数据），
+// 地址和半关闭使用底层连接
+type upgradedConn struct {
+	net.Conn
+	rwc io.ReadWriteCloser
+}
+
+func (c *upgradedConn) Read(b []byte) (int, error) {
+	return c.rwc.Read(b)
+}
+
+func (c *upgradedConn) Write(b []byte) (int, error) {
+	return c.rwc.Write(b)
+}
+
+func (c *upgradedConn) Close() error {
+	return c.rwc.Close()
+}
+
+// CloseWrite 半关闭底层连接
+func (c *upgradedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"goproxycommon/accesslog"
+)
+
+// startUpgradeServer 启动只接受websocket升级的测试服务器，升级后回显收到的数据
+func startUpgradeServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upgradeType(r.Header) != "websocket" {
+			fmt.Fprint(w, "no upgrade")
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		io.Copy(conn, brw)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// dialUpgrade 经代理发送升级请求，payload紧跟在请求后发送
+func dialUpgrade(t *testing.T, proxyAddr, target, protocol, payload string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("连接代理失败: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	host := strings.TrimPrefix(target, "http://")
+	fmt.Fprintf(conn, "GET %s/ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n%s", target, host, protocol, payload)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("读取升级响应失败: %v", err)
+	}
+	return conn, br, resp
+}
+
+// TestUpgrade 测试WebSocket升级后双向转发，并与CONNECT隧道一样登记、计时和记录日志
+func TestUpgrade(t *testing.T) {
+	backend := startUpgradeServer(t)
+	var buf syncBuffer
+	proxy := NewForwardProxy()
+	proxy.SetTunnelTimeouts(200*time.Millisecond, 0)
+	proxy.SetAccessLog(accesslog.New(&buf, accesslog.FormatJSON))
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyAddr := strings.TrimPrefix(proxyServer.URL, "http://")
+
+	conn, br, resp := dialUpgrade(t, proxyAddr, backend.URL, "websocket", "ping")
+	if resp.StatusCode != http.StatusSwitchingProtocols || upgradeType(resp.Header) != "websocket" {
+		t.Fatalf("升级失败: %s %v", resp.Status, resp.Header)
+	}
+	if resp.Header.Get("Via") == "" {
+		t.Error("升级响应中缺少Via头")
+	}
+
+	// 握手后立即发送的数据也要转发
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != "ping" {
+		t.Fatalf("读取回显失败: %q %v", got, err)
+	}
+	// 请求处理结束后连接仍然可用
+	time.Sleep(50 * time.Millisecond)
+	conn.Write([]byte("pong"))
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != "pong" {
+		t.Fatalf("读取回显失败: %q %v", got, err)
+	}
+	if n := proxy.tunnels.Len(); n != 1 {
+		t.Errorf("升级的连接应登记为隧道, 实际 %d", n)
+	}
+
+	// 空闲超时后关闭
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("空闲超时后连接应被关闭, 实际 %v", err)
+	}
+
+	var entries []map[string]interface{}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if entries = buf.entries(t); len(entries) == 1 {
+			break
+		}
+	}
+	if len(entries) != 1 {
+		t.Fatalf("期望1条访问记录, 实际 %d", len(entries))
+	}
+	if entries[0]["method"] != "GET" || entries[0]["status"] != 101.0 || entries[0]["bytes"] != 8.0 || entries[0]["bytes_in"] != 8.0 {
+		t.Errorf("访问记录不匹配: %v", entries[0])
+	}
+}
+
+// TestUpgradeRefused 测试上游不接受升级时按普通响应返回
+func TestUpgradeRefused(t *testing.T) {
+	backend := startUpgradeServer(t)
+	proxyServer := httptest.NewServer(NewForwardProxy())
+	defer proxyServer.Close()
+
+	_, _, resp := dialUpgrade(t, strings.TrimPrefix(proxyServer.URL, "http://"), backend.URL, "h2c", "")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "no upgrade" {
+		t.Errorf("期望普通响应, 实际 %s %q", resp.Status, body)
+	}
+}
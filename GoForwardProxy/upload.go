@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultExpectContinueTimeout 请求带有Expect: 100-continue时等待上游100 Continue的默认时间，
+// 超时后直接发送请求体，与http.DefaultTransport一致
+const defaultExpectContinueTimeout = time.Second
+
+// SetMaxRequestBody 设置请求体的大小上限（字节），超过时返回413，0表示不限制
+func (p *ForwardProxy) SetMaxRequestBody(n int64) {
+	p.maxRequestBody = n
+}
+
+// SetExpectContinueTimeout 设置等待上游100 Continue的时间，0表示不等待、立即发送请求体
+func (p *ForwardProxy) SetExpectContinueTimeout(timeout time.Duration) {
+	p.client.Transport.(*http.Transport).ExpectContinueTimeout = timeout
+}
+
+// setUpstreamBody 把客户端的请求体交给上游请求，保留Content-Length和Transfer-Encoding，
+// 使定长上传不会变成分块传输。
+// 客户端的100 Continue由http.Server在第一次读取请求体时发送，而Transport在收到上游的
+// 100 Continue（或等待超时）之后才读取请求体，所以Expect: 100-continue是端到端生效的。
+// 声明的长度超过上限时返回*http.MaxBytesError，此时不读取请求体，客户端不会收到100 Continue；
+// 长度未知的请求体在转发过程中超过上限时，上游请求失败并返回同样的错误
+func (p *ForwardProxy) setUpstreamBody(w http.ResponseWriter, r *http.Request, req *http.Request) error {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		req.Body, req.ContentLength = http.NoBody, 0
+		return nil
+	}
+	if p.maxRequestBody > 0 && r.ContentLength > p.maxRequestBody {
+		return &http.MaxBytesError{Limit: p.maxRequestBody}
+	}
+	req.Body = r.Body
+	if p.maxRequestBody > 0 {
+		req.Body = http.MaxBytesReader(w, r.Body, p.maxRequestBody)
+	}
+	req.ContentLength = r.ContentLength
+	req.TransferEncoding = r.TransferEncoding
+	return nil
+}
+
+// writeBodyTooLarge 请求体超过上限时返回413，err不是请求体超限的错误时返回false
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	logf(r.Context(), "请求体超过上限%d字节: %s %s", tooLarge.Limit, r.Method, r.URL)
+	// 客户端可能还在发送请求体，响应后关闭连接。HTTP/2下Connection: close会关闭整个连接，
+	// 未读取的请求体只影响当前流，不需要设置
+	if r.ProtoMajor == 1 {
+		w.Header().Set("Connection", "close")
+	}
+	http.Error(w, fmt.Sprintf("请求体超过上限%d字节", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+	return true
+}
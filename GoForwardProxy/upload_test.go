@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rawProxyRequest 直接在TCP连接上向代理发送请求头，用于控制请求体的发送时机
+func rawProxyRequest(t *testing.T, proxyAddr, head string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("连接代理失败: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, head); err != nil {
+		t.Fatalf("发送请求头失败: %v", err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+// TestUploadFraming 测试上传请求保留Content-Length和分块传输
+func TestUploadFraming(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d %v %s", r.ContentLength, r.TransferEncoding, body)
+	}))
+	defer backend.Close()
+	client := newProxyTestClient(t, NewForwardProxy())
+
+	tests := []struct {
+		name string
+		body io.Reader
+		size int64
+		want string
+	}{
+		{"定长", strings.NewReader("hello"), 5, "5 [] hello"},
+		{"分块", io.MultiReader(strings.NewReader("hel"), strings.NewReader("lo")), -1, "-1 [chunked] hello"},
+		{"空请求体", http.NoBody, 0, "0 [] "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPut, backend.URL, tt.body)
+			req.ContentLength = tt.size
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("请求失败: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != tt.want {
+				t.Errorf("上游收到的请求不正确, 期望 %q, 实际 %q", tt.want, body)
+			}
+		})
+	}
+}
+
+// TestExpectContinue 测试100-continue端到端生效：上游同意后客户端才收到100 Continue，
+// 上游直接拒绝时客户端不需要发送请求体
+func TestExpectContinue(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			http.Error(w, "需要认证", http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "expect=%s body=%s", r.Header.Get("Expect"), body)
+	}))
+	defer backend.Close()
+	proxy := NewForwardProxy()
+	// 上游支持100-continue，等待时间足够长，测试不会因为超时而发送请求体
+	proxy.SetExpectContinueTimeout(time.Minute)
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	proxyAddr := strings.TrimPrefix(server.URL, "http://")
+
+	head := "POST " + backend.URL + "/upload HTTP/1.1\r\nHost: " + strings.TrimPrefix(backend.URL, "http://") +
+		"\r\nExpect: 100-continue\r\nContent-Length: 5\r\n"
+
+	conn, br := rawProxyRequest(t, proxyAddr, head+"Authorization: Basic eDp5\r\n\r\n")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusContinue {
+		t.Fatalf("期望100 Continue, 实际 %v %v", resp, err)
+	}
+	io.WriteString(conn, "hello")
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("读取响应失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "expect=100-continue body=hello" {
+		t.Errorf("上游收到的请求不正确: %d %q", resp.StatusCode, body)
+	}
+
+	// 上游不读取请求体直接返回401，客户端不会收到100 Continue，收到最终响应后放弃发送请求体
+	conn, br = rawProxyRequest(t, proxyAddr, head+"\r\n")
+	resp, err = http.ReadResponse(br, nil)
+	conn.Close()
+	if err != nil {
+		t.Fatalf("读取响应失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized || !resp.Close {
+		t.Errorf("期望直接返回401并关闭连接, 实际 %d close=%v", resp.StatusCode, resp.Close)
+	}
+}
+
+// TestMaxRequestBody 测试请求体超过上限时返回413
+func TestMaxRequestBody(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "%d", len(body))
+	}))
+	defer backend.Close()
+	proxy := NewForwardProxy()
+	proxy.SetMaxRequestBody(10)
+	client := newProxyTestClient(t, proxy)
+
+	tests := []struct {
+		name   string
+		body   string
+		size   int64
+		status int
+	}{
+		{"未超过上限", "0123456789", 10, http.StatusOK},
+		{"声明的长度超过上限", "0123456789a", 11, http.StatusRequestEntityTooLarge},
+		{"分块传输超过上限", strings.Repeat("x", 64<<10), -1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, backend.URL, io.NopCloser(strings.NewReader(tt.body)))
+			req.ContentLength = tt.size
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("请求失败: %v", err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("期望状态码 %d, 实际 %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("声明的长度超过上限时不应连接上游, 上游收到 %d 次请求", n)
+	}
+
+	// 带有Expect: 100-continue时直接返回413，客户端不需要发送请求体
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	conn, br := rawProxyRequest(t, strings.TrimPrefix(server.URL, "http://"),
+		"PUT "+backend.URL+" HTTP/1.1\r\nHost: example.com\r\nExpect: 100-continue\r\nContent-Length: 100\r\n\r\n")
+	resp, err := http.ReadResponse(br, nil)
+	conn.Close()
+	if err != nil {
+		t.Fatalf("读取响应失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || !resp.Close {
+		t.Errorf("期望413并关闭连接, 实际 %d close=%v", resp.StatusCode, resp.Close)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// yamlLine 去掉注释和空行后的一行YAML
+type yamlLine struct {
+	num    int // 行号，从1开始
+	indent int
+	text   string
+}
+
+// yamlParser 按缩进解析YAML行
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseYAML 解析配置文件常用的YAML子集：按缩进嵌套的映射和列表、行内列表、引号字符串、
+// 数字、布尔值和null。不支持锚点、多文档、多行字符串和列表中的映射。
+// 返回值由map[string]interface{}、[]interface{}和标量组成，数字保留为yamlNumber原文，
+// 可以直接用encoding/json编码，也可以先用yamlToType按目标类型调整
+func parseYAML(data []byte) (interface{}, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(data), "\n") {
+		text := strings.TrimRight(stripYAMLComment(strings.TrimRight(raw, "\r")), " \t")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || (len(lines) == 0 && trimmed == "---") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("第%d行: 不能使用制表符缩进", i+1)
+		}
+		lines = append(lines, yamlLine{num: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.block(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(lines) {
+		return nil, fmt.Errorf("第%d行: 缩进不正确", lines[p.pos].num)
+	}
+	return v, nil
+}
+
+// block 解析从当前行开始、缩进为indent的映射或列表
+func (p *yamlParser) block(indent int) (interface{}, error) {
+	if isYAMLSeqItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func isYAMLSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// sequence 解析 "- 值" 形式的列表
+func (p *yamlParser) sequence(indent int) ([]interface{}, error) {
+	items := []interface{}{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent != indent || !isYAMLSeqItem(line.text) {
+			break
+		}
+		p.pos++
+		rest := strings.TrimSpace(strings.TrimPrefix(line.text, "-"))
+		if rest == "" {
+			// 值在下面的缩进块中
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				v, err := p.block(p.lines[p.pos].indent)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, v)
+			} else {
+				items = append(items, nil)
+			}
+			continue
+		}
+		if _, _, ok := splitYAMLKey(rest); ok {
+			return nil, fmt.Errorf("第%d行: 不支持列表中的映射", line.num)
+		}
+		v, err := yamlScalar(rest)
+		if err != nil {
+			return nil, fmt.Errorf("第%d行: %v", line.num, err)
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+// mapping 解析 "键: 值" 形式的映射
+func (p *yamlParser) mapping(indent int) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent || isYAMLSeqItem(line.text) {
+			return nil, fmt.Errorf("第%d行: 缩进不正确", line.num)
+		}
+		key, value, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("第%d行: 应为\"键: 值\"", line.num)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("第%d行: 重复的键 %q", line.num, key)
+		}
+		p.pos++
+		if value != "" {
+			v, err := yamlScalar(value)
+			if err != nil {
+				return nil, fmt.Errorf("第%d行: %v", line.num, err)
+			}
+			m[key] = v
+			continue
+		}
+		// 值在下面的缩进块中，列表也可以与键对齐
+		m[key] = nil
+		if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			if next.indent > indent || (next.indent == indent && isYAMLSeqItem(next.text)) {
+				v, err := p.block(next.indent)
+				if err != nil {
+					return nil, err
+				}
+				m[key] = v
+			}
+		}
+	}
+	return m, nil
+}
+
+// splitYAMLKey 拆分 "键: 值"，键可以带引号，没有冒号时返回false
+func splitYAMLKey(text string) (key, value string, ok bool) {
+	if text[0] == '"' || text[0] == '\'' {
+		end := yamlQuoteEnd(text)
+		if end < 0 {
+			return "", "", false
+		}
+		k, err := yamlScalar(text[:end+1])
+		rest := text[end+1:]
+		if err != nil || !strings.HasPrefix(rest, ":") || (len(rest) > 1 && rest[1] != ' ') {
+			return "", "", false
+		}
+		return k.(string), strings.TrimSpace(rest[1:]), true
+	}
+	if i := strings.Index(text, ": "); i >= 0 {
+		return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+2:]), true
+	}
+	if strings.HasSuffix(text, ":") {
+		return strings.TrimSpace(text[:len(text)-1]), "", true
+	}
+	return "", "", false
+}
+
+// yamlQuoteEnd 返回以引号开头的字符串中结束引号的位置，没有结束引号时返回-1
+func yamlQuoteEnd(s string) int {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote == '"' && s[i] == '\\':
+			i++
+		case s[i] == quote && quote == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// stripYAMLComment 去掉行尾注释，引号中的#不是注释
+func stripYAMLComment(s string) string {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" :[,-", s[i-1]) >= 0):
+			end := yamlQuoteEnd(s[i:])
+			if end < 0 {
+				return s
+			}
+			i += end
+		}
+	}
+	return s
+}
+
+// yamlScalar 解析标量或行内列表
+func yamlScalar(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		if yamlQuoteEnd(s) != len(s)-1 {
+			return nil, fmt.Errorf("引号不匹配: %s", s)
+		}
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("无效的字符串: %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if yamlQuoteEnd(s) != len(s)-1 {
+			return nil, fmt.Errorf("引号不匹配: %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.HasPrefix(s, "["):
+		return yamlFlowSequence(s)
+	case s == "{}":
+		return map[string]interface{}{}, nil
+	case strings.HasPrefix(s, "{"):
+		return nil, fmt.Errorf("不支持行内映射: %s", s)
+	}
+	switch strings.ToLower(s) {
+	case "null", "~":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if _, ok := yamlNumber(s).value(); ok {
+		return yamlNumber(s), nil
+	}
+	return s, nil
+}
+
+// yamlNumber 数字标量的原文。目标类型确定之前保留原文，
+// 写入字符串字段时不会把1.0变成1，也不会因为类型不符而出错
+type yamlNumber string
+
+// value 把原文解析为int64或float64，不是数字时返回false
+func (n yamlNumber) value() (interface{}, bool) {
+	s := string(n)
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return v, true
+	}
+	// 只把以数字、符号或小数点开头的值当作浮点数，避免inf、nan等被误解析
+	if s != "" && strings.IndexByte("+-.0123456789", s[0]) >= 0 {
+		if v, err := strconv.ParseFloat(s, 64); err == nil {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// MarshalJSON 按数值编码
+func (n yamlNumber) MarshalJSON() ([]byte, error) {
+	v, _ := n.value()
+	return json.Marshal(v)
+}
+
+// yamlToType 按目标类型调整解析结果：字符串类型的字段使用数字的原文。
+// 结构体按json标签匹配字段，找不到的键保持原样，由JSON解码报告未知的配置项
+func yamlToType(v interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch v := v.(type) {
+	case yamlNumber:
+		if t.Kind() == reflect.String {
+			return string(v)
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i := range v {
+				v[i] = yamlToType(v[i], t.Elem())
+			}
+		}
+	case map[string]interface{}:
+		switch t.Kind() {
+		case reflect.Map:
+			for k := range v {
+				v[k] = yamlToType(v[k], t.Elem())
+			}
+		case reflect.Struct:
+			for k := range v {
+				if f, ok := yamlField(t, k); ok {
+					v[k] = yamlToType(v[k], f.Type)
+				}
+			}
+		}
+	}
+	return v
+}
+
+// yamlField 按json标签查找结构体字段，与encoding/json一样不区分大小写
+func yamlField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// yamlFlowSequence 解析 [a, "b", 3] 形式的行内列表，元素只能是标量
+func yamlFlowSequence(s string) ([]interface{}, error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("行内列表缺少]: %s", s)
+	}
+	inner := strings.TrimSpace(s[1 : len(s)-1])
+	items := []interface{}{}
+	for inner != "" {
+		end := strings.IndexByte(inner, ',')
+		if inner[0] == '"' || inner[0] == '\'' {
+			q := yamlQuoteEnd(inner)
+			if q < 0 {
+				return nil, fmt.Errorf("引号不匹配: %s", s)
+			}
+			end = strings.IndexByte(inner[q:], ',')
+			if end >= 0 {
+				end += q
+			}
+		}
+		item := inner
+		if end >= 0 {
+			item, inner = inner[:end], strings.TrimSpace(inner[end+1:])
+		} else {
+			inner = ""
+		}
+		item = strings.TrimSpace(item)
+		if item == "" || item[0] == '[' || item[0] == '{' {
+			return nil, fmt.Errorf("不支持的行内列表: %s", s)
+		}
+		v, err := yamlScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
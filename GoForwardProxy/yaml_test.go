@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestParseYAML 测试YAML子集的解析
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  interface{}
+	}{
+		{"空文档", "# 只有注释\n\n", map[string]interface{}{}},
+		{"标量类型", "a: 1\nb: 1.5\nc: true\nd: null\ne: ~\nf: text\ng: \"1.2\"\nh: 'it''s'\ni: -3\nj: inf",
+			map[string]interface{}{"a": yamlNumber("1"), "b": yamlNumber("1.5"), "c": true, "d": nil, "e": nil, "f": "text", "g": "1.2", "h": "it's", "i": yamlNumber("-3"), "j": "inf"}},
+		{"嵌套映射", "---\na:\n  b:\n    c: 1\n  d: 2\ne: 3\n",
+			map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": yamlNumber("1")}, "d": yamlNumber("2")}, "e": yamlNumber("3")}},
+		{"列表", "a:\n  - x\n  - \"y z\"\nb:\n- 1\n- 2\n",
+			map[string]interface{}{"a": []interface{}{"x", "y z"}, "b": []interface{}{yamlNumber("1"), yamlNumber("2")}}},
+		{"行内列表", "a: [1, \"b,c\", d]\nb: []\nc: {}",
+			map[string]interface{}{"a": []interface{}{yamlNumber("1"), "b,c", "d"}, "b": []interface{}{}, "c": map[string]interface{}{}}},
+		{"注释和引号中的#", "a: \"x # y\" # 注释\nb: x#y\n\"c d\": 1",
+			map[string]interface{}{"a": "x # y", "b": "x#y", "c d": yamlNumber("1")}},
+		{"值中的冒号", "url: http://example.com:8080/a\naddr: \":8080\"",
+			map[string]interface{}{"url": "http://example.com:8080/a", "addr": ":8080"}},
+		{"空值", "a:\nb: 1", map[string]interface{}{"a": nil, "b": yamlNumber("1")}},
+		{"顶层列表", "- a\n- b", []interface{}{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("期望 %#v\n实际 %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestParseYAMLErrors 测试不支持或格式错误的YAML
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"制表符缩进", "a:\n\tb: 1"},
+		{"缩进不一致", "a:\n    b: 1\n  c: 2"},
+		{"多余的缩进", "a: 1\n  b: 2"},
+		{"重复的键", "a: 1\na: 2"},
+		{"不是键值对", "a: 1\njust text"},
+		{"行内映射", "a: {b: 1}"},
+		{"列表中的映射", "a:\n  - b: 1"},
+		{"引号不匹配", "a: \"abc"},
+		{"行内列表不完整", "a: [1, 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if v, err := parseYAML([]byte(tt.input)); err == nil {
+				t.Errorf("期望返回错误, 实际 %#v", v)
+			}
+		})
+	}
+}
@@ -1,3 +1,7 @@
 module GoHttpProxy
 
 go 1.20
+
+require goproxycommon v0.0.0
+
+replace goproxycommon => ../GoProxyCommon
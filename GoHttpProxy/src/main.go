@@ -3,9 +3,12 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"flag"
 	"io"
 	"log"
 	"net/http"
+
+	"goproxycommon/accesslog"
 )
 
 func handleRequestAndRedirect(res http.ResponseWriter, req *http.Request) {
@@ -39,6 +42,11 @@ func handleRequestAndRedirect(res http.ResponseWriter, req *http.Request) {
 	// Copy the headers from the incoming request to the outgoing request
 	outReq.Header = req.Header
 
+	// Record the upstream host in the access log
+	if e := accesslog.FromContext(req.Context()); e != nil {
+		e.Upstream = outReq.URL.Host
+	}
+
 	// Perform the request
 	client := &http.Client{}
 	resp, err := client.Do(outReq)
@@ -96,6 +104,12 @@ func handleRequestAndRedirect(res http.ResponseWriter, req *http.Request) {
 }
 
 func main() {
+	accessLogPath := flag.String("access-log", "", "access log file, \"-\" for stdout, empty to disable")
+	accessLogFormat := flag.String("access-log-format", "squid", "access log format: squid, combined or json")
+	accessLogSize := flag.Int64("access-log-max-size", 100, "rotate the access log at this size in MB, 0 to disable")
+	accessLogBackups := flag.Int("access-log-backups", 5, "number of rotated access log files to keep")
+	flag.Parse()
+
 	// Set up the HTTP server
 	http.HandleFunc("/", handleRequestAndRedirect)
 
@@ -109,6 +123,21 @@ func main() {
 		res.Write([]byte("POST request received"))
 	})
 
+	// Wrap all handlers with the shared access log
+	var handler http.Handler = http.DefaultServeMux
+	if *accessLogPath != "" {
+		format, err := accesslog.ParseFormat(*accessLogFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger, err := accesslog.Open(*accessLogPath, format, *accessLogSize<<20, *accessLogBackups)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer logger.Close()
+		handler = accesslog.Handler(logger, handler)
+	}
+
 	log.Println("Starting proxy server on :8088")
-	log.Fatal(http.ListenAndServe(":8088", nil))
+	log.Fatal(http.ListenAndServe(":8088", handler))
 }
@@ -0,0 +1,355 @@
+// Package accesslog 各代理共用的访问日志，支持Squid原生格式、Apache combined格式和JSON行格式
+package accesslog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format 访问日志格式
+type Format int
+
+const (
+	FormatSquid    Format = iota // Squid原生格式
+	FormatCombined               // Apache combined格式
+	FormatJSON                   // 每行一个JSON对象
+)
+
+// ParseFormat 解析格式名称：squid、combined 或 json
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "squid":
+		return FormatSquid, nil
+	case "combined":
+		return FormatCombined, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("不支持的访问日志格式: %s", s)
+}
+
+// Entry 一条访问记录
+type Entry struct {
+	Time        time.Time     // 请求开始时间
+	Duration    time.Duration // 处理时长
+	Client      string        // 客户端地址 host:port
+	User        string        // 认证用户名
+	Method      string
+	URL         string // 请求URL，CONNECT时为目标 host:port
+	Proto       string
+	Status      int
+	Bytes       int64  // 返回给客户端的字节数
+	BytesIn     int64  // 从客户端收到的字节数，只有隧道记录
+	Upstream    string // 实际连接的上游地址
+	Parent      bool   // Upstream是否为上级代理
+	Cache       string // 缓存结果：HIT、MISS、STALE、REVALIDATED
+	ContentType string
+	Referer     string
+	UserAgent   string
+}
+
+// Logger 访问日志写入器，可并发使用
+type Logger struct {
+	format  Format
+	mu      sync.Mutex
+	w       io.Writer
+	lastErr string // 上次报告的写入错误，相同的错误只报告一次
+}
+
+// New 创建按format格式写入w的访问日志
+func New(w io.Writer, format Format) *Logger {
+	return &Logger{format: format, w: w}
+}
+
+// Open 打开访问日志文件，path为"-"时写入标准输出；maxSize大于0时按大小轮转
+func Open(path string, format Format, maxSize int64, maxBackups int) (*Logger, error) {
+	if path == "-" {
+		// 隐藏os.Stdout的Close，关闭日志时不关闭标准输出
+		return New(struct{ io.Writer }{os.Stdout}, format), nil
+	}
+	f, err := OpenRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return New(f, format), nil
+}
+
+// Log 写入一条访问记录
+func (l *Logger) Log(e *Entry) {
+	var line []byte
+	switch l.format {
+	case FormatCombined:
+		line = formatCombined(e)
+	case FormatJSON:
+		line = formatJSON(e)
+	default:
+		line = formatSquid(e)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(line); err != nil {
+		if err.Error() != l.lastErr {
+			l.lastErr = err.Error()
+			log.Printf("写入访问日志失败: %v", err)
+		}
+	} else {
+		l.lastErr = ""
+	}
+}
+
+// Close 关闭底层的日志文件
+func (l *Logger) Close() error {
+	if c, ok := l.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// clientHost 去掉客户端地址中的端口
+func clientHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// dash 空字符串记为"-"
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// squidAction 返回Squid的结果代码，如 TCP_HIT、TCP_MISS、TCP_TUNNEL
+func squidAction(e *Entry) string {
+	switch {
+	case e.Status == http.StatusForbidden || e.Status == http.StatusProxyAuthRequired:
+		return "TCP_DENIED"
+	case e.Method == http.MethodConnect:
+		return "TCP_TUNNEL"
+	}
+	switch e.Cache {
+	case "HIT", "STALE":
+		return "TCP_HIT"
+	case "REVALIDATED":
+		return "TCP_REFRESH_UNMODIFIED"
+	}
+	return "TCP_MISS"
+}
+
+// squidHierarchy 返回Squid的层级代码和对端地址
+func squidHierarchy(e *Entry) string {
+	switch {
+	case e.Upstream == "":
+		return "HIER_NONE/-"
+	case e.Parent:
+		return "FIRSTUP_PARENT/" + e.Upstream
+	}
+	return "HIER_DIRECT/" + e.Upstream
+}
+
+// formatSquid 时间戳 耗时ms 客户端 结果/状态码 字节数 方法 URL 用户 层级/对端 类型
+func formatSquid(e *Entry) []byte {
+	ts := float64(e.Time.UnixNano()) / 1e9
+	return []byte(fmt.Sprintf("%.3f %6d %s %s/%03d %d %s %s %s %s %s\n",
+		ts, e.Duration.Milliseconds(), clientHost(e.Client), squidAction(e), e.Status, e.Bytes,
+		dash(e.Method), dash(e.URL), dash(e.User), squidHierarchy(e), dash(e.ContentType)))
+}
+
+// formatCombined 客户端 - 用户 [时间] "请求行" 状态码 字节数 "Referer" "User-Agent"
+func formatCombined(e *Entry) []byte {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	return []byte(fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		clientHost(e.Client), dash(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.URL, dash(e.Proto), e.Status, bytes, dash(e.Referer), dash(e.UserAgent)))
+}
+
+// jsonEntry JSON格式的字段
+type jsonEntry struct {
+	Time        string  `json:"time"`
+	DurationMS  float64 `json:"duration_ms"`
+	Client      string  `json:"client"`
+	User        string  `json:"user,omitempty"`
+	Method      string  `json:"method"`
+	URL         string  `json:"url"`
+	Proto       string  `json:"proto,omitempty"`
+	Status      int     `json:"status"`
+	Bytes       int64   `json:"bytes"`
+	BytesIn     int64   `json:"bytes_in,omitempty"`
+	Upstream    string  `json:"upstream,omitempty"`
+	Parent      bool    `json:"parent,omitempty"`
+	Cache       string  `json:"cache,omitempty"`
+	ContentType string  `json:"content_type,omitempty"`
+	Referer     string  `json:"referer,omitempty"`
+	UserAgent   string  `json:"user_agent,omitempty"`
+}
+
+func formatJSON(e *Entry) []byte {
+	line, _ := json.Marshal(jsonEntry{
+		Time:        e.Time.Format(time.RFC3339Nano),
+		DurationMS:  float64(e.Duration) / float64(time.Millisecond),
+		Client:      e.Client,
+		User:        e.User,
+		Method:      e.Method,
+		URL:         e.URL,
+		Proto:       e.Proto,
+		Status:      e.Status,
+		Bytes:       e.Bytes,
+		BytesIn:     e.BytesIn,
+		Upstream:    e.Upstream,
+		Parent:      e.Parent,
+		Cache:       e.Cache,
+		ContentType: e.ContentType,
+		Referer:     e.Referer,
+		UserAgent:   e.UserAgent,
+	})
+	return append(line, '\n')
+}
+
+// ResponseWriter 记录状态码和响应字节数的http.ResponseWriter
+type ResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+// NewResponseWriter 包装w以记录状态码和字节数
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+func (w *ResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush 支持流式响应
+func (w *ResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack 支持CONNECT等需要接管连接的请求，接管后由调用者自行记录
+func (w *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("不支持接管连接")
+	}
+	conn, brw, err := h.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, brw, err
+}
+
+// Detach 用于不劫持连接、直接把响应体作为数据流使用的请求（如HTTP/2的CONNECT），
+// 返回被包装的ResponseWriter，之后的写入不再统计，与Hijack一样由调用者自行记录
+func (w *ResponseWriter) Detach() http.ResponseWriter {
+	w.hijacked = true
+	return w.ResponseWriter
+}
+
+// Unwrap 供http.ResponseController使用
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Status 返回已写入的状态码，没有写入时为0
+func (w *ResponseWriter) Status() int {
+	return w.status
+}
+
+// Bytes 返回已写入的响应体字节数
+func (w *ResponseWriter) Bytes() int64 {
+	return w.bytes
+}
+
+// Hijacked 返回连接是否已被接管
+func (w *ResponseWriter) Hijacked() bool {
+	return w.hijacked
+}
+
+type entryKey struct{}
+
+// FromContext 返回Handler放入上下文的访问记录，供下游补充上游地址、用户等字段
+func FromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(entryKey{}).(*Entry)
+	return e
+}
+
+// Handler 记录每个请求的访问日志。连接被接管的请求不在这里记录
+func Handler(l *Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := NewEntry(r)
+		r = r.WithContext(context.WithValue(r.Context(), entryKey{}, e))
+		lw := NewResponseWriter(w)
+		next.ServeHTTP(lw, r)
+		if lw.Hijacked() {
+			return
+		}
+		e.Finish(lw)
+		l.Log(e)
+	})
+}
+
+// NewEntry 根据请求创建访问记录，开始计时
+func NewEntry(r *http.Request) *Entry {
+	target := r.URL.String()
+	if r.Method == http.MethodConnect {
+		target = r.Host
+	}
+	return &Entry{
+		Time:      time.Now(),
+		Client:    r.RemoteAddr,
+		Method:    r.Method,
+		URL:       target,
+		Proto:     r.Proto,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// Finish 从响应中补全状态码、字节数、内容类型和缓存结果，并计算耗时
+func (e *Entry) Finish(w *ResponseWriter) {
+	e.Duration = time.Since(e.Time)
+	e.Status = w.Status()
+	if e.Status == 0 {
+		e.Status = http.StatusOK
+	}
+	e.Bytes = w.Bytes()
+	if e.ContentType == "" {
+		e.ContentType = w.Header().Get("Content-Type")
+	}
+	if e.Cache == "" {
+		e.Cache = w.Header().Get("X-Cache")
+	}
+}
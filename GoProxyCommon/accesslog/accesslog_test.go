@@ -0,0 +1,181 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFormats 测试三种日志格式
+func TestFormats(t *testing.T) {
+	e := &Entry{
+		Time:        time.Date(2024, 5, 1, 8, 30, 0, 123e6, time.FixedZone("CST", 8*3600)),
+		Duration:    180 * time.Millisecond,
+		Client:      "192.168.0.224:50312",
+		User:        "alice",
+		Method:      "GET",
+		URL:         "http://www.example.com/",
+		Proto:       "HTTP/1.1",
+		Status:      200,
+		Bytes:       411,
+		Upstream:    "93.184.216.34:80",
+		Cache:       "MISS",
+		ContentType: "text/html",
+		UserAgent:   "curl/8.0",
+	}
+	tests := []struct {
+		format Format
+		want   string
+	}{
+		{FormatSquid, "1714523400.123    180 192.168.0.224 TCP_MISS/200 411 GET http://www.example.com/ alice HIER_DIRECT/93.184.216.34:80 text/html\n"},
+		{FormatCombined, "192.168.0.224 - alice [01/May/2024:08:30:00 +0800] \"GET http://www.example.com/ HTTP/1.1\" 200 411 \"-\" \"curl/8.0\"\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		New(&buf, tt.format).Log(e)
+		if buf.String() != tt.want {
+			t.Errorf("格式%d不匹配:\n期望 %q\n实际 %q", tt.format, tt.want, buf.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	New(&buf, FormatJSON).Log(e)
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("JSON格式无效: %v", err)
+	}
+	for key, want := range map[string]interface{}{"client": "192.168.0.224:50312", "status": 200.0, "bytes": 411.0, "duration_ms": 180.0, "cache": "MISS", "upstream": "93.184.216.34:80"} {
+		if got[key] != want {
+			t.Errorf("JSON字段%s不匹配, 期望 %v, 实际 %v", key, want, got[key])
+		}
+	}
+}
+
+// TestSquidAction 测试Squid结果代码和层级代码
+func TestSquidAction(t *testing.T) {
+	tests := []struct {
+		entry Entry
+		want  string
+	}{
+		{Entry{Method: "GET", Status: 200, Cache: "HIT"}, "TCP_HIT/200 0 GET - - HIER_NONE/-"},
+		{Entry{Method: "GET", Status: 200, Cache: "REVALIDATED"}, "TCP_REFRESH_UNMODIFIED/200 0 GET - - HIER_NONE/-"},
+		{Entry{Method: "CONNECT", URL: "example.com:443", Status: 200, Upstream: "proxy:3128", Parent: true}, "TCP_TUNNEL/200 0 CONNECT example.com:443 - FIRSTUP_PARENT/proxy:3128"},
+		{Entry{Method: "CONNECT", URL: "10.0.0.1:22", Status: 403}, "TCP_DENIED/403 0 CONNECT 10.0.0.1:22 - HIER_NONE/-"},
+	}
+	for _, tt := range tests {
+		line := string(formatSquid(&tt.entry))
+		if !strings.Contains(line, tt.want) {
+			t.Errorf("Squid日志不匹配, 期望包含 %q, 实际 %q", tt.want, line)
+		}
+	}
+}
+
+// TestHandler 测试中间件记录状态码、字节数和下游补充的字段
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	handler := Handler(New(&buf, FormatJSON), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).Upstream = "backend:8081"
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "hello")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api", nil))
+
+	var got jsonEntry
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("JSON格式无效: %v", err)
+	}
+	if got.Status != http.StatusCreated || got.Bytes != 5 || got.Upstream != "backend:8081" || got.ContentType != "text/plain" || got.Method != "POST" {
+		t.Errorf("访问记录不匹配: %+v", got)
+	}
+}
+
+// TestDetach 测试接管响应流后不再统计字节数
+func TestDetach(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := NewResponseWriter(rec)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w.Detach(), "stream")
+	if !w.Hijacked() || w.Bytes() != 0 {
+		t.Errorf("接管后应视为已劫持且不统计字节数: hijacked=%v bytes=%d", w.Hijacked(), w.Bytes())
+	}
+	if rec.Body.String() != "stream" {
+		t.Errorf("数据应写入被包装的ResponseWriter: %q", rec.Body.String())
+	}
+}
+
+// TestRotatingFile 测试按大小轮转和旧文件数量限制
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("打开日志文件失败: %v", err)
+	}
+	defer rf.Close()
+	for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("写入失败: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"access.log", "line4\n"},
+		{"access.log.1", "line3\n"},
+		{"access.log.2", "line2\n"},
+	}
+	for _, tt := range tests {
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(path), tt.name))
+		if err != nil || string(data) != tt.want {
+			t.Errorf("%s 内容不匹配: %q %v", tt.name, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("超过保留数量的旧文件应被删除")
+	}
+}
+
+// TestRotatingFileRenameFailure 测试轮转失败时继续写入原文件
+func TestRotatingFileRenameFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	// 非空目录占用了path.1，改名会失败
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0755); err != nil {
+		t.Fatalf("创建目录失败: %v", err)
+	}
+	rf, err := OpenRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatalf("打开日志文件失败: %v", err)
+	}
+	defer rf.Close()
+
+	tests := []struct {
+		line    string
+		wantErr bool
+	}{
+		{"line1\n", false},
+		{"line2\n", true}, // 轮转失败只报告一次
+		{"x\n", false},
+		{"line3\n", true}, // 再写入maxSize字节后重试轮转
+	}
+	for _, tt := range tests {
+		n, err := rf.Write([]byte(tt.line))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("写入%q的错误不符合预期: %v", tt.line, err)
+		}
+		if n != len(tt.line) {
+			t.Errorf("写入%q的字节数期望 %d, 实际 %d", tt.line, len(tt.line), n)
+		}
+	}
+	if data, _ := os.ReadFile(path); string(data) != "line1\nline2\nx\nline3\n" {
+		t.Errorf("日志应继续写入原文件: %q", data)
+	}
+}
@@ -0,0 +1,117 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile 按大小轮转的日志文件：超过MaxSize时将当前文件改名为 path.1，
+// 原有的 path.1 改名为 path.2，依此类推，最多保留MaxBackups个旧文件
+type RotatingFile struct {
+	path       string
+	maxSize    int64 // 0表示不轮转
+	maxBackups int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+// OpenRotatingFile 以追加方式打开日志文件
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("打开日志文件失败: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = info.Size()
+	return nil
+}
+
+// Write 写入一条日志，写入后超过大小上限时先轮转。
+// 轮转失败时日志继续追加到原文件，返回写入的字节数和轮转错误
+func (rf *RotatingFile) Write(b []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.closed {
+		return 0, os.ErrClosed
+	}
+	if rf.f == nil {
+		// 上次轮转后未能重新打开，再试一次
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	var rotateErr error
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(b)) > rf.maxSize {
+		if rotateErr = rf.rotate(); rf.f == nil {
+			return 0, rotateErr
+		}
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate 关闭当前文件，依次改名旧文件后重新打开，调用者需持有rf.mu。
+// 改名失败时以追加方式重新打开原文件，并在再写入maxSize字节后才重试轮转，
+// 避免每条日志都报告同一个错误
+func (rf *RotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		rf.f = nil
+		return rf.reopen(err)
+	}
+	rf.f = nil
+	if rf.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+		for i := rf.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return rf.reopen(err)
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return rf.reopen(err)
+	}
+	return rf.open()
+}
+
+// reopen 轮转失败后以追加方式重新打开日志文件
+func (rf *RotatingFile) reopen(cause error) error {
+	if err := rf.open(); err != nil {
+		return fmt.Errorf("日志轮转失败: %v; %v", cause, err)
+	}
+	rf.size = 0
+	return fmt.Errorf("日志轮转失败: %v", cause)
+}
+
+// Close 关闭日志文件
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.closed = true
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
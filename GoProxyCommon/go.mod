@@ -0,0 +1,3 @@
+module goproxycommon
+
+go 1.20
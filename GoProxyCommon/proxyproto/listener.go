@@ -0,0 +1,169 @@
+package proxyproto
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHeaderTimeout 等待PROXY协议头的默认超时
+const DefaultHeaderTimeout = 5 * time.Second
+
+// ParseCIDRs 解析逗号分隔的CIDR列表，单个IP视为/32或/128
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("无效的IP地址: %s", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("无效的CIDR: %s", item)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Listener 只对来自可信地址的连接解析PROXY协议头，其他连接原样返回，
+// 避免任意客户端伪造来源地址
+type Listener struct {
+	net.Listener
+	Trusted       []*net.IPNet  // 可信的负载均衡器地址
+	HeaderTimeout time.Duration // 等待协议头的超时，0表示DefaultHeaderTimeout
+}
+
+// NewListener 包装l，解析来自trusted地址的PROXY协议头
+func NewListener(l net.Listener, trusted []*net.IPNet) *Listener {
+	return &Listener{Listener: l, Trusted: trusted}
+}
+
+// Accept 接受连接，可信来源的连接在第一次读取或查询地址时解析协议头，不阻塞Accept
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	timeout := l.HeaderTimeout
+	if timeout == 0 {
+		timeout = DefaultHeaderTimeout
+	}
+	return &Conn{Conn: conn, br: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.Trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn 来自可信来源的连接，RemoteAddr和LocalAddr返回协议头中的地址；
+// 没有协议头时与原连接相同，协议头格式错误时读取返回错误
+type Conn struct {
+	net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header *Header
+	err    error
+
+	mu           sync.Mutex
+	readDeadline time.Time // 调用者设置的读截止时间，解析协议头后恢复
+}
+
+// init 解析协议头，只执行一次
+func (c *Conn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.header, c.err = Read(c.br)
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+		if c.err != nil {
+			c.err = fmt.Errorf("读取PROXY协议头失败: %w", c.err)
+		}
+	})
+}
+
+// Header 返回解析到的协议头，没有协议头时返回nil
+func (c *Conn) Header() (*Header, error) {
+	c.init()
+	return c.header, c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// RemoteAddr 返回真实的客户端地址
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr 返回客户端实际连接的地址
+func (c *Conn) LocalAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// SetDeadline 记录读截止时间，使解析协议头时设置的超时不会覆盖它
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline 同SetDeadline
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// CloseWrite 半关闭底层连接
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
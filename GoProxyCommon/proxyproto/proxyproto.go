@@ -0,0 +1,232 @@
+// Package proxyproto 解析和生成HAProxy PROXY协议（v1文本格式和v2二进制格式）的连接头，
+// 使位于TCP负载均衡器之后的代理能得到真实的客户端地址
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// v2Signature v2格式的12字节签名
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1MaxLength v1格式头部的最大长度，包括结尾的CRLF
+const v1MaxLength = 107
+
+const (
+	v2CmdLocal = 0x0
+	v2CmdProxy = 0x1
+
+	v2FamilyInet  = 0x1
+	v2FamilyInet6 = 0x2
+
+	v2ProtoStream = 0x1
+	v2ProtoDgram  = 0x2
+)
+
+// ErrInvalidHeader PROXY协议头格式错误
+var ErrInvalidHeader = errors.New("无效的PROXY协议头")
+
+// Header PROXY协议头
+type Header struct {
+	Version     int      // 1或2
+	Source      net.Addr // 客户端地址，为nil表示LOCAL命令或UNKNOWN协议，应使用连接本身的地址
+	Destination net.Addr // 客户端连接的目标地址
+}
+
+// Read 从r中读取PROXY协议头。数据不以PROXY协议头开始时返回nil且不消耗任何数据
+func Read(r *bufio.Reader) (*Header, error) {
+	// 逐步查看前缀，避免等待比客户端首包更多的数据（如SOCKS5握手只有3个字节）
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case v2Signature[0]:
+		prefix, err := r.Peek(len(v2Signature))
+		if err != nil || !bytes.Equal(prefix, v2Signature) {
+			return nil, err
+		}
+		return readV2(r)
+	case 'P':
+		prefix, err := r.Peek(6)
+		if err != nil || string(prefix) != "PROXY " {
+			return nil, err
+		}
+		return readV1(r)
+	}
+	return nil, nil
+}
+
+// readV1 解析 "PROXY TCP4 源地址 目标地址 源端口 目标端口\r\n"
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1头部过长或缺少CRLF", ErrInvalidHeader)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Version: 1}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+	src, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	return &Header{Version: 1, Source: src, Destination: dst}, nil
+}
+
+func parseV1Addr(proto, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (proto == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("%w: 地址 %q 与协议 %s 不符", ErrInvalidHeader, host, proto)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: 端口 %q", ErrInvalidHeader, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 解析二进制格式，忽略地址之后的TLV扩展
+func readV2(r *bufio.Reader) (*Header, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: 不支持的版本 %d", ErrInvalidHeader, fixed[12]>>4)
+	}
+	command := fixed[12] & 0x0F
+	family, proto := fixed[13]>>4, fixed[13]&0x0F
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+	switch command {
+	case v2CmdLocal:
+		return h, nil
+	case v2CmdProxy:
+	default:
+		return nil, fmt.Errorf("%w: 未知的命令 %d", ErrInvalidHeader, command)
+	}
+	var ipLen int
+	switch family {
+	case v2FamilyInet:
+		ipLen = net.IPv4len
+	case v2FamilyInet6:
+		ipLen = net.IPv6len
+	default:
+		// UNIX套接字等地址对代理没有意义，按LOCAL处理
+		return h, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, fmt.Errorf("%w: 地址长度不足", ErrInvalidHeader)
+	}
+	srcIP := net.IP(append([]byte(nil), payload[:ipLen]...))
+	dstIP := net.IP(append([]byte(nil), payload[ipLen:2*ipLen]...))
+	srcPort := int(binary.BigEndian.Uint16(payload[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))
+	if proto == v2ProtoDgram {
+		h.Source = &net.UDPAddr{IP: srcIP, Port: srcPort}
+		h.Destination = &net.UDPAddr{IP: dstIP, Port: dstPort}
+	} else {
+		h.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+		h.Destination = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	}
+	return h, nil
+}
+
+// addrIPPort 取出TCP或UDP地址的IP和端口
+func addrIPPort(addr net.Addr) (net.IP, int, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, true
+	case *net.UDPAddr:
+		return a.IP, a.Port, true
+	}
+	return nil, 0, false
+}
+
+// Format 按h.Version生成PROXY协议头。源或目标地址不是IP地址时，
+// v1生成UNKNOWN，v2生成LOCAL命令；地址族不同时统一使用IPv6格式
+func (h *Header) Format() ([]byte, error) {
+	srcIP, srcPort, srcOK := addrIPPort(h.Source)
+	dstIP, dstPort, dstOK := addrIPPort(h.Destination)
+	known := srcOK && dstOK
+	ipv4 := known && srcIP.To4() != nil && dstIP.To4() != nil
+	if ipv4 {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	} else if known {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+
+	switch h.Version {
+	case 1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP6"
+		if ipv4 {
+			proto = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, srcPort, dstPort)), nil
+	case 2:
+		buf := append([]byte(nil), v2Signature...)
+		if !known {
+			return append(buf, 0x20|v2CmdLocal, 0x00, 0x00, 0x00), nil
+		}
+		family := byte(v2FamilyInet6)
+		if ipv4 {
+			family = v2FamilyInet
+		}
+		proto := byte(v2ProtoStream)
+		if _, ok := h.Source.(*net.UDPAddr); ok {
+			proto = v2ProtoDgram
+		}
+		buf = append(buf, 0x20|v2CmdProxy, family<<4|proto)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(2*len(srcIP)+4))
+		buf = append(buf, srcIP...)
+		buf = append(buf, dstIP...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(srcPort))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(dstPort))
+		return buf, nil
+	}
+	return nil, fmt.Errorf("不支持的PROXY协议版本: %d", h.Version)
+}
+
+// WriteHeader 向w写入一个PROXY协议头
+func WriteHeader(w io.Writer, version int, src, dst net.Addr) error {
+	h := &Header{Version: version, Source: src, Destination: dst}
+	b, err := h.Format()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
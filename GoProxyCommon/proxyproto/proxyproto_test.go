@@ -0,0 +1,160 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRoundTrip 测试v1和v2格式的生成与解析
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  int
+		src, dst net.Addr
+		wantV1   string
+	}{
+		{"IPv4", 1, &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}, "PROXY TCP4 192.0.2.10 198.51.100.1 51234 443\r\n"},
+		{"IPv6", 1, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}, "PROXY TCP6 2001:db8::1 2001:db8::2 40000 80\r\n"},
+		{"IPv4 v2", 2, &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}, ""},
+		{"混合地址族 v2", 2, &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 1}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteHeader(&buf, tt.version, tt.src, tt.dst); err != nil {
+				t.Fatalf("生成协议头失败: %v", err)
+			}
+			if tt.wantV1 != "" && buf.String() != tt.wantV1 {
+				t.Errorf("v1格式不匹配: %q", buf.String())
+			}
+			buf.WriteString("GET / HTTP/1.1\r\n")
+
+			br := bufio.NewReader(&buf)
+			h, err := Read(br)
+			if err != nil || h == nil {
+				t.Fatalf("解析协议头失败: %v", err)
+			}
+			if h.Version != tt.version || !sameAddr(h.Source, tt.src) || !sameAddr(h.Destination, tt.dst) {
+				t.Errorf("协议头不匹配: %+v", h)
+			}
+			if rest, _ := io.ReadAll(br); string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("协议头之后的数据不正确: %q", rest)
+			}
+		})
+	}
+}
+
+func sameAddr(a, b net.Addr) bool {
+	ta, _ := a.(*net.TCPAddr)
+	tb, _ := b.(*net.TCPAddr)
+	return ta != nil && tb != nil && ta.IP.Equal(tb.IP) && ta.Port == tb.Port
+}
+
+// TestReadSpecial 测试没有协议头、UNKNOWN、LOCAL和错误格式
+func TestReadSpecial(t *testing.T) {
+	local, _ := (&Header{Version: 2}).Format()
+	tests := []struct {
+		name       string
+		input      string
+		wantHeader bool
+		wantErr    bool
+	}{
+		{"普通HTTP请求", "POST / HTTP/1.1\r\n", false, false},
+		{"SOCKS5握手", "\x05\x01\x00", false, false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", true, false},
+		{"v2 LOCAL", string(local), true, false},
+		{"v1缺少CRLF", "PROXY TCP4 1.2.3.4 5.6.7.8 1 2\n", false, true},
+		{"v1地址族不符", "PROXY TCP4 ::1 ::1 1 2\r\n", false, true},
+		{"v1端口无效", "PROXY TCP4 1.2.3.4 5.6.7.8 1 99999\r\n", false, true},
+		{"v1过长", "PROXY " + strings.Repeat("x", 200), false, true},
+		{"v2版本错误", string(v2Signature) + "\x11\x11\x00\x00", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := Read(bufio.NewReader(strings.NewReader(tt.input)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("错误不符合预期: %v", err)
+			}
+			if (h != nil) != tt.wantHeader {
+				t.Fatalf("协议头不符合预期: %+v", h)
+			}
+			if h != nil && h.Source != nil {
+				t.Errorf("UNKNOWN和LOCAL不应包含地址: %+v", h)
+			}
+			if tt.wantErr && !errors.Is(err, ErrInvalidHeader) && err != io.EOF && err != io.ErrUnexpectedEOF {
+				t.Errorf("错误类型不正确: %v", err)
+			}
+		})
+	}
+}
+
+// TestListener 测试只有可信来源的协议头生效
+func TestListener(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    string
+		send       string
+		wantRemote string
+		wantData   string
+	}{
+		{"可信来源", "127.0.0.1", "PROXY TCP4 203.0.113.7 127.0.0.1 40000 80\r\nhello", "203.0.113.7:40000", "hello"},
+		{"可信来源没有协议头", "127.0.0.0/8", "hello", "127.0.0.1", "hello"},
+		{"不可信来源", "10.0.0.0/8", "PROXY TCP4 203.0.113.7 127.0.0.1 40000 80\r\nhello", "127.0.0.1", "PROXY TCP4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := ParseCIDRs(tt.trusted)
+			if err != nil {
+				t.Fatalf("解析CIDR失败: %v", err)
+			}
+			raw, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("监听失败: %v", err)
+			}
+			l := NewListener(raw, trusted)
+			defer l.Close()
+
+			client, err := net.Dial("tcp", raw.Addr().String())
+			if err != nil {
+				t.Fatalf("连接失败: %v", err)
+			}
+			defer client.Close()
+			client.Write([]byte(tt.send))
+
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatalf("接受连接失败: %v", err)
+			}
+			defer conn.Close()
+			// 调用者设置的截止时间在解析协议头后仍然有效
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if remote := conn.RemoteAddr().String(); !strings.HasPrefix(remote, tt.wantRemote) {
+				t.Errorf("客户端地址不匹配, 期望 %s, 实际 %s", tt.wantRemote, remote)
+			}
+			buf := make([]byte, len(tt.wantData))
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != tt.wantData {
+				t.Errorf("数据不匹配: %q %v", buf, err)
+			}
+		})
+	}
+}
+
+// TestParseCIDRs 测试可信地址列表解析
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs("10.0.0.0/8, 192.0.2.1,2001:db8::1")
+	if err != nil || len(nets) != 3 {
+		t.Fatalf("解析失败: %v %v", nets, err)
+	}
+	if !nets[1].Contains(net.ParseIP("192.0.2.1")) || nets[1].Contains(net.ParseIP("192.0.2.2")) {
+		t.Errorf("单个IP应视为/32: %v", nets[1])
+	}
+	if _, err := ParseCIDRs("not-an-ip"); err == nil {
+		t.Error("无效地址应解析失败")
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"time"
+
+	"goproxycommon/accesslog"
+	"goproxycommon/proxyproto"
 )
 
 // ProxyServer 代理服务器结构体
@@ -42,6 +47,10 @@ func NewProxyServer(target string) (*ProxyServer, error) {
 		originalDirector(req)
 		// 添加自定义请求头
 		req.Header.Set("X-Proxy-Server", "Go-Proxy")
+		// 访问日志中记录转发的目标地址
+		if e := accesslog.FromContext(req.Context()); e != nil {
+			e.Upstream = targetURL.Host
+		}
 		log.Printf("转发请求到: %s", targetURL.String())
 	}
 
@@ -64,6 +73,13 @@ func (p *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	accessLogPath := flag.String("access-log", "", "访问日志文件，\"-\"表示标准输出，为空时只输出调试日志")
+	accessLogFormat := flag.String("access-log-format", "combined", "访问日志格式: squid、combined 或 json")
+	accessLogSize := flag.Int64("access-log-max-size", 100, "访问日志轮转大小（MB），0表示不轮转")
+	accessLogBackups := flag.Int("access-log-backups", 5, "访问日志保留的旧文件数")
+	proxyProtoFrom := flag.String("proxy-protocol-from", "", "信任PROXY协议头的负载均衡器地址（CIDR），逗号分隔，为空时不解析")
+	flag.Parse()
+
 	// 配置目标URL
 	targetURL := "http://localhost:8081" // 示例目标地址
 	
@@ -76,14 +92,39 @@ func main() {
 	// 创建路由器
 	mux := http.NewServeMux()
 	
-	// 注册代理处理器并添加日志中间件
-	mux.Handle("/", LoggingMiddleware(proxy))
+	// 注册代理处理器并添加日志中间件，配置了访问日志时使用统一的访问日志格式
+	if *accessLogPath != "" {
+		format, err := accesslog.ParseFormat(*accessLogFormat)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		logger, err := accesslog.Open(*accessLogPath, format, *accessLogSize<<20, *accessLogBackups)
+		if err != nil {
+			log.Fatalf("打开访问日志失败: %v", err)
+		}
+		defer logger.Close()
+		mux.Handle("/", accesslog.Handler(logger, proxy))
+	} else {
+		mux.Handle("/", LoggingMiddleware(proxy))
+	}
 
 	// 启动服务器
 	serverAddr := ":8080"
 	fmt.Printf("代理服务器启动于 %s，转发至 %s\n", serverAddr, targetURL)
 	
-	if err := http.ListenAndServe(serverAddr, mux); err != nil {
+	listener, err := net.Listen("tcp", serverAddr)
+	if err != nil {
+		log.Fatalf("服务器启动失败: %v", err)
+	}
+	// 位于TCP负载均衡器之后时，从PROXY协议头中取得真实的客户端地址
+	trusted, err := proxyproto.ParseCIDRs(*proxyProtoFrom)
+	if err != nil {
+		log.Fatalf("解析PROXY协议可信地址失败: %v", err)
+	}
+	if len(trusted) > 0 {
+		listener = proxyproto.NewListener(listener, trusted)
+	}
+	if err := http.Serve(listener, mux); err != nil {
 		log.Fatalf("服务器启动失败: %v", err)
 	}
 }
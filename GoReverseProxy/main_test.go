@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -8,6 +10,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"goproxycommon/accesslog"
 )
 
 // 模拟后端服务器
@@ -115,3 +119,42 @@ func TestProxyServerError(t *testing.T) {
 		t.Errorf("期望状态码 %d，实际 %d", http.StatusBadGateway, resp.StatusCode)
 	}
 }
+
+// TestProxyServerAccessLog 测试访问日志记录状态码、字节数和转发目标
+func TestProxyServerAccessLog(t *testing.T) {
+	backendServer := mockBackendServer()
+	defer backendServer.Close()
+
+	proxy, err := NewProxyServer(backendServer.URL)
+	if err != nil {
+		t.Fatalf("创建代理服务器失败: %v", err)
+	}
+
+	var buf bytes.Buffer
+	proxyServer := httptest.NewServer(accesslog.Handler(accesslog.New(&buf, accesslog.FormatJSON), proxy))
+	defer proxyServer.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(proxyServer.URL + "/api/test")
+	if err != nil {
+		t.Fatalf("请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	var entry struct {
+		Method   string `json:"method"`
+		URL      string `json:"url"`
+		Status   int    `json:"status"`
+		Bytes    int    `json:"bytes"`
+		Upstream string `json:"upstream"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("访问日志不是有效的JSON: %q", buf.String())
+	}
+	wantUpstream := strings.TrimPrefix(backendServer.URL, "http://")
+	if entry.Method != "GET" || entry.URL != "/api/test" || entry.Status != http.StatusOK ||
+		entry.Bytes != len(body) || entry.Upstream != wantUpstream {
+		t.Errorf("访问记录不匹配: %+v", entry)
+	}
+}